@@ -0,0 +1,68 @@
+package tortugasync
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ParseSigner parses a PEM encoded private key, decrypting it with
+// passphrase if it's protected.
+// If cert isn't empty it must be an OpenSSH user certificate for the key in
+// authorized_keys format (the content of a *-cert.pub file), the returned
+// signer then authenticates with the certificate instead of the bare key.
+func ParseSigner(key, passphrase, cert []byte) (ssh.Signer, error) {
+	var (
+		signer ssh.Signer
+		err    error
+	)
+
+	if len(passphrase) > 0 {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ParseSigner: ssh.ParsePrivateKey: %w", err)
+	}
+
+	if len(cert) == 0 {
+		return signer, nil
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(cert)
+	if err != nil {
+		return nil, fmt.Errorf("ParseSigner: ssh.ParseAuthorizedKey: %w", err)
+	}
+	c, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("ParseSigner: %s is not a certificate", pub.Type())
+	}
+
+	signer, err = ssh.NewCertSigner(c, signer)
+	if err != nil {
+		return nil, fmt.Errorf("ParseSigner: ssh.NewCertSigner: %w", err)
+	}
+	return signer, nil
+}
+
+// AgentSigners returns the signers of the ssh-agent listening on the unix
+// socket at sock.
+// The returned connection must stay open as long as the signers are used,
+// reconnecting included: set it as the Agent of the Bay.
+func AgentSigners(sock string) ([]ssh.Signer, io.Closer, error) {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("AgentSigners: net.Dial: %w", err)
+	}
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("AgentSigners: agent.Signers: %w", err)
+	}
+	return signers, conn, nil
+}
@@ -0,0 +1,164 @@
+package tortugasync
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestParseSigner(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := pem.EncodeToMemory(block)
+	if block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("arrr")); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := pem.EncodeToMemory(block)
+
+	// A user certificate for the key signed by a CA.
+	cert := &ssh.Certificate{
+		Key:             sshPub,
+		CertType:        ssh.UserCert,
+		KeyId:           "kobo",
+		ValidPrincipals: []string{"tortuga"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, newSigner(t)); err != nil {
+		t.Fatal(err)
+	}
+	certFile := ssh.MarshalAuthorizedKey(cert)
+
+	tests := []struct {
+		name       string
+		key        []byte
+		passphrase string
+		cert       []byte
+		// Type of the public key, empty if an error is expected.
+		want string
+	}{
+		{"plain", plain, "", nil, ssh.KeyAlgoED25519},
+		{"passphrase", encrypted, "arrr", nil, ssh.KeyAlgoED25519},
+		{"wrong passphrase", encrypted, "avast", nil, ""},
+		{"missing passphrase", encrypted, "", nil, ""},
+		{"certificate", encrypted, "arrr", certFile, ssh.CertAlgoED25519v01},
+		{"not a certificate", plain, "", ssh.MarshalAuthorizedKey(sshPub), ""},
+		{"garbage certificate", plain, "", []byte("garbage"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := ParseSigner(tt.key, []byte(tt.passphrase), tt.cert)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("ParseSigner() = %s, want an error", signer.PublicKey().Type())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ := signer.PublicKey().Type(); typ != tt.want {
+				t.Errorf("ParseSigner() key type = %s, want %s", typ, tt.want)
+			}
+			if c, ok := signer.PublicKey().(*ssh.Certificate); ok && c.KeyId != "kobo" {
+				t.Errorf("ParseSigner() certificate = %q, want %q", c.KeyId, "kobo")
+			}
+		})
+	}
+}
+
+// serveAgent runs an ssh-agent holding priv on a unix socket and returns
+// its path.
+func serveAgent(t *testing.T, priv ed25519.PrivateKey) string {
+	t.Helper()
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return sock
+}
+
+func TestAgentSigners(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		srv  = newTestServer(t)
+		sock = serveAgent(t, priv)
+		path = filepath.Join(t.TempDir(), "metadata.json")
+	)
+	if err := os.WriteFile(path, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := AgentSigners(filepath.Join(t.TempDir(), "missing.sock")); err == nil {
+		t.Error("expected an error without an agent")
+	}
+
+	signers, conn, err := AgentSigners(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 {
+		t.Fatalf("AgentSigners() = %d signers, want 1", len(signers))
+	}
+	// The server accepts only the key in the agent.
+	srv.clientKey = signers[0]
+
+	bay, err := dialServer(srv.addr, signers, FixedHostKey(srv.hostKey.PublicKey().Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bay.Agent = conn
+
+	// Reconnecting signs with the agent again.
+	srv.dropConns()
+	if _, err := bay.Metadata(path); err != nil {
+		t.Fatalf("Metadata() after the connection dropped: %v", err)
+	}
+
+	bay.Close()
+	if _, err := agent.NewClient(conn.(net.Conn)).List(); err == nil {
+		t.Error("the agent connection is still open after closing the Bay")
+	}
+}
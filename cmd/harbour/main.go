@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ts "github.com/NicoNex/tortugasync"
+)
+
+var (
+	errNoRoot   = errors.New("no root directory, set it with -root")
+	errHomeRoot = errors.New("refusing to serve the home directory, pass -allow-home to do it anyway")
+)
+
+var token string
+
+// auth requires the token as the password of the HTTP basic authentication.
+func auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pass, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(pass), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="harbour"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkRoot returns the absolute path of the directory to serve, which
+// can't be the home directory, holding the SSH keys among the rest, unless
+// allowHome is set.
+func checkRoot(root string, allowHome bool) (string, error) {
+	if root == "" {
+		return "", errNoRoot
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", fmt.Errorf("checkRoot: filepath.Abs: %w", err)
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return "", fmt.Errorf("checkRoot: os.Stat: %w", err)
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("checkRoot: %s is not a directory", root)
+	}
+
+	if home, err := os.UserHomeDir(); err == nil && !allowHome {
+		if hfi, err := os.Stat(home); err == nil && os.SameFile(fi, hfi) {
+			return "", errHomeRoot
+		}
+	}
+	return root, nil
+}
+
+func main() {
+	var (
+		port      string
+		root      string
+		cert      string
+		key       string
+		allowHome bool
+	)
+
+	flag.StringVar(&port, "p", ":8090", "Port, or address and port, to listen on.")
+	flag.StringVar(&root, "root", "", "Directory holding the books and metadata.json to serve.")
+	flag.BoolVar(&allowHome, "allow-home", false, "Allow serving the home directory.")
+	flag.StringVar(&cert, "cert", "", "TLS certificate file, serves HTTPS with -key.")
+	flag.StringVar(&key, "key", "", "TLS private key file.")
+	flag.Parse()
+
+	if token = os.Getenv("HARBOUR_TOKEN"); token == "" {
+		log.Fatalln("main", "HARBOUR_TOKEN is not set")
+	}
+	root, err := checkRoot(root, allowHome)
+	if err != nil {
+		log.Fatalln("main", err)
+	}
+	if (cert == "") != (key == "") {
+		log.Fatalln("main", "-cert and -key must be set together")
+	}
+	if !strings.Contains(port, ":") {
+		port = ":" + port
+	}
+
+	http.Handle("/", auth(ts.StorageHandler(ts.LocalStorage{Root: root})))
+	srv := &http.Server{
+		Addr:              port,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	for {
+		if cert != "" {
+			log.Println("main", "srv.ListenAndServeTLS", srv.ListenAndServeTLS(cert, key))
+		} else {
+			log.Println("main", "srv.ListenAndServe", srv.ListenAndServe())
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckRoot(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	books := filepath.Join(home, "books")
+	if err := os.Mkdir(books, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := checkRoot("", false); !errors.Is(err, errNoRoot) {
+		t.Errorf("checkRoot() error = %v, want errNoRoot", err)
+	}
+	if _, err := checkRoot(home, false); !errors.Is(err, errHomeRoot) {
+		t.Errorf("checkRoot() error = %v, want errHomeRoot", err)
+	}
+	if _, err := checkRoot(books+"/..", false); !errors.Is(err, errHomeRoot) {
+		t.Errorf("checkRoot() error = %v, want errHomeRoot", err)
+	}
+	if root, err := checkRoot(home, true); err != nil || root != home {
+		t.Errorf("checkRoot() = %q, %v with -allow-home", root, err)
+	}
+	if root, err := checkRoot(books, false); err != nil || root != books {
+		t.Errorf("checkRoot() = %q, %v", root, err)
+	}
+	if _, err := checkRoot(filepath.Join(home, "missing"), false); err == nil {
+		t.Error("checkRoot() succeeded for a missing directory")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	fixtureBooks = []fixtureBook{
+		{ID: "file:///mnt/onboard/dune.kepub.epub", Title: "Dune", Author: "Frank Herbert", Chapters: 3},
+		{ID: "file:///mnt/onboard/anon.epub", Title: "Beowulf", Chapters: 1},
+		{ID: "file:///mnt/onboard/untitled.epub"},
+	}
+
+	fixtureBookmarks = []fixtureBookmark{
+		{VolumeID: "file:///mnt/onboard/dune.kepub.epub", Text: "Fear is the mind-killer.", Note: "Litany"},
+		{VolumeID: "file:///mnt/onboard/dune.kepub.epub", Text: "The spice must flow.", Note: nil},
+		{VolumeID: "file:///mnt/onboard/dune.kepub.epub", Text: nil, Note: "a dogear"},
+		{VolumeID: "file:///mnt/onboard/dune.kepub.epub", Text: "", Note: ""},
+		{VolumeID: "file:///mnt/onboard/anon.epub", Text: "Hwæt!", Note: nil},
+		{VolumeID: "file:///mnt/onboard/untitled.epub", Text: "Lorem ipsum", Note: nil},
+	}
+)
+
+func TestQueryData(t *testing.T) {
+	for schema := range koboSchemas {
+		t.Run(schema, func(t *testing.T) {
+			db := newKoboDB(t, schema, fixtureBooks, fixtureBookmarks)
+
+			data, err := queryData(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != 3 {
+				t.Fatalf("queryData() returned %d books, want 3", len(data))
+			}
+
+			dune := data["file:///mnt/onboard/dune.kepub.epub"]
+			if dune == nil {
+				t.Fatal("missing Dune")
+			}
+			if dune.Title != "Dune" || dune.Author != "Frank Herbert" {
+				t.Errorf("Dune resolved as %q by %q", dune.Title, dune.Author)
+			}
+			// The dogear and the empty highlight are filtered out.
+			if len(dune.Bookmarks) != 2 {
+				t.Fatalf("Dune has %d bookmarks, want 2: %v", len(dune.Bookmarks), dune.Bookmarks)
+			}
+			for _, bm := range dune.Bookmarks {
+				switch bm.Text {
+				case "Fear is the mind-killer.":
+					if bm.Note != "Litany" {
+						t.Errorf("note = %q, want %q", bm.Note, "Litany")
+					}
+				case "The spice must flow.":
+					if bm.Note != "" {
+						t.Errorf("note = %q, want none", bm.Note)
+					}
+				default:
+					t.Errorf("unexpected bookmark %q", bm.Text)
+				}
+			}
+
+			anon := data["file:///mnt/onboard/anon.epub"]
+			if anon == nil || anon.Title != "Beowulf" || anon.Author != "" {
+				t.Errorf("Beowulf resolved as %+v", anon)
+			}
+
+			untitled := data["file:///mnt/onboard/untitled.epub"]
+			if untitled == nil || untitled.Title != "" || untitled.Author != "" {
+				t.Errorf("untitled book resolved as %+v", untitled)
+			}
+		})
+	}
+}
+
+func TestNoteNames(t *testing.T) {
+	tests := []struct {
+		id, title, author string
+		want              string
+	}{
+		{"file:///mnt/onboard/dune.kepub.epub", "Dune", "Frank Herbert", "Dune - Frank Herbert"},
+		{"file:///mnt/onboard/anon.epub", "Beowulf", "", "Beowulf"},
+		{"file:///mnt/onboard/untitled.epub", "", "", "untitled.epub"},
+		{"file:///mnt/onboard/x.epub", `What? A "title": yes/no`, "", "What A title yesno"},
+	}
+
+	for _, tt := range tests {
+		if got := notename(tt.id, tt.title, tt.author); got != tt.want+".html" {
+			t.Errorf("notename(%q, %q) = %q, want %q", tt.title, tt.author, got, tt.want+".html")
+		}
+		if got := jsonname(tt.id, tt.title, tt.author); got != tt.want+".json" {
+			t.Errorf("jsonname(%q, %q) = %q, want %q", tt.title, tt.author, got, tt.want+".json")
+		}
+	}
+}
+
+// withNotesPath makes the exporters write in a temporary directory.
+func withNotesPath(t *testing.T) string {
+	t.Helper()
+
+	saved := notespath
+	notespath = t.TempDir()
+	t.Cleanup(func() { notespath = saved })
+	return notespath
+}
+
+func collect(paths <-chan string) []string {
+	var ret []string
+	for p := range paths {
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+func TestGenBookmarks(t *testing.T) {
+	var (
+		dir = withNotesPath(t)
+		db  = newKoboDB(t, "fw4", fixtureBooks, fixtureBookmarks)
+		rep = NewReport()
+	)
+
+	data, err := queryData(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := collect(genBookmarks(data, rep))
+	if !rep.OK() || len(paths) != len(data) {
+		t.Fatalf("generated %d files, want %d:\n%s", len(paths), len(data), rep)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "Dune - Frank Herbert.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(b)
+	for _, want := range []string{
+		"<h1>Dune - Frank Herbert</h1>",
+		"<h2>Fear is the mind-killer.</h2>",
+		`<p class="note">Litany</p>`,
+		"<h2>The spice must flow.</h2>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("the HTML export is missing %q", want)
+		}
+	}
+	if n := strings.Count(html, `class="note"`); n != 1 {
+		t.Errorf("the HTML export has %d notes, want 1", n)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "untitled.epub.html")); err != nil {
+		t.Errorf("the untitled book isn't named after its file: %v", err)
+	}
+}
+
+func TestGenJSONBookmarks(t *testing.T) {
+	var (
+		dir = withNotesPath(t)
+		db  = newKoboDB(t, "fw4.38", fixtureBooks, fixtureBookmarks)
+		rep = NewReport()
+	)
+
+	data, err := queryData(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := collect(genJSONBookmarks(data, rep))
+	if !rep.OK() || len(paths) != len(data) {
+		t.Fatalf("generated %d files, want %d:\n%s", len(paths), len(data), rep)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "Beowulf.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"title":"Beowulf","author":"","bookmarks":[{"text":"Hwæt!"}]}`
+	if string(b) != want {
+		t.Errorf("Beowulf.json = %s, want %s", b, want)
+	}
+
+	var dune Book
+	b, err = os.ReadFile(filepath.Join(dir, "Dune - Frank Herbert.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &dune); err != nil {
+		t.Fatal(err)
+	}
+	notes := 0
+	for _, bm := range dune.Bookmarks {
+		if bm.Note != "" {
+			notes++
+		}
+	}
+	if len(dune.Bookmarks) != 2 || notes != 1 {
+		t.Errorf("Dune.json has %d bookmarks and %d notes, want 2 and 1", len(dune.Bookmarks), notes)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	ts "github.com/NicoNex/tortugasync"
+	"golang.org/x/crypto/ssh"
+)
+
+// Config holds the user tunable settings of the client.
+type Config struct {
+	// ServerURL is the address of the server, the scheme selects the
+	// transport (see ts.Dial), defaults to the embedded host address.
+	ServerURL string `json:"server_url"`
+	// LibraryRoot is the local directory the books are downloaded into,
+	// the server's subdirectories are recreated below it.
+	LibraryRoot string `json:"library_root"`
+	// SyncShelves enables the creation of a Kobo shelf for each of
+	// the server's subdirectories.
+	SyncShelves bool `json:"sync_shelves"`
+	// Selective restricts the downloads to the books in the wishlist.
+	Selective bool `json:"selective"`
+	// Reserve is the number of bytes of free space sync never consumes.
+	Reserve int64 `json:"reserve"`
+	// SpacePolicy chooses what to download when not all the pending books
+	// fit in the free space, one of SpaceSkip, SpaceSmallest or SpaceNewest.
+	SpacePolicy string `json:"space_policy"`
+	// KnownHosts is the path of an OpenSSH known_hosts file used to verify
+	// the server instead of the embedded host key.
+	KnownHosts string `json:"known_hosts"`
+	// TOFU trusts and pins in KnownHosts the first key seen for the server.
+	TOFU bool `json:"tofu"`
+	// Passphrase decrypts the embedded private key.
+	Passphrase string `json:"passphrase"`
+	// Certificate is the path of an OpenSSH user certificate for the
+	// embedded key, signed by a CA trusted by the server.
+	Certificate string `json:"certificate"`
+	// AgentSocket is the path of an ssh-agent socket whose keys are tried
+	// before the embedded one.
+	AgentSocket string `json:"agent_socket"`
+	// ConnectTimeout is how many seconds to keep trying to reach the server.
+	ConnectTimeout int `json:"connect_timeout"`
+	// SyncInterval is how many minutes the daemon waits between syncs while
+	// online, 0 syncs only when the Wi-Fi connects.
+	SyncInterval int `json:"sync_interval"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		ServerURL:      hostAddress,
+		LibraryRoot:    koboHome,
+		SyncShelves:    true,
+		Reserve:        64 << 20,
+		SpacePolicy:    SpaceSkip,
+		AgentSocket:    os.Getenv("SSH_AUTH_SOCK"),
+		ConnectTimeout: 60,
+	}
+}
+
+// LoadConfig reads the JSON formatted config at path on top of the defaults,
+// a missing file is not an error.
+func LoadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return cfg, nil
+		}
+		return cfg, fmt.Errorf("LoadConfig: os.ReadFile: %w", err)
+	}
+
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("LoadConfig: json.Unmarshal: %w", err)
+	}
+	// The config is written with the paths as seen on the device.
+	cfg.LibraryRoot = hostPath(cfg.LibraryRoot)
+	if cfg.KnownHosts != "" {
+		cfg.KnownHosts = hostPath(cfg.KnownHosts)
+	}
+	if cfg.Certificate != "" {
+		cfg.Certificate = hostPath(cfg.Certificate)
+	}
+	return cfg, nil
+}
+
+// HostKeyCallback returns the callback verifying the server's identity and
+// the host key algorithms to negotiate, nil for the defaults.
+func (c Config) HostKeyCallback() (ssh.HostKeyCallback, []string, error) {
+	if c.KnownHosts == "" {
+		return ts.FixedHostKey(hostKey), ts.FixedHostKeyAlgorithms(hostKey), nil
+	}
+
+	cb, err := ts.KnownHosts(c.KnownHosts, c.TOFU)
+	if err != nil {
+		return nil, nil, err
+	}
+	algos, err := ts.KnownHostsAlgorithms(c.KnownHosts, c.sshAddr())
+	if err != nil {
+		return nil, nil, err
+	}
+	return cb, algos, nil
+}
+
+// sshAddr returns the host:port of the SFTP server in ServerURL, the way
+// ts.Dial reads it.
+func (c Config) sshAddr() string {
+	if !strings.Contains(c.ServerURL, "://") {
+		return c.ServerURL
+	}
+	u, err := url.Parse(c.ServerURL)
+	if err != nil {
+		return c.ServerURL
+	}
+	return u.Host
+}
+
+// Signers returns the keys to authenticate with, the ssh-agent ones first.
+// agent is the connection to the ssh-agent, if any, and must stay open as
+// long as the signers are used.
+func (c Config) Signers() (signers []ssh.Signer, agent io.Closer, err error) {
+	if c.AgentSocket != "" {
+		s, conn, err := ts.AgentSigners(c.AgentSocket)
+		if err == nil {
+			signers, agent = s, conn
+		} else if len(tortugaKey) == 0 {
+			return nil, nil, err
+		}
+	}
+
+	if len(tortugaKey) == 0 {
+		return signers, agent, nil
+	}
+
+	var cert []byte
+	if c.Certificate != "" {
+		if cert, err = os.ReadFile(c.Certificate); err != nil {
+			closeAgent(agent)
+			return nil, nil, fmt.Errorf("c.Signers: os.ReadFile: %w", err)
+		}
+	}
+
+	signer, err := ts.ParseSigner(tortugaKey, []byte(c.Passphrase), cert)
+	if err != nil {
+		closeAgent(agent)
+		return nil, nil, fmt.Errorf("c.Signers: %w", err)
+	}
+	return append(signers, signer), agent, nil
+}
+
+// closeAgent closes the ssh-agent connection agent, if any.
+func closeAgent(agent io.Closer) {
+	if agent != nil {
+		agent.Close()
+	}
+}
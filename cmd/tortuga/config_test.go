@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigPaths(t *testing.T) {
+	home := withKoboHome(t)
+
+	config := `{
+		"library_root": "/mnt/onboard/books",
+		"known_hosts": "/mnt/onboard/.tortuga_known_hosts",
+		"certificate": "/mnt/onboard/.tortuga_key-cert.pub"
+	}`
+	if err := os.WriteFile(cfgpath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(cfgpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][2]string{
+		"library_root": {cfg.LibraryRoot, filepath.Join(home, "books")},
+		"known_hosts":  {cfg.KnownHosts, filepath.Join(home, ".tortuga_known_hosts")},
+		"certificate":  {cfg.Certificate, filepath.Join(home, ".tortuga_key-cert.pub")},
+	}
+	for name, tt := range tests {
+		if tt[0] != tt[1] {
+			t.Errorf("%s = %q, want %q", name, tt[0], tt[1])
+		}
+	}
+}
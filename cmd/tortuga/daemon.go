@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How often the daemon checks the network.
+	pollInterval = 10 * time.Second
+	// Route flag of the usable routes, from linux/route.h.
+	rtfUp = 0x1
+)
+
+var (
+	routePath = "/proc/net/route"
+
+	errLocked        = errors.New("another sync is running")
+	errDaemonRunning = errors.New("the daemon is already running")
+)
+
+// hasDefaultRoute reports whether the routing table in the format of
+// /proc/net/route has a usable default route.
+func hasDefaultRoute(r io.Reader) (bool, error) {
+	sc := bufio.NewScanner(r)
+	// Skip the header.
+	sc.Scan()
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil {
+			continue
+		}
+		if fields[1] == "00000000" && fields[7] == "00000000" && flags&rtfUp != 0 {
+			return true, nil
+		}
+	}
+	return false, sc.Err()
+}
+
+// online reports whether the device is connected to a network.
+func online() (bool, error) {
+	f, err := os.Open(routePath)
+	if err != nil {
+		return false, fmt.Errorf("online: os.Open: %w", err)
+	}
+	defer f.Close()
+
+	ok, err := hasDefaultRoute(f)
+	if err != nil {
+		return false, fmt.Errorf("online: hasDefaultRoute: %w", err)
+	}
+	return ok, nil
+}
+
+// daemon syncs every time the device goes online and then every
+// cfg.SyncInterval minutes while it stays online, until ctx is done.
+// A sync that can't start because another one is running, or because the
+// network state can't be read, is tried again at the next check.
+// It fails with errDaemonRunning if another daemon is running.
+func daemon(ctx context.Context, cfg Config) error {
+	release, err := lockFile(daemonpath)
+	if errors.Is(err, errLocked) {
+		return fmt.Errorf("daemon: %w", errDaemonRunning)
+	} else if err != nil {
+		return fmt.Errorf("daemon: lockFile: %w", err)
+	}
+	defer release()
+
+	var (
+		ticker   = time.NewTicker(pollInterval)
+		interval = time.Duration(cfg.SyncInterval) * time.Minute
+		wasUp    bool
+		last     time.Time
+	)
+	defer ticker.Stop()
+
+	for {
+		up, err := online()
+		if err != nil {
+			fmt.Println(err)
+		} else if up && (!wasUp || interval > 0 && time.Since(last) >= interval) {
+			// The periodic syncs show up only when they bring books.
+			if err := daemonSync(ctx, cfg, wasUp); err != nil {
+				fmt.Println(err)
+			} else {
+				last = time.Now()
+				wasUp = true
+			}
+		} else {
+			wasUp = up
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// daemonSync runs a full sync and has Nickel import the books only if any
+// was downloaded.
+// If quiet the outcome is only logged, unless books were downloaded.
+// It fails only if the sync couldn't start.
+func daemonSync(ctx context.Context, cfg Config, quiet bool) error {
+	release, err := lockFile(lockpath)
+	if err != nil {
+		return fmt.Errorf("daemonSync: lockFile: %w", err)
+	}
+	defer release()
+
+	rep := NewReport()
+
+	if bay, err := connect(ctx, cfg); err != nil {
+		rep.Fail("tortuga", err)
+	} else {
+		if err := syncAll(ctx, bay, cfg, rep); err != nil {
+			rep.Fail("tortuga", err)
+		}
+		bay.Close()
+	}
+	rep.Finish()
+
+	fmt.Print(rep)
+	if err := rep.AppendToFile(logpath); err != nil {
+		fmt.Println(err)
+	}
+	if changed := len(rep.Downloaded) > 0; changed || !quiet {
+		notifyReport(rep, changed)
+	}
+	return nil
+}
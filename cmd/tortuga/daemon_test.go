@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ts "github.com/NicoNex/tortugasync"
+)
+
+func TestHasDefaultRoute(t *testing.T) {
+	const header = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+
+	tests := []struct {
+		name   string
+		routes string
+		want   bool
+	}{
+		{"no routes", "", false},
+		{"lan only", "wlan0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n", false},
+		{"default", "wlan0\t0001A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\nwlan0\t00000000\t0101A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n", true},
+		{"default down", "wlan0\t00000000\t0101A8C0\t0002\t0\t0\t0\t00000000\t0\t0\t0\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hasDefaultRoute(strings.NewReader(header + tt.routes))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("hasDefaultRoute() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".tortuga.lock")
+
+	release, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockFile(path); !errors.Is(err, errLocked) {
+		t.Errorf("lockFile() error = %v while locked, want errLocked", err)
+	}
+	release()
+
+	release, err = lockFile(path)
+	if err != nil {
+		t.Fatalf("lockFile() error = %v once released", err)
+	}
+	release()
+}
+
+func TestDaemonSyncLocked(t *testing.T) {
+	withKoboHome(t)
+
+	release, err := lockFile(lockpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if err := daemonSync(context.Background(), defaultConfig(), false); !errors.Is(err, errLocked) {
+		t.Errorf("daemonSync() error = %v during a manual sync, want errLocked", err)
+	}
+}
+
+func TestDaemonRunning(t *testing.T) {
+	withKoboHome(t)
+
+	release, err := lockFile(daemonpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if err := daemon(context.Background(), defaultConfig()); !errors.Is(err, errDaemonRunning) {
+		t.Errorf("daemon() error = %v with another daemon running, want errDaemonRunning", err)
+	}
+}
+
+func TestDaemonOfflineError(t *testing.T) {
+	withKoboHome(t)
+	saved := routePath
+	routePath = filepath.Join(t.TempDir(), "missing")
+	t.Cleanup(func() { routePath = saved })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := daemon(ctx, defaultConfig()); err != nil {
+		t.Errorf("daemon() error = %v, want it to keep running", err)
+	}
+}
+
+// fakeQNDB installs a NickelDBus client recording the methods called, and
+// returns the path of the record.
+func fakeQNDB(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	record := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$2\" >> " + record + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "qndb"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	return record
+}
+
+func TestDaemonSyncQuiet(t *testing.T) {
+	tests := []struct {
+		name  string
+		books map[string]string
+		quiet bool
+		want  string
+	}{
+		{"periodic", nil, true, ""},
+		{"periodic with books", map[string]string{"dune.epub": "spice"}, true, "pfmRescanBooks\nmwcToast\n"},
+		{"connected", nil, false, "mwcToast\n"},
+		{"connected with books", map[string]string{"dune.epub": "spice"}, false, "pfmRescanBooks\nmwcToast\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withKoboHome(t)
+			record := fakeQNDB(t)
+			bay, _ := newRemote(t, tt.books)
+
+			cfg := defaultConfig()
+			cfg.ServerURL = "file://" + bay.Storage.(ts.LocalStorage).Root
+			cfg.AgentSocket = ""
+			if err := daemonSync(context.Background(), cfg, tt.quiet); err != nil {
+				t.Fatal(err)
+			}
+
+			calls, err := os.ReadFile(record)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				t.Fatal(err)
+			}
+			if string(calls) != tt.want {
+				t.Errorf("NickelDBus calls = %q, want %q", calls, tt.want)
+			}
+		})
+	}
+}
@@ -1,24 +1,44 @@
 //go:build ignore
 
+// hostkey fetches the public keys of an SSH server by performing the
+// handshake with it, it writes the first key to host_key to be embedded in
+// the client and all of them to known_hosts.
 package main
 
 import (
-	"bytes"
+	"errors"
+	"fmt"
+	"net"
 	"os"
-	"os/exec"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
-func keyscan(hostname string) []byte {
-	var out bytes.Buffer
+var errGotKey = errors.New("got host key")
 
-	cmd := exec.Command("ssh-keyscan", hostname)
-	cmd.Stdout = &out
-	if err := cmd.Run(); err != nil {
-		panic(err)
+// keyscan returns the host key the server offers for the given algorithm.
+func keyscan(addr, algo string) (ssh.PublicKey, error) {
+	var key ssh.PublicKey
+
+	cfg := &ssh.ClientConfig{
+		User:              "tortuga",
+		HostKeyAlgorithms: []string{algo},
+		Timeout:           5 * time.Second,
+		HostKeyCallback: func(_ string, _ net.Addr, k ssh.PublicKey) error {
+			key = k
+			// Abort the handshake, the key is all we need.
+			return errGotKey
+		},
 	}
-	return out.Bytes()
+
+	_, err := ssh.Dial("tcp", addr, cfg)
+	if key != nil {
+		return key, nil
+	}
+	return nil, err
 }
 
 func main() {
@@ -26,12 +46,37 @@ func main() {
 		panic("no hostname specified")
 	}
 
-	key, _, _, _, err := ssh.ParseAuthorizedKey(keyscan(os.Args[1]))
-	if err != nil {
-		panic(err)
+	addr := os.Args[1]
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
 	}
 
-	if err := os.WriteFile("host_key", key.Marshal(), 0644); err != nil {
+	var (
+		keys  []ssh.PublicKey
+		lines []string
+	)
+	for _, algo := range []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA256,
+		ssh.KeyAlgoECDSA384,
+		ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512,
+	} {
+		key, err := keyscan(addr, algo)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(addr)}, key))
+	}
+	if len(keys) == 0 {
+		panic(fmt.Sprintf("no host keys found for %s", addr))
+	}
+
+	if err := os.WriteFile("host_key", keys[0].Marshal(), 0644); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile("known_hosts", []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
 		panic(err)
 	}
 }
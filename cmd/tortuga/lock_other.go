@@ -0,0 +1,7 @@
+//go:build !linux && !darwin
+
+package main
+
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
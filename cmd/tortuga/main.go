@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"embed"
 	"encoding/hex"
@@ -9,10 +10,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"sync"
+	"syscall"
 	"text/template"
+	"time"
 
 	ts "github.com/NicoNex/tortugasync"
 	_ "modernc.org/sqlite"
@@ -44,41 +49,117 @@ var (
 	tFile embed.FS
 
 	serverHome = filepath.Join("/", "home", "tortuga")
-	koboHome   = filepath.Join("/", "mnt", "onboard")
-	notespath  = filepath.Join("/", "mnt", "onboard", ".kraken_notes")
-	dbpath     = filepath.Join("/", "mnt", "onboard", ".kobo", "KoboReader.sqlite")
+	// Where the Kobo's storage is mounted on the device itself.
+	deviceHome = filepath.Join("/", "mnt", "onboard")
+
+	// Set by setKoboHome.
+	koboHome    string
+	notespath   string
+	dbpath      string
+	cachepath   string
+	logpath     string
+	cfgpath     string
+	shelvespath string
+	selpath     string
+	lockpath    string
+	daemonpath  string
 
 	sre = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1F]`)
 )
 
-func downloadAll(bay ts.Bay) (e error) {
-	ccPath := filepath.Join(koboHome, "tortuga.json")
-	lcache, err := ts.NewCacheFromFile(ccPath)
+func downloadAll(ctx context.Context, bay *ts.Bay, cfg Config, rep *Report) error {
+	lcache, err := loadLocalCache()
 	if err != nil {
-		return err
+		return fmt.Errorf("downloadAll: loadLocalCache: %w", err)
 	}
 
-	rcache, err := bay.Metadata(filepath.Join(serverHome, "metadata.json"))
+	rcache, err := bay.MetadataContext(ctx, filepath.Join(serverHome, "metadata.json"))
 	if err != nil {
-		return err
+		return fmt.Errorf("downloadAll: bay.MetadataContext: %w", err)
+	}
+
+	var (
+		// Local paths of the books still on the server.
+		taken = make(map[string]bool)
+		// Local paths of all the books downloaded by Tortuga.
+		managed = make(map[string]bool)
+		// Local paths of the books no longer on the server and their hash.
+		stale = make(map[string]string)
+	)
+	for hash, lpath := range lcache {
+		managed[lpath] = true
+		if path, ok := rcache[hash]; ok {
+			taken[lpath] = true
+			rep.Skip(path)
+		} else {
+			stale[lpath] = hash
+		}
+	}
+
+	sel, err := LoadSelection(selpath)
+	if err != nil {
+		return fmt.Errorf("downloadAll: %w", err)
+	}
+
+	pending := rcache.Diff(lcache)
+	for _, path := range sel.Filter(pending, cfg.Selective) {
+		rep.Skip(path)
+	}
+	hashes := make([]string, 0, len(pending))
+	for hash := range pending {
+		hashes = append(hashes, hash)
+	}
+	// Sort to resolve the name collisions always in the same way.
+	sort.Slice(hashes, func(i, j int) bool {
+		if pending[hashes[i]] != pending[hashes[j]] {
+			return pending[hashes[i]] < pending[hashes[j]]
+		}
+		return hashes[i] < hashes[j]
+	})
+
+	avail, err := availSpace(cfg.LibraryRoot, cfg.Reserve)
+	if err != nil {
+		return fmt.Errorf("downloadAll: %w", err)
+	}
+	queue, nofit := planDownloads(queueDownloads(ctx, bay, pending, hashes, rep), avail, cfg.SpacePolicy)
+	for _, d := range nofit {
+		rep.Fail(d.path, fmt.Errorf("downloadAll: %w for %s", errNoSpace, byteSize(d.size)))
 	}
 
 	var (
 		wg sync.WaitGroup
 		mu sync.Mutex
 	)
-	for _, path := range rcache.Diff(lcache) {
-		lpath := filepath.Join(koboHome, filepath.Base(path))
-		b, err := bay.Fetch(lpath, path)
+	for _, d := range queue {
+		hash, path := d.hash, d.path
+		lpath := uniquePath(localPath(cfg.LibraryRoot, path), hash, taken, managed)
+		taken[lpath] = true
+
+		if err := os.MkdirAll(filepath.Dir(lpath), 0755); err != nil {
+			rep.Fail(path, fmt.Errorf("downloadAll: os.MkdirAll: %w", err))
+			continue
+		}
+		b, err := bay.FetchContext(ctx, lpath, path)
 		if err != nil {
-			e = errors.Join(e, err)
+			rep.Fail(path, err)
 			continue
 		}
+		rep.Download(path, fileSize(lpath))
+
+		mu.Lock()
+		// The book replaced an old version that has been removed from the server.
+		if h, ok := stale[lpath]; ok {
+			delete(lcache, h)
+		}
 		lcache[hex.EncodeToString(b)] = lpath
+		mu.Unlock()
+
 		wg.Add(1)
 		go func() {
 			mu.Lock()
-			lcache.WriteToFile(ccPath)
+			if err := writeLocalCache(lcache); err != nil {
+				rep.Fail(cachepath, err)
+			}
 			mu.Unlock()
 			wg.Done()
 		}()
@@ -88,7 +169,7 @@ func downloadAll(bay ts.Bay) (e error) {
 	return nil
 }
 
-func uploadBookmarks(bay ts.Bay, localPaths <-chan string) <-chan struct{} {
+func uploadBookmarks(ctx context.Context, bay *ts.Bay, localPaths <-chan string, rep *Report) <-chan struct{} {
 	var (
 		bmpath = filepath.Join(serverHome, ".kraken")
 		done   = make(chan struct{}, 1)
@@ -99,16 +180,18 @@ func uploadBookmarks(bay ts.Bay, localPaths <-chan string) <-chan struct{} {
 
 		for path := range localPaths {
 			rpath := filepath.Join(bmpath, filepath.Base(path))
-			if err := bay.Upload(path, rpath); err != nil {
-				fmt.Println("uploadBookmarks", "bay.Upload", err)
+			if err := bay.UploadContext(ctx, path, rpath); err != nil {
+				rep.Fail(path, fmt.Errorf("uploadBookmarks: bay.UploadContext: %w", err))
+				continue
 			}
+			rep.Upload(rpath, fileSize(path))
 		}
 		done <- struct{}{}
 	}()
 	return done
 }
 
-func uploadJSONs(bay ts.Bay, localPaths <-chan string) <-chan struct{} {
+func uploadJSONs(ctx context.Context, bay *ts.Bay, localPaths <-chan string, rep *Report) <-chan struct{} {
 	var (
 		jbmpath = filepath.Join(serverHome, ".kraken-json")
 		done    = make(chan struct{}, 1)
@@ -119,16 +202,18 @@ func uploadJSONs(bay ts.Bay, localPaths <-chan string) <-chan struct{} {
 
 		for path := range localPaths {
 			rpath := filepath.Join(jbmpath, filepath.Base(path))
-			if err := bay.Upload(path, rpath); err != nil {
-				fmt.Println("uploadBookmarks", "bay.Upload", err)
+			if err := bay.UploadContext(ctx, path, rpath); err != nil {
+				rep.Fail(path, fmt.Errorf("uploadJSONs: bay.UploadContext: %w", err))
+				continue
 			}
+			rep.Upload(rpath, fileSize(path))
 		}
 		done <- struct{}{}
 	}()
 	return done
 }
 
-func genBookmarks(data map[string]*Book) <-chan string {
+func genBookmarks(data map[string]*Book, rep *Report) <-chan string {
 	var paths = make(chan string)
 
 	go func() {
@@ -136,7 +221,12 @@ func genBookmarks(data map[string]*Book) <-chan string {
 
 		t, err := template.ParseFS(tFile, "template.html")
 		if err != nil {
-			fmt.Println("genBookmarks", "template.ParseFS", err)
+			rep.Fail("template.html", fmt.Errorf("genBookmarks: template.ParseFS: %w", err))
+			return
+		}
+
+		if err := os.MkdirAll(notespath, 0755); err != nil {
+			rep.Fail(notespath, fmt.Errorf("genBookmarks: os.MkdirAll: %w", err))
 			return
 		}
 
@@ -152,13 +242,13 @@ func genBookmarks(data map[string]*Book) <-chan string {
 
 				f, err := os.Create(path)
 				if err != nil {
-					fmt.Println("genBookmarks", "os.Create", err)
+					rep.Fail(path, fmt.Errorf("genBookmarks: os.Create: %w", err))
 					return
 				}
 				defer f.Close()
 
 				if err := t.Execute(f, book); err != nil {
-					fmt.Println("genBookmarks", "t.Execute", err)
+					rep.Fail(path, fmt.Errorf("genBookmarks: t.Execute: %w", err))
 					return
 				}
 				paths <- path
@@ -170,12 +260,17 @@ func genBookmarks(data map[string]*Book) <-chan string {
 	return paths
 }
 
-func genJSONBookmarks(data map[string]*Book) <-chan string {
+func genJSONBookmarks(data map[string]*Book, rep *Report) <-chan string {
 	var paths = make(chan string)
 
 	go func() {
 		defer close(paths)
 
+		if err := os.MkdirAll(notespath, 0755); err != nil {
+			rep.Fail(notespath, fmt.Errorf("genJSONBookmarks: os.MkdirAll: %w", err))
+			return
+		}
+
 		var wg sync.WaitGroup
 		for id, book := range data {
 			wg.Add(1)
@@ -184,7 +279,7 @@ func genJSONBookmarks(data map[string]*Book) <-chan string {
 
 				b, err := json.Marshal(book)
 				if err != nil {
-					fmt.Println("genJSONBookmarks", "json.Marshal", err)
+					rep.Fail(id, fmt.Errorf("genJSONBookmarks: json.Marshal: %w", err))
 					return
 				}
 
@@ -193,7 +288,7 @@ func genJSONBookmarks(data map[string]*Book) <-chan string {
 					jsonname(id, book.Title, book.Author),
 				)
 				if err := os.WriteFile(path, b, os.ModePerm); err != nil {
-					fmt.Println("genJSONBookmarks", "os.WriteFile", err)
+					rep.Fail(path, fmt.Errorf("genJSONBookmarks: os.WriteFile: %w", err))
 					return
 				}
 				paths <- path
@@ -307,50 +402,245 @@ func readBookmarks() (map[string]*Book, error) {
 	return queryData(db)
 }
 
-func main() {
-	var (
-		isKraken     bool
-		isKrakenJson bool
-	)
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
 
-	flag.BoolVar(&isKraken, "b", false, "Upload bookmarks to the server")
-	flag.BoolVar(&isKrakenJson, "bm-json", false, "Upload bookmarks to the server in JSON format")
-	flag.Parse()
+// options are the command line flags selecting what a run does.
+type options struct {
+	isKraken     bool
+	isKrakenJson bool
+	list         bool
+	want         string
+	remove       string
+	offline      bool
+	usb          bool
+	daemon       bool
+}
 
-	bay, err := ts.Connect(hostAddress, tortugaKey, hostKey)
+// connect dials the server, retrying for cfg.ConnectTimeout seconds.
+func connect(ctx context.Context, cfg Config) (*ts.Bay, error) {
+	hkcb, algos, err := cfg.HostKeyCallback()
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, err
+	}
+
+	signers, agent, err := cfg.Signers()
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep trying while the Wi-Fi comes up.
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.ConnectTimeout)*time.Second)
+	defer cancel()
+	bay, err := ts.Dial(ctx, cfg.ServerURL, serverHome, signers, hkcb, algos...)
+	if err != nil {
+		closeAgent(agent)
+		return nil, err
+	}
+	// The agent signs again when reconnecting.
+	bay.Agent = agent
+	return bay, nil
+}
+
+// syncAll downloads the new books, updates the shelves and uploads the
+// bookmarks in both formats.
+func syncAll(ctx context.Context, bay *ts.Bay, cfg Config, rep *Report) error {
+	if err := downloadAll(ctx, bay, cfg, rep); err != nil {
+		return err
+	}
+	if cfg.SyncShelves {
+		if err := syncShelves(cfg); err != nil {
+			return err
+		}
+	}
+
+	bms, err := readBookmarks()
+	if err != nil {
+		return err
+	}
+	<-uploadBookmarks(ctx, bay, genBookmarks(bms, rep), rep)
+	<-uploadJSONs(ctx, bay, genJSONBookmarks(bms, rep), rep)
+	return nil
+}
+
+func run(ctx context.Context, rep *Report, cfg Config, opts options) error {
+	// Listing only reads, everything else must not overlap with the daemon.
+	if !opts.list {
+		release, err := lockFile(lockpath)
+		if err != nil {
+			return fmt.Errorf("run: lockFile: %w", err)
+		}
+		defer release()
+	}
+
+	switch {
+	// Removing a local book doesn't need the server.
+	case opts.remove != "":
+		return removeBook(opts.remove)
+
+	case opts.offline && (opts.isKraken || opts.isKrakenJson):
+		bms, err := readBookmarks()
+		if err != nil {
+			return err
+		}
+		if opts.isKraken {
+			for range genBookmarks(bms, rep) {
+			}
+		}
+		if opts.isKrakenJson {
+			for range genJSONBookmarks(bms, rep) {
+			}
+		}
+		return nil
+	}
+
+	bay, err := connect(ctx, cfg)
+	if err != nil {
+		return err
 	}
 	defer bay.Close()
 
 	switch {
-	case isKrakenJson:
+	case opts.list:
+		return listBooks(ctx, bay, os.Stdout)
+
+	case opts.want != "":
+		return wantBook(ctx, bay, opts.want)
+
+	case opts.isKrakenJson:
 		bms, err := readBookmarks()
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
 		}
-		<-uploadJSONs(bay, genJSONBookmarks(bms))
+		<-uploadJSONs(ctx, bay, genJSONBookmarks(bms, rep), rep)
 
-	case isKraken:
+	case opts.isKraken:
 		bms, err := readBookmarks()
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
 		}
-		<-uploadBookmarks(bay, genBookmarks(bms))
+		<-uploadBookmarks(ctx, bay, genBookmarks(bms, rep), rep)
+
+	// A mounted Kobo gets everything done in one go before being unplugged.
+	case opts.usb:
+		return syncAll(ctx, bay, cfg, rep)
 
 	default:
-		downloadAll(bay)
+		if err := downloadAll(ctx, bay, cfg, rep); err != nil {
+			return err
+		}
+		if cfg.SyncShelves {
+			return syncShelves(cfg)
+		}
 	}
-	fmt.Println("All done!")
+	return nil
 }
 
-func init() {
-	if _, err := os.Stat(notespath); errors.Is(err, os.ErrNotExist) {
-		if err := os.Mkdir(notespath, 0755); err != nil {
+func main() {
+	var (
+		opts  options
+		home  string
+		db    string
+		notes string
+		rep   = NewReport()
+	)
+
+	flag.BoolVar(&opts.isKraken, "b", false, "Upload bookmarks to the server")
+	flag.BoolVar(&opts.isKrakenJson, "bm-json", false, "Upload bookmarks to the server in JSON format")
+	flag.BoolVar(&opts.list, "list", false, "Print the remote catalog")
+	flag.StringVar(&opts.want, "want", "", "Add the book with the given hash to the wishlist")
+	flag.StringVar(&opts.remove, "remove", "", "Delete the book with the given hash from the device and don't download it again")
+	flag.BoolVar(&opts.offline, "offline", false, "Only export the bookmarks to the notes directory, without uploading them")
+	flag.StringVar(&home, "home", deviceHome, "Root of the Kobo filesystem, e.g. where it's mounted over USB")
+	flag.StringVar(&db, "db", "", "Path of the Kobo database (default {home}/.kobo/KoboReader.sqlite)")
+	flag.StringVar(&notes, "notes", "", "Directory the bookmarks are exported to (default {home}/.kraken_notes)")
+	flag.BoolVar(&opts.daemon, "daemon", false, "Keep running and sync whenever the Wi-Fi connects and every sync_interval minutes")
+	flag.BoolVar(&opts.usb, "usb", false, "Sync a Kobo mounted over USB, found automatically unless -home is given")
+	flag.Parse()
+
+	if opts.usb && !isFlagSet("home") {
+		dir, err := findKobo(mountRoots())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Found a Kobo in", dir)
+		home = dir
+	}
+	setKoboHome(home)
+	if db != "" {
+		dbpath = db
+	}
+	if notes != "" {
+		notespath = notes
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	cfg, err := LoadConfig(cfgpath)
+	if err == nil && opts.daemon {
+		err = daemon(ctx, cfg)
+		stop()
+		if err != nil {
 			fmt.Println(err)
+			os.Exit(1)
 		}
+		return
+	}
+	if err != nil {
+		rep.Fail(cfgpath, err)
+	} else if err := run(ctx, rep, cfg, opts); err != nil {
+		rep.Fail("tortuga", err)
 	}
+	stop()
+	rep.Finish()
+
+	// Keep the catalog readable when it's displayed by NickelMenu.
+	if !opts.list || !rep.OK() {
+		fmt.Print(rep)
+	}
+	if err := rep.AppendToFile(logpath); err != nil {
+		fmt.Println(err)
+	}
+
+	// Nickel is only around when running on the Kobo itself.
+	if koboHome == deviceHome && !opts.list && !opts.offline && opts.want == "" {
+		notifyReport(rep, len(rep.Downloaded) > 0 || opts.remove != "")
+	}
+
+	if !rep.OK() {
+		os.Exit(1)
+	}
+}
+
+func isFlagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return
+}
+
+// setKoboHome points the client to the Kobo filesystem rooted at home, e.g.
+// a Kobo mounted over USB.
+func setKoboHome(home string) {
+	koboHome = home
+	notespath = filepath.Join(home, ".kraken_notes")
+	dbpath = filepath.Join(home, ".kobo", "KoboReader.sqlite")
+	cachepath = filepath.Join(home, "tortuga.json")
+	logpath = filepath.Join(home, ".tortuga.log")
+	cfgpath = filepath.Join(home, ".tortuga_config.json")
+	shelvespath = filepath.Join(home, ".tortuga_shelves.json")
+	selpath = filepath.Join(home, ".tortuga_selection.json")
+	lockpath = filepath.Join(home, ".tortuga.lock")
+	daemonpath = filepath.Join(home, ".tortuga_daemon.lock")
+}
+
+func init() {
+	setKoboHome(deviceHome)
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ts "github.com/NicoNex/tortugasync"
+)
+
+// withKoboHome points the client to a temporary device for the duration of
+// the test and returns its path.
+func withKoboHome(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	setKoboHome(dir)
+	t.Cleanup(func() { setKoboHome(deviceHome) })
+	return dir
+}
+
+// newRemote creates a server home holding books, given as relative path and
+// content, and its metadata.json.
+func newRemote(t *testing.T, books map[string]string) (*ts.Bay, ts.Cache) {
+	t.Helper()
+
+	var (
+		dir  = t.TempDir()
+		meta = make(ts.Cache)
+	)
+	for rel, content := range books {
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum := md5.Sum([]byte(content))
+		meta[hex.EncodeToString(sum[:])] = filepath.Join(serverHome, rel)
+	}
+
+	b, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ts.NewBay(ts.LocalStorage{Root: dir}, serverHome), meta
+}
+
+func TestDownloadAll(t *testing.T) {
+	var (
+		home  = withKoboHome(t)
+		books = map[string]string{
+			"a.epub":        "book a",
+			"sci-fi/a.epub": "another book a",
+			"b.kepub.epub":  "book b",
+		}
+		bay, meta = newRemote(t, books)
+		cfg       = defaultConfig()
+		rep       = NewReport()
+	)
+	cfg.LibraryRoot = home
+	cfg.Reserve = 0
+
+	// A file of the user with the same name as a remote book.
+	if err := os.WriteFile(filepath.Join(home, "b.kepub.epub"), []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloadAll(context.Background(), bay, cfg, rep); err != nil {
+		t.Fatal(err)
+	}
+	if !rep.OK() || len(rep.Downloaded) != len(books) {
+		t.Fatalf("unexpected report:\n%s", rep)
+	}
+
+	lcache, err := loadLocalCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// On disk the paths are the ones on the device.
+	dcache, err := ts.NewCacheFromFile(filepath.Join(home, "tortuga.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h, p := range dcache {
+		if want := devicePath(lcache[h]); p != want || !strings.HasPrefix(p, deviceHome) {
+			t.Errorf("cache entry %s stored as %s, want %s", h, p, want)
+		}
+	}
+
+	bhash := ""
+	for h, p := range meta {
+		if p == filepath.Join(serverHome, "b.kepub.epub") {
+			bhash = h
+		}
+	}
+	want := map[string]string{
+		filepath.Join(home, "a.epub"):                       "book a",
+		filepath.Join(home, "sci-fi", "a.epub"):             "another book a",
+		filepath.Join(home, "b ("+bhash[:8]+").kepub.epub"): "book b",
+		filepath.Join(home, "b.kepub.epub"):                 "mine",
+	}
+	for path, content := range want {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("reading %s: %v", path, err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s = %q, want %q", path, got, content)
+		}
+	}
+
+	// The cache must record where each book has actually been saved.
+	for h, p := range lcache {
+		got, err := os.ReadFile(p)
+		if err != nil {
+			t.Errorf("cache entry %s: %v", h, err)
+			continue
+		}
+		if sum := md5.Sum(got); hex.EncodeToString(sum[:]) != h {
+			t.Errorf("cache entry %s points to %s with hash %x", h, p, sum)
+		}
+	}
+	if len(lcache) != len(books) {
+		t.Errorf("cache has %d entries, want %d", len(lcache), len(books))
+	}
+
+	// A second run has nothing to do.
+	rep = NewReport()
+	if err := downloadAll(context.Background(), bay, cfg, rep); err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Downloaded) != 0 || len(rep.Skipped) != len(books) || !rep.OK() {
+		t.Errorf("unexpected report for the second run:\n%s", rep)
+	}
+}
+
+func TestDownloadAllSelective(t *testing.T) {
+	var (
+		home      = withKoboHome(t)
+		bay, meta = newRemote(t, map[string]string{"a.epub": "book a", "b.epub": "book b"})
+		cfg       = defaultConfig()
+		rep       = NewReport()
+		sel       = Selection{Wanted: make(ts.Cache), Removed: make(ts.Cache)}
+	)
+	cfg.LibraryRoot = home
+	cfg.Reserve = 0
+	cfg.Selective = true
+
+	for h, p := range meta {
+		if filepath.Base(p) == "a.epub" {
+			sel.Wanted[h] = p
+		}
+	}
+	if err := sel.WriteToFile(selpath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloadAll(context.Background(), bay, cfg, rep); err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Downloaded) != 1 || len(rep.Skipped) != 1 {
+		t.Fatalf("unexpected report:\n%s", rep)
+	}
+	if exists(filepath.Join(home, "b.epub")) {
+		t.Error("b.epub downloaded while not in the wishlist")
+	}
+}
+
+func TestDownloadAllNoSpace(t *testing.T) {
+	var (
+		home   = withKoboHome(t)
+		bay, _ = newRemote(t, map[string]string{"a.epub": "book a"})
+		cfg    = defaultConfig()
+		rep    = NewReport()
+	)
+	cfg.LibraryRoot = home
+	// More than any disk can offer.
+	cfg.Reserve = 1 << 62
+
+	if err := downloadAll(context.Background(), bay, cfg, rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.OK() || len(rep.Downloaded) != 0 {
+		t.Errorf("expected the download to fail for lack of space:\n%s", rep)
+	}
+}
+
+func TestQueueDownloadsCancelled(t *testing.T) {
+	var (
+		bay, _ = newRemote(t, map[string]string{"a.epub": "book a", "b.epub": "book b"})
+		rep    = NewReport()
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	queue := queueDownloads(ctx, bay, ts.Cache{"a": "/a.epub", "b": "/b.epub"}, []string{"a", "b"}, rep)
+	if len(queue) != 0 || len(rep.Failed) != 1 {
+		t.Errorf("queueDownloads() = %v, want it to stop at the first book:\n%s", queue, rep)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+var (
+	// Nickel reads the hardware events from this FIFO.
+	hwstatusPath = "/tmp/nickel-hardware-status"
+	// How long the notifications stay on screen.
+	toastDuration = 3 * time.Second
+)
+
+// qndb returns the path of the NickelDBus client if it's installed.
+func qndb() (string, bool) {
+	path, err := exec.LookPath("qndb")
+	return path, err == nil
+}
+
+// rescan makes Nickel import the new books, through NickelDBus if
+// available, otherwise by faking a USB plug and unplug.
+func rescan() error {
+	if path, ok := qndb(); ok {
+		if out, err := exec.Command(path, "-m", "pfmRescanBooks").CombinedOutput(); err != nil {
+			return fmt.Errorf("rescan: qndb: %w: %s", err, out)
+		}
+		return nil
+	}
+
+	for _, ev := range []string{"usb plug add", "usb plug remove"} {
+		f, err := os.OpenFile(hwstatusPath, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("rescan: os.OpenFile: %w", err)
+		}
+		_, err = fmt.Fprintln(f, ev)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("rescan: fmt.Fprintln: %w", err)
+		}
+		time.Sleep(time.Second)
+	}
+	return nil
+}
+
+// notify shows a toast in Nickel, it requires NickelDBus and is a no-op
+// without it.
+func notify(title, msg string) error {
+	path, ok := qndb()
+	if !ok {
+		return nil
+	}
+
+	ms := fmt.Sprint(toastDuration.Milliseconds())
+	if out, err := exec.Command(path, "-m", "mwcToast", ms, title, msg).CombinedOutput(); err != nil {
+		return fmt.Errorf("notify: qndb: %w: %s", err, out)
+	}
+	return nil
+}
+
+// notifyReport rescans the library if any book changed and shows the
+// outcome of the run.
+func notifyReport(rep *Report, changed bool) {
+	if changed {
+		if err := rescan(); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	title := "Tortuga sync done"
+	if !rep.OK() {
+		title = "Tortuga sync failed"
+	}
+	if err := notify(title, rep.Summary()); err != nil {
+		fmt.Println(err)
+	}
+}
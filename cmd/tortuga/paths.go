@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ts "github.com/NicoNex/tortugasync"
+)
+
+// devicePath returns the path lpath has on the Kobo itself, which differs
+// from lpath when the Kobo is mounted elsewhere.
+func devicePath(lpath string) string {
+	rel, err := filepath.Rel(koboHome, lpath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return lpath
+	}
+	return filepath.Join(deviceHome, rel)
+}
+
+// hostPath is the inverse of devicePath.
+func hostPath(dpath string) string {
+	rel, err := filepath.Rel(deviceHome, dpath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return dpath
+	}
+	return filepath.Join(koboHome, rel)
+}
+
+// loadLocalCache reads the cache of the downloaded books.
+// The cache stores the paths the books have on the device so that it stays
+// valid whether tortuga runs on the Kobo or against a mounted one.
+func loadLocalCache() (ts.Cache, error) {
+	cc, err := ts.NewCacheFromFile(cachepath)
+	if err != nil {
+		return nil, err
+	}
+	for hash, dpath := range cc {
+		cc[hash] = hostPath(dpath)
+	}
+	return cc, nil
+}
+
+func writeLocalCache(cc ts.Cache) error {
+	dc := make(ts.Cache, len(cc))
+	for hash, lpath := range cc {
+		dc[hash] = devicePath(lpath)
+	}
+	return dc.WriteToFile(cachepath)
+}
+
+// localPath maps the server path of a book to a path under root, keeping the
+// directory structure relative to serverHome.
+// Paths outside serverHome are placed directly in root.
+func localPath(root, rpath string) string {
+	rel, err := filepath.Rel(serverHome, rpath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Base(rpath)
+	}
+	return filepath.Join(root, rel)
+}
+
+// uniquePath returns lpath if nothing else claims it, otherwise it
+// deterministically renames it by appending the first characters of hash
+// to the file name, e.g. "book (0cc175b9).epub", followed by a counter if
+// that is claimed too, e.g. "book (0cc175b9 2).epub".
+// A path is claimed if it's in taken or if a file not managed by Tortuga
+// already exists there.
+func uniquePath(lpath, hash string, taken, managed map[string]bool) string {
+	free := func(p string) bool {
+		return !taken[p] && (managed[p] || !exists(p))
+	}
+	if free(lpath) {
+		return lpath
+	}
+
+	if len(hash) > 8 {
+		hash = hash[:8]
+	}
+	dir, base := filepath.Split(lpath)
+	ext := bookExt(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	p := filepath.Join(dir, fmt.Sprintf("%s (%s)%s", stem, hash, ext))
+	for i := 2; !free(p); i++ {
+		p = filepath.Join(dir, fmt.Sprintf("%s (%s %d)%s", stem, hash, i, ext))
+	}
+	return p
+}
+
+// bookExt is like filepath.Ext but treats ".kepub.epub" as a single extension.
+func bookExt(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".kepub.epub") {
+		return name[len(name)-len(".kepub.epub"):]
+	}
+	return filepath.Ext(name)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUniquePath(t *testing.T) {
+	dir := t.TempDir()
+	hash := "0cc175b9c0f1b6a831c399e269772661"
+
+	lpath := filepath.Join(dir, "book.kepub.epub")
+	renamed := filepath.Join(dir, "book (0cc175b9).kepub.epub")
+	if got := uniquePath(lpath, hash, nil, nil); got != lpath {
+		t.Errorf("uniquePath() = %q, want %q", got, lpath)
+	}
+
+	// A file of the user is there.
+	if err := os.WriteFile(lpath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := uniquePath(lpath, hash, nil, nil); got != renamed {
+		t.Errorf("uniquePath() = %q, want %q", got, renamed)
+	}
+	if got := uniquePath(lpath, hash, nil, map[string]bool{lpath: true}); got != lpath {
+		t.Errorf("uniquePath() = %q, want the managed %q", got, lpath)
+	}
+
+	// The renamed path is claimed too, by the user and by another book.
+	if err := os.WriteFile(renamed, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	taken := map[string]bool{filepath.Join(dir, "book (0cc175b9 2).kepub.epub"): true}
+	want := filepath.Join(dir, "book (0cc175b9 3).kepub.epub")
+	if got := uniquePath(lpath, hash, taken, nil); got != want {
+		t.Errorf("uniquePath() = %q, want %q", got, want)
+	}
+}
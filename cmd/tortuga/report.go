@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Report collects the outcome of a sync run.
+type Report struct {
+	Start      time.Time
+	Duration   time.Duration
+	Downloaded []string
+	Uploaded   []string
+	Skipped    []string
+	Failed     map[string]string
+	Bytes      int64
+
+	mu sync.Mutex
+}
+
+func NewReport() *Report {
+	return &Report{
+		Start:  time.Now(),
+		Failed: make(map[string]string),
+	}
+}
+
+func (r *Report) Download(path string, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Downloaded = append(r.Downloaded, path)
+	r.Bytes += size
+}
+
+func (r *Report) Upload(path string, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Uploaded = append(r.Uploaded, path)
+	r.Bytes += size
+}
+
+func (r *Report) Skip(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Skipped = append(r.Skipped, path)
+}
+
+// Fail records err as the reason why the item identified by path failed.
+func (r *Report) Fail(path string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Failed[path] = err.Error()
+}
+
+// Finish stamps the total duration of the run.
+func (r *Report) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Duration = time.Since(r.Start)
+}
+
+// OK reports whether the run completed without failures.
+func (r *Report) OK() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.Failed) == 0
+}
+
+// Summary returns the counts of the run in a single line.
+func (r *Report) Summary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return fmt.Sprintf(
+		"%d downloaded, %d uploaded, %d skipped, %d failed, %s in %s",
+		len(r.Downloaded),
+		len(r.Uploaded),
+		len(r.Skipped),
+		len(r.Failed),
+		byteSize(r.Bytes),
+		r.Duration.Round(time.Millisecond),
+	)
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintln(&b, r.Summary())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.Downloaded {
+		fmt.Fprintf(&b, "+ %s\n", p)
+	}
+
+	failed := make([]string, 0, len(r.Failed))
+	for p := range r.Failed {
+		failed = append(failed, p)
+	}
+	sort.Strings(failed)
+	for _, p := range failed {
+		fmt.Fprintf(&b, "! %s: %s\n", p, r.Failed[p])
+	}
+	return b.String()
+}
+
+// AppendToFile appends the timestamped summary to the log file at path.
+func (r *Report) AppendToFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("r.AppendToFile: os.OpenFile: %w", err)
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "[%s] %s\n", r.Start.Format(time.DateTime), r)
+	if err != nil {
+		return fmt.Errorf("r.AppendToFile: fmt.Fprintf: %w", err)
+	}
+	return nil
+}
+
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
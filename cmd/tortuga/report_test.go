@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	tests := []struct {
+		name    string
+		fill    func(*Report)
+		summary string
+		lines   []string
+		ok      bool
+	}{
+		{
+			"empty",
+			func(*Report) {},
+			"0 downloaded, 0 uploaded, 0 skipped, 0 failed, 0 B in 1.5s",
+			nil,
+			true,
+		},
+		{
+			"counts",
+			func(r *Report) {
+				r.Download("Books/dune.epub", 1536)
+				r.Download("Books/emma.epub", 512)
+				r.Upload("Notes/dune.html", 1024)
+				r.Skip("Books/ulysses.epub")
+			},
+			"2 downloaded, 1 uploaded, 1 skipped, 0 failed, 3.0 KiB in 1.5s",
+			[]string{"+ Books/dune.epub", "+ Books/emma.epub"},
+			true,
+		},
+		{
+			"errors",
+			func(r *Report) {
+				r.Download("Books/dune.epub", 3<<20)
+				r.Fail("Books/zorba.epub", errors.New("no space"))
+				r.Fail("Books/abel.epub", errors.New("timeout"))
+				// The last error of an item wins.
+				r.Fail("Books/zorba.epub", errors.New("permission denied"))
+			},
+			"1 downloaded, 0 uploaded, 0 skipped, 2 failed, 3.0 MiB in 1.5s",
+			[]string{"+ Books/dune.epub", "! Books/abel.epub: timeout", "! Books/zorba.epub: permission denied"},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReport()
+			tt.fill(r)
+			r.Finish()
+			r.Duration = 1500 * time.Millisecond
+
+			if got := r.Summary(); got != tt.summary {
+				t.Errorf("Summary() = %q, want %q", got, tt.summary)
+			}
+			if got := r.OK(); got != tt.ok {
+				t.Errorf("OK() = %v, want %v", got, tt.ok)
+			}
+			want := strings.Join(append([]string{tt.summary}, tt.lines...), "\n") + "\n"
+			if got := r.String(); got != want {
+				t.Errorf("String() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestReportAppendToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tortuga.log")
+
+	for i := 0; i < 2; i++ {
+		r := NewReport()
+		r.Skip("Books/dune.epub")
+		r.Finish()
+		if err := r.AppendToFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "0 downloaded, 0 uploaded, 1 skipped, 0 failed"); n != 2 {
+		t.Errorf("the log holds %d summaries, want 2:\n%s", n, b)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	tests := map[int64]string{
+		0:             "0 B",
+		1023:          "1023 B",
+		1024:          "1.0 KiB",
+		1536:          "1.5 KiB",
+		5 << 20:       "5.0 MiB",
+		3 << 30:       "3.0 GiB",
+		1<<40 + 1<<39: "1.5 TiB",
+	}
+	for n, want := range tests {
+		if got := byteSize(n); got != want {
+			t.Errorf("byteSize(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ts "github.com/NicoNex/tortugasync"
+)
+
+// Selection holds the books the user picked from the remote catalog.
+type Selection struct {
+	// Wanted are the books to download in selective mode.
+	Wanted ts.Cache `json:"wanted"`
+	// Removed are the books deleted from the device that must not be
+	// downloaded again.
+	Removed ts.Cache `json:"removed"`
+}
+
+func LoadSelection(path string) (Selection, error) {
+	var sel Selection
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return sel, fmt.Errorf("LoadSelection: os.ReadFile: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &sel); err != nil {
+			return sel, fmt.Errorf("LoadSelection: json.Unmarshal: %w", err)
+		}
+	}
+
+	if sel.Wanted == nil {
+		sel.Wanted = make(ts.Cache)
+	}
+	if sel.Removed == nil {
+		sel.Removed = make(ts.Cache)
+	}
+	return sel, nil
+}
+
+func (s Selection) WriteToFile(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// Filter removes from pending the books that must not be downloaded and
+// returns them.
+func (s Selection) Filter(pending ts.Cache, selective bool) (skipped ts.Cache) {
+	skipped = make(ts.Cache)
+
+	for hash, path := range pending {
+		_, removed := s.Removed[hash]
+		_, wanted := s.Wanted[hash]
+		if removed || (selective && !wanted) {
+			skipped[hash] = path
+			delete(pending, hash)
+		}
+	}
+	return
+}
+
+// wantBook adds the book with the given hash to the wishlist, undoing any
+// previous removal.
+func wantBook(ctx context.Context, bay *ts.Bay, hash string) error {
+	rcache, err := bay.MetadataContext(ctx, filepath.Join(serverHome, "metadata.json"))
+	if err != nil {
+		return fmt.Errorf("wantBook: bay.MetadataContext: %w", err)
+	}
+	path, ok := rcache[hash]
+	if !ok {
+		return fmt.Errorf("wantBook: unknown hash %q", hash)
+	}
+
+	sel, err := LoadSelection(selpath)
+	if err != nil {
+		return fmt.Errorf("wantBook: %w", err)
+	}
+	delete(sel.Removed, hash)
+	sel.Wanted[hash] = path
+	return sel.WriteToFile(selpath)
+}
+
+// removeBook deletes the book with the given hash from the device and marks
+// it so that it won't be downloaded again.
+func removeBook(hash string) error {
+	lcache, err := loadLocalCache()
+	if err != nil {
+		return fmt.Errorf("removeBook: loadLocalCache: %w", err)
+	}
+
+	sel, err := LoadSelection(selpath)
+	if err != nil {
+		return fmt.Errorf("removeBook: %w", err)
+	}
+
+	lpath, ok := lcache[hash]
+	if ok {
+		if err := os.Remove(lpath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removeBook: os.Remove: %w", err)
+		}
+		delete(lcache, hash)
+		if err := writeLocalCache(lcache); err != nil {
+			return fmt.Errorf("removeBook: writeLocalCache: %w", err)
+		}
+	} else if _, wanted := sel.Wanted[hash]; !wanted {
+		return fmt.Errorf("removeBook: unknown hash %q", hash)
+	}
+
+	if lpath == "" {
+		lpath = sel.Wanted[hash]
+	}
+	delete(sel.Wanted, hash)
+	sel.Removed[hash] = lpath
+	return sel.WriteToFile(selpath)
+}
+
+// listBooks writes the remote catalog to w, one book per line with its hash,
+// size, local status and title.
+func listBooks(ctx context.Context, bay *ts.Bay, w io.Writer) error {
+	rcache, err := bay.MetadataContext(ctx, filepath.Join(serverHome, "metadata.json"))
+	if err != nil {
+		return fmt.Errorf("listBooks: bay.MetadataContext: %w", err)
+	}
+
+	lcache, err := loadLocalCache()
+	if err != nil {
+		return fmt.Errorf("listBooks: loadLocalCache: %w", err)
+	}
+
+	sel, err := LoadSelection(selpath)
+	if err != nil {
+		return fmt.Errorf("listBooks: %w", err)
+	}
+
+	hashes := make([]string, 0, len(rcache))
+	for hash := range rcache {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return strings.ToLower(bookTitle(rcache[hashes[i]])) < strings.ToLower(bookTitle(rcache[hashes[j]]))
+	})
+
+	for _, hash := range hashes {
+		var (
+			path   = rcache[hash]
+			size   = "?"
+			status = "-"
+		)
+
+		fi, err := bay.StatContext(ctx, path)
+		if err == nil {
+			size = byteSize(fi.Size())
+		} else if ctx.Err() != nil {
+			return fmt.Errorf("listBooks: bay.StatContext: %w", err)
+		}
+
+		if _, ok := lcache[hash]; ok {
+			status = "local"
+		} else if _, ok := sel.Removed[hash]; ok {
+			status = "removed"
+		} else if _, ok := sel.Wanted[hash]; ok {
+			status = "wanted"
+		}
+
+		_, err = fmt.Fprintf(w, "%s %9s %-7s %s\n", hash, size, status, bookTitle(path))
+		if err != nil {
+			return fmt.Errorf("listBooks: fmt.Fprintf: %w", err)
+		}
+	}
+	return nil
+}
+
+// bookTitle returns the file name of the book without the extension.
+func bookTitle(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, bookExt(base))
+}
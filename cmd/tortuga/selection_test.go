@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveBook(t *testing.T) {
+	var (
+		home      = withKoboHome(t)
+		bay, meta = newRemote(t, map[string]string{"a.epub": "book a", "b.epub": "book b"})
+		cfg       = defaultConfig()
+		rep       = NewReport()
+	)
+	cfg.LibraryRoot = home
+	cfg.Reserve = 0
+
+	var ahash, bhash string
+	for h, p := range meta {
+		if filepath.Base(p) == "a.epub" {
+			ahash = h
+		} else {
+			bhash = h
+		}
+	}
+
+	if err := downloadAll(context.Background(), bay, cfg, rep); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeBook(ahash); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(home, "a.epub")) {
+		t.Error("a.epub is still on the device")
+	}
+	lcache, err := loadLocalCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lcache[ahash]; ok || len(lcache) != 1 {
+		t.Errorf("local cache = %v, want only b.epub", lcache)
+	}
+
+	// The removed book isn't downloaded again until it's wanted.
+	rep = NewReport()
+	if err := downloadAll(context.Background(), bay, cfg, rep); err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Downloaded) != 0 || exists(filepath.Join(home, "a.epub")) {
+		t.Errorf("a.epub downloaded again:\n%s", rep)
+	}
+	if err := wantBook(context.Background(), bay, ahash); err != nil {
+		t.Fatal(err)
+	}
+	sel, err := LoadSelection(selpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sel.Removed[ahash]; ok {
+		t.Error("a.epub still marked as removed once wanted")
+	}
+
+	// A wanted book not downloaded yet can be removed too, unknown ones not.
+	if err := os.Remove(filepath.Join(home, "b.epub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeBook(bhash); err != nil {
+		t.Errorf("removeBook() error = %v for a book already deleted by hand", err)
+	}
+	if err := removeBook(ahash); err != nil {
+		t.Errorf("removeBook() error = %v for a wanted book", err)
+	}
+	if sel, err = LoadSelection(selpath); err != nil {
+		t.Fatal(err)
+	}
+	if len(sel.Wanted) != 0 || len(sel.Removed) != 2 {
+		t.Errorf("selection = %+v, want both books removed", sel)
+	}
+	if err := removeBook("00000000000000000000000000000000"); err == nil {
+		t.Error("removeBook() succeeded for an unknown hash")
+	}
+}
+
+func TestListBooksCancelled(t *testing.T) {
+	withKoboHome(t)
+	bay, _ := newRemote(t, map[string]string{"a.epub": "book a"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := listBooks(ctx, bay, io.Discard); !errors.Is(err, context.Canceled) {
+		t.Errorf("listBooks() error = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	ts "github.com/NicoNex/tortugasync"
+)
+
+// Shelves maps the names of the Tortuga managed shelves to the Kobo content
+// IDs of the books they contain.
+type Shelves map[string]map[string]bool
+
+// shelvesFromCache derives the shelves from the directories the books have
+// been downloaded into, relative to root.
+// Books directly in root don't belong to any shelf.
+func shelvesFromCache(cc ts.Cache, root string) Shelves {
+	var shelves = make(Shelves)
+
+	for _, lpath := range cc {
+		rel, err := filepath.Rel(root, filepath.Dir(lpath))
+		if err != nil || rel == "." || rel == ".." || filepath.IsAbs(rel) {
+			continue
+		}
+		name := filepath.ToSlash(rel)
+		if shelves[name] == nil {
+			shelves[name] = make(map[string]bool)
+		}
+		shelves[name][contentID(lpath)] = true
+	}
+	return shelves
+}
+
+// contentID returns the ID Nickel uses for a sideloaded book.
+func contentID(lpath string) string {
+	return "file://" + filepath.ToSlash(devicePath(lpath))
+}
+
+// loadManagedShelves returns the names of the shelves created by Tortuga.
+func loadManagedShelves(path string) (map[string]bool, error) {
+	var names []string
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return make(map[string]bool), nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &names); err != nil {
+		return nil, err
+	}
+
+	managed := make(map[string]bool, len(names))
+	for _, n := range names {
+		managed[n] = true
+	}
+	return managed, nil
+}
+
+func writeManagedShelves(path string, managed map[string]bool) error {
+	names := make([]string, 0, len(managed))
+	for n := range managed {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	b, err := json.MarshalIndent(names, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// applyShelves writes shelves into the Shelf and ShelfContent tables of db.
+// Only the shelves in managed are updated or removed, shelves with the same
+// name created by the user are left untouched.
+// managed is updated in place with the shelves created and removed.
+func applyShelves(db *sql.DB, shelves Shelves, managed map[string]bool) (e error) {
+	now := time.Now().UTC().Format("2006-01-02T15:04:05Z")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("applyShelves: db.Begin: %w", err)
+	}
+	defer func() {
+		if e != nil {
+			tx.Rollback()
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			e = fmt.Errorf("applyShelves: tx.Commit: %w", err)
+		}
+	}()
+
+	for name, books := range shelves {
+		var deleted sql.NullString
+
+		err := tx.QueryRow(`SELECT _IsDeleted FROM Shelf WHERE InternalName = ?`, name).Scan(&deleted)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// Nickel marks the collections made by the user as UserTag.
+			_, err = tx.Exec(
+				`INSERT INTO Shelf (
+				    CreationDate, Id, InternalName, LastModified, Name, Type,
+				    _IsDeleted, _IsVisible, _IsSynced
+				) VALUES (?, ?, ?, ?, ?, 'UserTag', 'false', 'true', 'false')`,
+				now, name, name, now, name,
+			)
+			if err != nil {
+				return fmt.Errorf("applyShelves: tx.Exec: %w", err)
+			}
+			managed[name] = true
+
+		case err != nil:
+			return fmt.Errorf("applyShelves: tx.QueryRow: %w", err)
+
+		case !managed[name] && deleted.String != "true":
+			// A user made shelf.
+			continue
+
+		default:
+			_, err = tx.Exec(
+				`UPDATE Shelf
+				SET LastModified = ?, Type = 'UserTag', _IsDeleted = 'false', _IsVisible = 'true'
+				WHERE InternalName = ?`,
+				now, name,
+			)
+			if err != nil {
+				return fmt.Errorf("applyShelves: tx.Exec: %w", err)
+			}
+			managed[name] = true
+		}
+
+		rows, err := tx.Query(`SELECT ContentId FROM ShelfContent WHERE ShelfName = ?`, name)
+		if err != nil {
+			return fmt.Errorf("applyShelves: tx.Query: %w", err)
+		}
+		var stale []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return fmt.Errorf("applyShelves: rows.Scan: %w", err)
+			}
+			if !books[id] {
+				stale = append(stale, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("applyShelves: rows.Err: %w", err)
+		}
+
+		for _, id := range stale {
+			_, err := tx.Exec(`DELETE FROM ShelfContent WHERE ShelfName = ? AND ContentId = ?`, name, id)
+			if err != nil {
+				return fmt.Errorf("applyShelves: tx.Exec: %w", err)
+			}
+		}
+
+		for id := range books {
+			_, err := tx.Exec(
+				`INSERT OR REPLACE INTO ShelfContent (
+				    ShelfName, ContentId, DateModified, _IsDeleted, _IsSynced
+				) VALUES (?, ?, ?, 'false', 'false')`,
+				name, id, now,
+			)
+			if err != nil {
+				return fmt.Errorf("applyShelves: tx.Exec: %w", err)
+			}
+		}
+	}
+
+	for name := range managed {
+		if _, ok := shelves[name]; ok {
+			continue
+		}
+
+		if _, err := tx.Exec(`DELETE FROM ShelfContent WHERE ShelfName = ?`, name); err != nil {
+			return fmt.Errorf("applyShelves: tx.Exec: %w", err)
+		}
+		_, err := tx.Exec(
+			`UPDATE Shelf SET LastModified = ?, _IsDeleted = 'true' WHERE InternalName = ?`,
+			now, name,
+		)
+		if err != nil {
+			return fmt.Errorf("applyShelves: tx.Exec: %w", err)
+		}
+		delete(managed, name)
+	}
+	return nil
+}
+
+// syncShelves mirrors the server's folders of the downloaded books into
+// the Kobo's shelves.
+func syncShelves(cfg Config) error {
+	lcache, err := loadLocalCache()
+	if err != nil {
+		return fmt.Errorf("syncShelves: loadLocalCache: %w", err)
+	}
+
+	managed, err := loadManagedShelves(shelvespath)
+	if err != nil {
+		return fmt.Errorf("syncShelves: loadManagedShelves: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", dbpath)
+	if err != nil {
+		return fmt.Errorf("syncShelves: sql.Open: %w", err)
+	}
+	defer db.Close()
+
+	if err := applyShelves(db, shelvesFromCache(lcache, cfg.LibraryRoot), managed); err != nil {
+		return fmt.Errorf("syncShelves: %w", err)
+	}
+
+	if err := writeManagedShelves(shelvespath, managed); err != nil {
+		return fmt.Errorf("syncShelves: writeManagedShelves: %w", err)
+	}
+	return nil
+}
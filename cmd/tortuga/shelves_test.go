@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// shelfRows returns the shelves in db, as name, type and deletion flag, and
+// the contents of each one.
+func shelfRows(t *testing.T, db *sql.DB) (map[string][2]string, map[string][]string) {
+	t.Helper()
+
+	shelves := make(map[string][2]string)
+	rows, err := db.Query(`SELECT InternalName, Type, _IsDeleted FROM Shelf`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name, typ, deleted string
+		if err := rows.Scan(&name, &typ, &deleted); err != nil {
+			t.Fatal(err)
+		}
+		shelves[name] = [2]string{typ, deleted}
+	}
+	rows.Close()
+
+	contents := make(map[string][]string)
+	if rows, err = db.Query(`SELECT ShelfName, ContentId FROM ShelfContent`); err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name, id string
+		if err := rows.Scan(&name, &id); err != nil {
+			t.Fatal(err)
+		}
+		contents[name] = append(contents[name], id)
+	}
+	rows.Close()
+	for _, ids := range contents {
+		sort.Strings(ids)
+	}
+	return shelves, contents
+}
+
+func TestApplyShelves(t *testing.T) {
+	for _, schema := range []string{"fw4", "fw4.38"} {
+		t.Run(schema, func(t *testing.T) {
+			db := newKoboDB(t, schema, nil, nil)
+
+			// A collection of the user with the name of a folder.
+			_, err := db.Exec(
+				`INSERT INTO Shelf (Id, InternalName, Name, Type, _IsDeleted, _IsVisible, _IsSynced)
+				VALUES ('Mine', 'Mine', 'Mine', 'UserTag', 'false', 'true', 'true')`,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec(`INSERT INTO ShelfContent (ShelfName, ContentId) VALUES ('Mine', 'file:///mine.epub')`); err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				managed = make(map[string]bool)
+				shelves = Shelves{
+					"Sci-Fi":     {"file:///a.epub": true, "file:///b.epub": true},
+					"Sci-Fi/Old": {"file:///c.epub": true},
+					"Mine":       {"file:///d.epub": true},
+				}
+				wantShelves = map[string][2]string{
+					"Sci-Fi":     {"UserTag", "false"},
+					"Sci-Fi/Old": {"UserTag", "false"},
+					"Mine":       {"UserTag", "false"},
+				}
+				wantContents = map[string][]string{
+					"Sci-Fi":     {"file:///a.epub", "file:///b.epub"},
+					"Sci-Fi/Old": {"file:///c.epub"},
+					"Mine":       {"file:///mine.epub"},
+				}
+			)
+
+			// Running it again changes nothing.
+			for i := 0; i < 2; i++ {
+				if err := applyShelves(db, shelves, managed); err != nil {
+					t.Fatal(err)
+				}
+				gotShelves, gotContents := shelfRows(t, db)
+				if !reflect.DeepEqual(gotShelves, wantShelves) || !reflect.DeepEqual(gotContents, wantContents) {
+					t.Errorf("run %d: shelves = %v %v, want %v %v", i, gotShelves, gotContents, wantShelves, wantContents)
+				}
+			}
+			if !reflect.DeepEqual(managed, map[string]bool{"Sci-Fi": true, "Sci-Fi/Old": true}) {
+				t.Errorf("managed = %v", managed)
+			}
+
+			// A book moved away and a folder emptied.
+			shelves = Shelves{"Sci-Fi": {"file:///a.epub": true}}
+			if err := applyShelves(db, shelves, managed); err != nil {
+				t.Fatal(err)
+			}
+			wantShelves["Sci-Fi/Old"] = [2]string{"UserTag", "true"}
+			wantContents = map[string][]string{
+				"Sci-Fi": {"file:///a.epub"},
+				"Mine":   {"file:///mine.epub"},
+			}
+			gotShelves, gotContents := shelfRows(t, db)
+			if !reflect.DeepEqual(gotShelves, wantShelves) || !reflect.DeepEqual(gotContents, wantContents) {
+				t.Errorf("shelves = %v %v, want %v %v", gotShelves, gotContents, wantShelves, wantContents)
+			}
+			if !reflect.DeepEqual(managed, map[string]bool{"Sci-Fi": true}) {
+				t.Errorf("managed = %v", managed)
+			}
+
+			// The deleted shelf comes back.
+			shelves["Sci-Fi/Old"] = map[string]bool{"file:///c.epub": true}
+			if err := applyShelves(db, shelves, managed); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := shelfRows(t, db); got["Sci-Fi/Old"] != [2]string{"UserTag", "false"} {
+				t.Errorf("Sci-Fi/Old = %v, want it restored", got["Sci-Fi/Old"])
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	ts "github.com/NicoNex/tortugasync"
+)
+
+// Policies used to choose what to download when the space is short.
+const (
+	// SpaceSkip keeps the usual order and skips the books that don't fit.
+	SpaceSkip = "skip"
+	// SpaceSmallest downloads the smallest books first.
+	SpaceSmallest = "smallest"
+	// SpaceNewest downloads the most recently added books first.
+	SpaceNewest = "newest"
+)
+
+var errNoSpace = errors.New("not enough free space")
+
+type download struct {
+	hash  string
+	path  string
+	size  int64
+	mtime time.Time
+}
+
+// queueDownloads stats the pending books on the server, in the given order.
+// The books that can't be stat'ed are reported as failed, it stops at the
+// first one once ctx is done.
+func queueDownloads(ctx context.Context, bay *ts.Bay, pending ts.Cache, hashes []string, rep *Report) []download {
+	var queue = make([]download, 0, len(hashes))
+
+	for _, hash := range hashes {
+		path := pending[hash]
+		fi, err := bay.StatContext(ctx, path)
+		if err != nil {
+			rep.Fail(path, fmt.Errorf("queueDownloads: bay.StatContext: %w", err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		queue = append(queue, download{
+			hash:  hash,
+			path:  path,
+			size:  fi.Size(),
+			mtime: fi.ModTime(),
+		})
+	}
+	return queue
+}
+
+// planDownloads orders queue according to policy and splits it into the
+// downloads that fit in avail bytes and the ones that don't.
+func planDownloads(queue []download, avail int64, policy string) (fit, nofit []download) {
+	switch policy {
+	case SpaceSmallest:
+		sort.SliceStable(queue, func(i, j int) bool {
+			return queue[i].size < queue[j].size
+		})
+	case SpaceNewest:
+		sort.SliceStable(queue, func(i, j int) bool {
+			return queue[i].mtime.After(queue[j].mtime)
+		})
+	}
+
+	for _, d := range queue {
+		if d.size > avail {
+			nofit = append(nofit, d)
+			continue
+		}
+		avail -= d.size
+		fit = append(fit, d)
+	}
+	return
+}
+
+// availSpace returns the bytes that can be written in dir without eating
+// into the reserve.
+// If the free space can't be determined on this platform there's no limit.
+func availSpace(dir string, reserve int64) (int64, error) {
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		dir = koboHome
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		if errors.Is(err, errors.ErrUnsupported) {
+			return math.MaxInt64, nil
+		}
+		return 0, fmt.Errorf("availSpace: freeSpace: %w", err)
+	}
+
+	if free > math.MaxInt64 {
+		free = math.MaxInt64
+	}
+	return int64(free) - reserve, nil
+}
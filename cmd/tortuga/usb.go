@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var errNoKobo = errors.New("no Kobo found")
+
+// mountRoots returns the directories desktop systems mount removable
+// drives into.
+func mountRoots() []string {
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{"/Volumes"}
+
+	case "windows":
+		var drives []string
+		for c := 'D'; c <= 'Z'; c++ {
+			drives = append(drives, string(c)+":\\")
+		}
+		return drives
+
+	default:
+		name := os.Getenv("USER")
+		if u, err := user.Current(); err == nil {
+			name = u.Username
+		}
+		return []string{
+			filepath.Join("/", "media", name),
+			filepath.Join("/", "run", "media", name),
+			filepath.Join("/", "media"),
+			filepath.Join("/", "mnt"),
+		}
+	}
+}
+
+// isKobo reports whether dir is the root of a Kobo's filesystem.
+func isKobo(dir string) bool {
+	fi, err := os.Stat(filepath.Join(dir, ".kobo"))
+	return err == nil && fi.IsDir()
+}
+
+// findKobo returns the mount point of the Kobo plugged over USB.
+func findKobo(roots []string) (string, error) {
+	var found []string
+
+	for _, root := range roots {
+		if isKobo(root) {
+			found = append(found, root)
+			continue
+		}
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if dir := filepath.Join(root, e.Name()); e.IsDir() && isKobo(dir) {
+				found = append(found, dir)
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("findKobo: %w in %s", errNoKobo, strings.Join(roots, ", "))
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("findKobo: several Kobos found, pick one with -home: %s", strings.Join(found, ", "))
+	}
+}
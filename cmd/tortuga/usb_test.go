@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindKobo(t *testing.T) {
+	var (
+		media = t.TempDir()
+		empty = t.TempDir()
+		kobo  = filepath.Join(media, "KOBOeReader")
+	)
+	for _, dir := range []string{filepath.Join(kobo, ".kobo"), filepath.Join(media, "USB STICK")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := findKobo([]string{empty, filepath.Join(empty, "missing"), media})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != kobo {
+		t.Errorf("findKobo() = %q, want %q", got, kobo)
+	}
+
+	// A mount root can be the Kobo itself.
+	if got, err := findKobo([]string{kobo}); err != nil || got != kobo {
+		t.Errorf("findKobo() = %q, %v, want %q", got, err, kobo)
+	}
+
+	if _, err := findKobo([]string{empty}); !errors.Is(err, errNoKobo) {
+		t.Errorf("findKobo() error = %v, want errNoKobo", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(media, "KOBOeReader 2", ".kobo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := findKobo([]string{media}); err == nil {
+		t.Error("expected an error with several Kobos mounted")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// Telegram refuses the messages longer than this.
+const maxMessageLen = 4096
+
+var (
+	// Most files taken from an archive.
+	maxArchiveEntries = 500
+	// Most bytes extracted from an archive, whatever its headers say.
+	maxArchiveSize int64 = 4 << 30
+
+	errArchiveLimit = errors.New("the archive holds too many files or too much data")
+)
+
+// entry is a file taken from an archive.
+type entry struct {
+	Name string
+	// Tmp is the temporary file the entry has been extracted to, empty when
+	// Err is set.
+	Tmp string
+	Err error
+}
+
+// isArchive reports whether name is an archive of books, comic book archives
+// are books themselves.
+func isArchive(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".zip") ||
+		strings.HasSuffix(name, ".tar.gz") ||
+		strings.HasSuffix(name, ".tgz")
+}
+
+// extractor spools the files of an archive keeping within the limits.
+type extractor struct {
+	entries []entry
+	size    int64
+}
+
+// add extracts the file named name from r.
+// Only the base name of the file is kept, so nothing can be written outside
+// of the library, and hidden files like the macOS metadata are ignored.
+func (e *extractor) add(name string, r io.Reader) error {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if strings.HasPrefix(name, ".") {
+		return nil
+	}
+	if len(e.entries) == maxArchiveEntries {
+		return errArchiveLimit
+	}
+
+	if !isAllowedExt(path.Ext(name)) {
+		e.entries = append(e.entries, entry{Name: name, Err: errBadExt})
+		return nil
+	}
+
+	tmp, err := spool(r, maxArchiveSize-e.size)
+	if errors.Is(err, errTooBig) {
+		return errArchiveLimit
+	} else if err != nil {
+		return err
+	}
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	e.size += fi.Size()
+	e.entries = append(e.entries, entry{Name: name, Tmp: tmp})
+	return nil
+}
+
+// clean removes the files extracted so far.
+func (e *extractor) clean() {
+	for _, en := range e.entries {
+		if en.Tmp != "" {
+			os.Remove(en.Tmp)
+		}
+	}
+}
+
+// extractArchive extracts the regular files of the archive named name, saved
+// at tmp, into temporary files.
+// Directories, links and the files of unsupported types are skipped, the
+// latter being reported among the entries.
+func extractArchive(name, tmp string) ([]entry, error) {
+	var (
+		e   extractor
+		err error
+	)
+
+	if strings.HasSuffix(strings.ToLower(name), ".zip") {
+		err = extractZip(&e, tmp)
+	} else {
+		err = extractTarGz(&e, tmp)
+	}
+	if err != nil {
+		e.clean()
+		return nil, fmt.Errorf("extractArchive: %w", err)
+	}
+	return e.entries, nil
+}
+
+func extractZip(e *extractor, tmp string) error {
+	zr, err := zip.OpenReader(tmp)
+	if err != nil {
+		return fmt.Errorf("extractZip: zip.OpenReader: %w", err)
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+		f, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("extractZip: zf.Open: %w", err)
+		}
+		err = e.add(zf.Name, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("extractZip: %w", err)
+		}
+	}
+	return nil
+}
+
+func extractTarGz(e *extractor, tmp string) error {
+	f, err := os.Open(tmp)
+	if err != nil {
+		return fmt.Errorf("extractTarGz: os.Open: %w", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("extractTarGz: gzip.NewReader: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("extractTarGz: tr.Next: %w", err)
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if err := e.add(hdr.Name, tr); err != nil {
+			return fmt.Errorf("extractTarGz: %w", err)
+		}
+	}
+}
+
+// storeArchive stores the books in the archive named name, saved at tmp,
+// and replies with the outcome of each of them.
+func (b *bot) storeArchive(name, tmp string) storeResult {
+	entries, err := extractArchive(name, tmp)
+	os.Remove(tmp)
+	switch {
+	case errors.Is(err, errArchiveLimit):
+		b.send(fmt.Sprintf(
+			"Arr, %s be too big to unpack: at most %d files and %s.",
+			name, maxArchiveEntries, byteSize(maxArchiveSize),
+		))
+		return storeFailed
+	case err != nil:
+		log.Println("b.storeArchive", err)
+		b.send("An error occurred while unpacking " + name + ".")
+		return storeFailed
+	case len(entries) == 0:
+		b.send(noBook)
+		return storeFailed
+	}
+
+	if isImageSet(entries) {
+		return b.storeImageSet(name, entries)
+	}
+
+	lines := []string{"Unpacked " + name + ":"}
+	for _, en := range entries {
+		if en.Err != nil {
+			lines = append(lines, fmt.Sprintf("✗ %s: %v", en.Name, en.Err))
+			continue
+		}
+
+		switch res, stored, err := b.ingest(en.Name, en.Tmp); res {
+		case storeSaved:
+			lines = append(lines, "✓ "+stored)
+		case storeSkipped:
+			lines = append(lines, fmt.Sprintf("= %s: already aboard as %s", en.Name, stored))
+		case storeAsked:
+			lines = append(lines, fmt.Sprintf("? %s: waiting for yer orders", en.Name))
+		default:
+			var broken epubError
+			if errors.As(err, &broken) {
+				lines = append(lines, fmt.Sprintf("✗ %s: %v", en.Name, broken))
+				break
+			}
+			log.Println("b.storeArchive", err)
+			lines = append(lines, fmt.Sprintf("✗ %s: couldn't be stowed", en.Name))
+		}
+	}
+	b.sendLines(lines)
+	return storeUnpacked
+}
+
+// storeImageSet packs the images extracted from the archive name into a CBZ
+// and stores it.
+func (b *bot) storeImageSet(name string, entries []entry) storeResult {
+	tmp, err := packCBZ(entries)
+	for _, en := range entries {
+		if en.Tmp != "" {
+			os.Remove(en.Tmp)
+		}
+	}
+	if err != nil {
+		log.Println("b.storeImageSet", err)
+		b.send("An error occurred while packing " + name + ".")
+		return storeFailed
+	}
+
+	return b.storeEbook(archiveStem(name)+".cbz", tmp)
+}
+
+// archiveStem returns the name of the archive without its extension.
+func archiveStem(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".tar.gz") {
+		return name[:len(name)-len(".tar.gz")]
+	}
+	return name[:len(name)-len(path.Ext(name))]
+}
+
+// sendLines sends the lines in as few messages as Telegram allows.
+func (b *bot) sendLines(lines []string) {
+	var buf strings.Builder
+
+	for _, l := range lines {
+		l = truncate(l, maxMessageLen/4)
+		if buf.Len()+len(l)+1 > maxMessageLen {
+			b.send(buf.String())
+			buf.Reset()
+		}
+		buf.WriteString(l)
+		buf.WriteByte('\n')
+	}
+	if buf.Len() > 0 {
+		b.send(buf.String())
+	}
+}
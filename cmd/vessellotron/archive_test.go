@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveFile is a file in the archives written by the tests, a non empty
+// link makes it a symlink.
+type archiveFile struct {
+	name, body, link string
+}
+
+func writeZip(t *testing.T, path string, files []archiveFile) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &zip.FileHeader{Name: f.name, Method: zip.Deflate}
+		body := f.body
+		switch {
+		case f.link != "":
+			hdr.SetMode(os.ModeSymlink | 0777)
+			body = f.link
+		case strings.HasSuffix(f.name, "/"):
+			hdr.SetMode(os.ModeDir | 0755)
+		default:
+			hdr.SetMode(0644)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTarGz(t *testing.T, path string, files []archiveFile) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body)), Typeflag: tar.TypeReg}
+		switch {
+		case f.link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, f.link, 0
+		case strings.HasSuffix(f.name, "/"):
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(f.body))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsArchive(t *testing.T) {
+	for name, want := range map[string]bool{
+		"books.zip":    true,
+		"BOOKS.ZIP":    true,
+		"books.tar.gz": true,
+		"books.tgz":    true,
+		"comic.cbz":    false,
+		"book.epub":    false,
+		"notes.gz":     false,
+	} {
+		if got := isArchive(name); got != want {
+			t.Errorf("isArchive(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	dir := withHome(t)
+
+	files := []archiveFile{
+		{name: "books/"},
+		{name: "books/dune.epub", body: "dune"},
+		{name: "books/comic.cbz", body: "comic"},
+		{name: "../../evil.pdf", body: "evil"},
+		{name: "/etc/abs.txt", body: "abs"},
+		{name: "books/setup.exe", body: "exe"},
+		{name: "__MACOSX/books/._dune.epub", body: "junk"},
+		{name: "books/link.pdf", link: "/etc/passwd"},
+	}
+	want := map[string]string{
+		"dune.epub": "dune",
+		"comic.cbz": "comic",
+		"evil.pdf":  "evil",
+		"abs.txt":   "abs",
+		"setup.exe": "",
+	}
+
+	for _, name := range []string{"books.zip", "books.tar.gz"} {
+		t.Run(name, func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), name)
+			if strings.HasSuffix(name, ".zip") {
+				writeZip(t, src, files)
+			} else {
+				writeTarGz(t, src, files)
+			}
+
+			entries, err := extractArchive(name, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]string)
+			for _, en := range entries {
+				if en.Err != nil {
+					if !errors.Is(en.Err, errBadExt) {
+						t.Errorf("%s: unexpected error %v", en.Name, en.Err)
+					}
+					got[en.Name] = ""
+					continue
+				}
+				if filepath.Dir(en.Tmp) != dir {
+					t.Errorf("%s extracted to %s, outside of %s", en.Name, en.Tmp, dir)
+				}
+				b, err := os.ReadFile(en.Tmp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[en.Name] = string(b)
+				os.Remove(en.Tmp)
+			}
+
+			if len(got) != len(want) {
+				t.Errorf("entries = %v, want %v", got, want)
+			}
+			for k, v := range want {
+				if g, ok := got[k]; !ok || g != v {
+					t.Errorf("%s = %q, %t, want %q", k, g, ok, v)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	dir := withHome(t)
+	defer func(n int, size int64) {
+		maxArchiveEntries, maxArchiveSize = n, size
+	}(maxArchiveEntries, maxArchiveSize)
+	maxArchiveEntries, maxArchiveSize = 2, 1000
+
+	tests := []struct {
+		name  string
+		files []archiveFile
+	}{
+		{"entries", []archiveFile{
+			{name: "a.pdf", body: "a"},
+			{name: "b.pdf", body: "b"},
+			{name: "c.pdf", body: "c"},
+		}},
+		// Highly compressible, like a zip bomb.
+		{"size", []archiveFile{
+			{name: "a.pdf", body: "a"},
+			{name: "b.pdf", body: strings.Repeat("b", 1000)},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), "books.zip")
+			writeZip(t, src, tt.files)
+
+			if _, err := extractArchive("books.zip", src); !errors.Is(err, errArchiveLimit) {
+				t.Errorf("extractArchive() error = %v, want %v", err, errArchiveLimit)
+			}
+			if tmps, _ := filepath.Glob(filepath.Join(dir, ".vessellotron-*")); len(tmps) != 0 {
+				t.Errorf("temporary files left: %q", tmps)
+			}
+		})
+	}
+}
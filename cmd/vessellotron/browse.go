@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/NicoNex/echotron/v3"
+)
+
+// Books per page of the listing.
+const pageSize = 8
+
+// escapeCode escapes the text of a MarkdownV2 code entity.
+var escapeCode = strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace
+
+// page renders the page n of the books matching query, clamping n to the
+// available pages.
+func page(query string, n int) (string, echotron.InlineKeyboardMarkup) {
+	var (
+		books = lib.Search(query)
+		pages = max(1, (len(books)+pageSize-1)/pageSize)
+		buf   strings.Builder
+		kbd   [][]echotron.InlineKeyboardButton
+	)
+	n = min(max(n, 0), pages-1)
+
+	switch {
+	case query != "":
+		fmt.Fprintf(&buf, "Barrels matchin' *%s*", escapeMD(query))
+	default:
+		buf.WriteString("Yer library")
+	}
+	fmt.Fprintf(&buf, " \\(%d\\)\n\n", len(books))
+	if len(books) == 0 {
+		buf.WriteString(escapeMD(noBook))
+	}
+
+	start := n * pageSize
+	for i, b := range books[start:min(start+pageSize, len(books))] {
+		fmt.Fprintf(&buf, "%d\\. *%s*", start+i+1, escapeMD(b.Name()))
+		if b.Author != "" {
+			fmt.Fprintf(&buf, " \\- %s", escapeMD(b.Author))
+		}
+		buf.WriteString("\n")
+
+		kbd = append(kbd, []echotron.InlineKeyboardButton{{
+			Text:         fmt.Sprintf("%d. %s", start+i+1, truncate(b.Name(), 40)),
+			CallbackData: fmt.Sprintf("book:%s:%d", b.Hash, n),
+		}})
+	}
+
+	if pages > 1 {
+		var nav []echotron.InlineKeyboardButton
+		if n > 0 {
+			nav = append(nav, echotron.InlineKeyboardButton{Text: "« Prev", CallbackData: fmt.Sprintf("page:%d", n-1)})
+		}
+		nav = append(nav, echotron.InlineKeyboardButton{Text: fmt.Sprintf("%d/%d", n+1, pages), CallbackData: "noop"})
+		if n < pages-1 {
+			nav = append(nav, echotron.InlineKeyboardButton{Text: "Next »", CallbackData: fmt.Sprintf("page:%d", n+1)})
+		}
+		kbd = append(kbd, nav)
+	}
+	return buf.String(), echotron.InlineKeyboardMarkup{InlineKeyboard: kbd}
+}
+
+// details renders the book with the given hash, with a delete button for the
+// admins and one to go back to the page it was listed in.
+func details(b Book, role Role, n int) (string, echotron.InlineKeyboardMarkup) {
+	var buf strings.Builder
+
+	fmt.Fprintf(&buf, "*%s*\n", escapeMD(b.Name()))
+	if b.Author != "" {
+		fmt.Fprintf(&buf, "by %s\n", escapeMD(b.Author))
+	}
+	fmt.Fprintf(&buf, "\nFile: `%s`\n", escapeCode(b.Path))
+	if fi, err := os.Stat(b.Path); err == nil {
+		fmt.Fprintf(&buf, "Size: %s\n", escapeMD(byteSize(fi.Size())))
+	}
+	fmt.Fprintf(&buf, "MD5: `%s`", b.Hash)
+
+	var row []echotron.InlineKeyboardButton
+	if role.CanManage() {
+		row = append(row, echotron.InlineKeyboardButton{Text: "Delete", CallbackData: fmt.Sprintf("del:%s:%d", b.Hash, n)})
+	}
+	row = append(row, echotron.InlineKeyboardButton{Text: "« Back", CallbackData: fmt.Sprintf("page:%d", n)})
+	return buf.String(), echotron.InlineKeyboardMarkup{InlineKeyboard: [][]echotron.InlineKeyboardButton{row}}
+}
+
+// confirmDelete asks whether to really delete the book.
+func confirmDelete(b Book, n int) (string, echotron.InlineKeyboardMarkup) {
+	text := fmt.Sprintf("Throw *%s* overboard?", escapeMD(b.Name()))
+	return text, echotron.InlineKeyboardMarkup{
+		InlineKeyboard: [][]echotron.InlineKeyboardButton{{
+			{Text: "Yes, delete it", CallbackData: fmt.Sprintf("rm:%s:%d", b.Hash, n)},
+			{Text: "No", CallbackData: fmt.Sprintf("book:%s:%d", b.Hash, n)},
+		}},
+	}
+}
+
+// sendPage sends the first page of the books matching query and remembers
+// the query for the navigation of that message.
+func (b *bot) sendPage(query string) {
+	text, kbd := page(query, 0)
+	res, err := b.SendMessage(text, b.chatID, &echotron.MessageOptions{
+		ParseMode:   echotron.MarkdownV2,
+		ReplyMarkup: kbd,
+	})
+	if err != nil {
+		log.Println("b.sendPage", "b.SendMessage", err)
+		return
+	}
+
+	b.mu.Lock()
+	b.queries[res.Result.ID] = query
+	b.mu.Unlock()
+}
+
+// callback handles the buttons of the listings.
+func (b *bot) callback(cq *echotron.CallbackQuery, role Role) {
+	var answer string
+	defer func() {
+		if _, err := b.AnswerCallbackQuery(cq.ID, &echotron.CallbackQueryOptions{Text: answer}); err != nil {
+			log.Println("b.callback", "b.AnswerCallbackQuery", err)
+		}
+	}()
+
+	if cq.Message == nil || cq.Data == "noop" {
+		return
+	}
+
+	if rest, ok := strings.CutPrefix(cq.Data, "dup:"); ok {
+		if !role.CanUpload() {
+			answer = noRights
+			return
+		}
+		choice, sid, _ := strings.Cut(rest, ":")
+		id, _ := strconv.Atoi(sid)
+		b.editText(cq.Message.ID, b.resolveDuplicate(choice, id))
+		return
+	}
+	if !role.CanList() {
+		answer = noRights
+		return
+	}
+
+	var (
+		msgID      = cq.Message.ID
+		toks       = strings.Split(cq.Data, ":")
+		action     = toks[0]
+		hash, npag string
+	)
+	switch len(toks) {
+	case 2:
+		npag = toks[1]
+	case 3:
+		hash, npag = toks[1], toks[2]
+	}
+	n, _ := strconv.Atoi(npag)
+
+	b.mu.Lock()
+	query := b.queries[msgID]
+	b.mu.Unlock()
+
+	var (
+		text string
+		kbd  echotron.InlineKeyboardMarkup
+	)
+	switch action {
+	case "page":
+		text, kbd = page(query, n)
+
+	case "book", "del", "rm":
+		book, ok := lib.Get(hash)
+		if !ok {
+			answer = "Unknown book"
+			text, kbd = page(query, n)
+			break
+		}
+
+		switch {
+		case action == "book":
+			text, kbd = details(book, role, n)
+
+		case !role.CanManage():
+			answer = noRights
+			return
+
+		case action == "del":
+			text, kbd = confirmDelete(book, n)
+
+		default:
+			if err := b.removeBook(hash); err != nil {
+				answer = err.Error()
+			} else {
+				answer = "Deleted " + book.Name()
+			}
+			text, kbd = page(query, n)
+		}
+
+	default:
+		return
+	}
+
+	_, err := b.EditMessageText(text, echotron.NewMessageID(b.chatID, msgID), &echotron.MessageTextOptions{
+		ParseMode:   echotron.MarkdownV2,
+		ReplyMarkup: kbd,
+	})
+	if err != nil {
+		log.Println("b.callback", "b.EditMessageText", err)
+	}
+}
+
+// editText replaces the text of the message and removes its buttons.
+func (b *bot) editText(msgID int, text string) {
+	if _, err := b.EditMessageText(text, echotron.NewMessageID(b.chatID, msgID), nil); err != nil {
+		log.Println("b.editText", "b.EditMessageText", err)
+	}
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
+
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NicoNex/echotron/v3"
+)
+
+// Role is what a chat is allowed to do with the library.
+type Role string
+
+const (
+	// Admin can do everything, including deleting books and approving invites.
+	Admin Role = "admin"
+	// Contributor can only upload books.
+	Contributor Role = "contributor"
+	// Reader can only list the books.
+	Reader Role = "reader"
+
+	// How long an invite code can be approved for.
+	inviteTTL = 24 * time.Hour
+	// How long a chat has to wait between two invites.
+	inviteCooldown = time.Hour
+	// Most invites waiting for the admins at once.
+	maxPendingInvites = 10
+)
+
+var (
+	errNoToken    = errors.New("no bot token, set it in the config or in VESSELLOTRON_TOKEN")
+	errBadRole    = errors.New("unknown role")
+	errBadInvite  = errors.New("unknown or expired invite code")
+	errNoSuchUser = errors.New("unknown chat")
+	errNoSenders  = errors.New("no senders allowed to email books")
+
+	// The chat already has an invite waiting for the admins.
+	errInvitePending = errors.New("invite already pending")
+	// The chat asked for an invite too recently.
+	errInviteCooldown = errors.New("invite asked too recently")
+	// Too many chats are waiting for the admins.
+	errTooManyInvites = errors.New("too many pending invites")
+
+	// Environment variables listing the chat IDs of each role.
+	roleEnvs = map[string]Role{
+		"VESSELLOTRON_ADMINS":       Admin,
+		"VESSELLOTRON_CONTRIBUTORS": Contributor,
+		"VESSELLOTRON_READERS":      Reader,
+	}
+)
+
+func (r Role) valid() bool {
+	return r == Admin || r == Contributor || r == Reader
+}
+
+func (r Role) CanUpload() bool {
+	return r == Admin || r == Contributor
+}
+
+func (r Role) CanList() bool {
+	return r == Admin || r == Reader
+}
+
+func (r Role) CanManage() bool {
+	return r == Admin
+}
+
+type invite struct {
+	chatID  int64
+	expires time.Time
+}
+
+// Config holds the bot token and the chats allowed to use the bot.
+// It's shared by all the sessions.
+type Config struct {
+	// Token is the Telegram bot token.
+	Token string `json:"token"`
+	// Users maps the allowed chat IDs to their role.
+	Users map[int64]Role `json:"users"`
+	// APIURL is the address of a local Bot API server, e.g.
+	// http://localhost:8081, which lifts the limit on the size of the files.
+	APIURL string `json:"api_url"`
+	// MaxDownload is the size in bytes of the biggest book downloaded from
+	// a link.
+	MaxDownload int64 `json:"max_download"`
+	// Convert are the default settings of the EPUB to KEPUB conversion.
+	Convert ConvertOptions `json:"convert"`
+	// UserConvert are the conversion settings changed by the users, by chat
+	// ID.
+	UserConvert map[int64]ConvertOptions `json:"user_convert"`
+	// Mail configures the books sent by email.
+	Mail MailConfig `json:"mail"`
+
+	path string
+	// Token and users from the environment, never written to the file.
+	envToken string
+	env      map[int64]Role
+	invites  map[string]invite
+	// When each chat last asked for an invite, within inviteCooldown.
+	invited map[int64]time.Time
+	mu      sync.RWMutex
+}
+
+// LoadConfig reads the JSON formatted config at path, a missing file is not
+// an error.
+// The environment variables VESSELLOTRON_TOKEN and VESSELLOTRON_ADMINS,
+// VESSELLOTRON_CONTRIBUTORS and VESSELLOTRON_READERS, comma separated chat
+// IDs, take precedence over the file.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{
+		Users:       make(map[int64]Role),
+		MaxDownload: 100 << 20,
+		Convert:     defaultConvert,
+		UserConvert: make(map[int64]ConvertOptions),
+		Mail:        MailConfig{Domain: "localhost", MaxSize: 50 << 20},
+		path:        path,
+		env:         make(map[int64]Role),
+		invites:     make(map[string]invite),
+		invited:     make(map[int64]time.Time),
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("LoadConfig: os.ReadFile: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, cfg); err != nil {
+			return nil, fmt.Errorf("LoadConfig: json.Unmarshal: %w", err)
+		}
+		if cfg.Users == nil {
+			cfg.Users = make(map[int64]Role)
+		}
+		if cfg.UserConvert == nil {
+			cfg.UserConvert = make(map[int64]ConvertOptions)
+		}
+	}
+	for id, r := range cfg.Users {
+		if !r.valid() {
+			return nil, fmt.Errorf("LoadConfig: %w %q for %d", errBadRole, r, id)
+		}
+	}
+	if err := cfg.Convert.validate(); err != nil {
+		return nil, fmt.Errorf("LoadConfig: convert: %w", err)
+	}
+	for id, o := range cfg.UserConvert {
+		if err := o.validate(); err != nil {
+			return nil, fmt.Errorf("LoadConfig: user_convert %d: %w", id, err)
+		}
+	}
+	if cfg.Mail.Listen != "" && len(cfg.Mail.Senders) == 0 {
+		return nil, fmt.Errorf("LoadConfig: mail: %w", errNoSenders)
+	}
+	if cfg.Mail.Listen != "" && cfg.Mail.AuthServID == "" && cfg.Mail.exposed() {
+		return nil, fmt.Errorf("LoadConfig: mail: %w", errMailExposed)
+	}
+
+	cfg.envToken = strings.TrimSpace(os.Getenv("VESSELLOTRON_TOKEN"))
+	if cfg.BotToken() == "" {
+		return nil, fmt.Errorf("LoadConfig: %w", errNoToken)
+	}
+
+	for name, r := range roleEnvs {
+		for _, s := range strings.Split(os.Getenv(name), ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("LoadConfig: %s: %w", name, err)
+			}
+			cfg.env[id] = r
+		}
+	}
+	return cfg, nil
+}
+
+// BotToken returns the token to authenticate the bot with.
+func (c *Config) BotToken() string {
+	if c.envToken != "" {
+		return c.envToken
+	}
+	return c.Token
+}
+
+// API returns a client of the Bot API server in use.
+func (c *Config) API() echotron.API {
+	if c.APIURL == "" {
+		return echotron.NewAPI(c.BotToken())
+	}
+	return echotron.NewLocalAPI(c.botURL(), c.BotToken())
+}
+
+// botURL returns the base URL of the bot methods.
+func (c *Config) botURL() string {
+	return fmt.Sprintf("%s/bot%s/", strings.TrimSuffix(c.APIURL, "/"), c.BotToken())
+}
+
+// fileURL returns the URL to download the file at path, as returned by
+// getFile.
+func (c *Config) fileURL(path string) string {
+	base := "https://api.telegram.org"
+	if c.APIURL != "" {
+		base = strings.TrimSuffix(c.APIURL, "/")
+	}
+	return fmt.Sprintf("%s/file/bot%s/%s", base, c.BotToken(), path)
+}
+
+// Role returns the role of chatID and whether it's allowed at all.
+func (c *Config) Role(chatID int64) (Role, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if r, ok := c.env[chatID]; ok {
+		return r, true
+	}
+	r, ok := c.Users[chatID]
+	return r, ok
+}
+
+// Admins returns the chat IDs of the admins.
+func (c *Config) Admins() []int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var ids []int64
+	for id, r := range c.Users {
+		if r == Admin {
+			ids = append(ids, id)
+		}
+	}
+	for id, r := range c.env {
+		if _, ok := c.Users[id]; r == Admin && !ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// ConvertOptions returns the conversion settings of chatID.
+func (c *Config) ConvertOptions(chatID int64) ConvertOptions {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if o, ok := c.UserConvert[chatID]; ok {
+		return o
+	}
+	return c.Convert
+}
+
+// SetConvertOptions saves the conversion settings of chatID.
+func (c *Config) SetConvertOptions(chatID int64, o ConvertOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.UserConvert[chatID] = o
+	if err := c.save(); err != nil {
+		return fmt.Errorf("c.SetConvertOptions: %w", err)
+	}
+	return nil
+}
+
+// Invite issues a one-time code for chatID to be approved by an admin.
+// A chat can have a single code pending and can't ask for another one within
+// inviteCooldown, so that the admins aren't flooded with requests.
+func (c *Config) Invite(chatID int64) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("c.Invite: rand.Read: %w", err)
+	}
+	code := strings.ToUpper(hex.EncodeToString(b))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, inv := range c.invites {
+		switch {
+		case now.After(inv.expires):
+			delete(c.invites, k)
+		case inv.chatID == chatID:
+			return "", fmt.Errorf("c.Invite: %w", errInvitePending)
+		}
+	}
+	for id, t := range c.invited {
+		if now.Sub(t) >= inviteCooldown {
+			delete(c.invited, id)
+		}
+	}
+
+	if _, ok := c.invited[chatID]; ok {
+		return "", fmt.Errorf("c.Invite: %w", errInviteCooldown)
+	}
+	if len(c.invites) >= maxPendingInvites {
+		return "", fmt.Errorf("c.Invite: %w", errTooManyInvites)
+	}
+	c.invites[code] = invite{chatID: chatID, expires: now.Add(inviteTTL)}
+	c.invited[chatID] = now
+	return code, nil
+}
+
+// Approve consumes the invite code and grants role to the chat that
+// requested it, returning its ID.
+func (c *Config) Approve(code string, role Role) (int64, error) {
+	if !role.valid() {
+		return 0, fmt.Errorf("c.Approve: %w %q", errBadRole, role)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	code = strings.ToUpper(code)
+	inv, ok := c.invites[code]
+	if !ok || time.Now().After(inv.expires) {
+		delete(c.invites, code)
+		return 0, fmt.Errorf("c.Approve: %w", errBadInvite)
+	}
+	delete(c.invites, code)
+
+	c.Users[inv.chatID] = role
+	if err := c.save(); err != nil {
+		return inv.chatID, fmt.Errorf("c.Approve: %w", err)
+	}
+	return inv.chatID, nil
+}
+
+// Revoke removes chatID from the users in the config file.
+func (c *Config) Revoke(chatID int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.Users[chatID]; !ok {
+		return fmt.Errorf("c.Revoke: %w %d", errNoSuchUser, chatID)
+	}
+	delete(c.Users, chatID)
+	if err := c.save(); err != nil {
+		return fmt.Errorf("c.Revoke: %w", err)
+	}
+	return nil
+}
+
+// save writes the config to its file, c.mu must be held.
+func (c *Config) save() error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("c.save: json.MarshalIndent: %w", err)
+	}
+	// The file holds the token.
+	if err := os.WriteFile(c.path, b, 0600); err != nil {
+		return fmt.Errorf("c.save: os.WriteFile: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vessellotron.json")
+	if err := os.WriteFile(path, []byte(`{"token": "file", "users": {"1": "admin", "2": "reader"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VESSELLOTRON_TOKEN", "")
+	t.Setenv("VESSELLOTRON_CONTRIBUTORS", "2, 3")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BotToken() != "file" {
+		t.Errorf("BotToken() = %q, want %q", cfg.BotToken(), "file")
+	}
+
+	tests := map[int64]Role{1: Admin, 2: Contributor, 3: Contributor}
+	for id, want := range tests {
+		if got, ok := cfg.Role(id); !ok || got != want {
+			t.Errorf("Role(%d) = %q, %v, want %q", id, got, ok, want)
+		}
+	}
+	if _, ok := cfg.Role(4); ok {
+		t.Error("Role(4) is allowed")
+	}
+
+	t.Setenv("VESSELLOTRON_TOKEN", "env")
+	if cfg, err = LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BotToken() != "env" {
+		t.Errorf("BotToken() = %q, want %q", cfg.BotToken(), "env")
+	}
+
+	t.Setenv("VESSELLOTRON_TOKEN", "")
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, errNoToken) {
+		t.Errorf("LoadConfig() error = %v, want errNoToken", err)
+	}
+}
+
+func TestInvite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vessellotron.json")
+	t.Setenv("VESSELLOTRON_TOKEN", "env")
+	t.Setenv("VESSELLOTRON_ADMINS", "1")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := cfg.Invite(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.Invite(42); !errors.Is(err, errInvitePending) {
+		t.Errorf("Invite() again error = %v, want errInvitePending", err)
+	}
+	if _, err := cfg.Approve("00000000", Reader); !errors.Is(err, errBadInvite) {
+		t.Errorf("Approve() with an unknown code error = %v, want errBadInvite", err)
+	}
+	if _, err := cfg.Approve(code, "captain"); !errors.Is(err, errBadRole) {
+		t.Errorf("Approve() with an unknown role error = %v, want errBadRole", err)
+	}
+
+	id, err := cfg.Approve(code, Contributor)
+	if err != nil || id != 42 {
+		t.Fatalf("Approve() = %d, %v", id, err)
+	}
+	if _, err := cfg.Approve(code, Contributor); !errors.Is(err, errBadInvite) {
+		t.Errorf("Approve() twice error = %v, want errBadInvite", err)
+	}
+
+	// Once approved, the chat still has to wait before asking again.
+	if _, err := cfg.Invite(42); !errors.Is(err, errInviteCooldown) {
+		t.Errorf("Invite() after the approval error = %v, want errInviteCooldown", err)
+	}
+	cfg.invited[42] = time.Now().Add(-inviteCooldown)
+	if _, err := cfg.Invite(42); err != nil {
+		t.Errorf("Invite() after the cooldown error = %v", err)
+	}
+
+	// The admins get a bounded number of requests.
+	for id := int64(100); id < 100+maxPendingInvites; id++ {
+		_, err = cfg.Invite(id)
+	}
+	if !errors.Is(err, errTooManyInvites) {
+		t.Errorf("Invite() error = %v with %d pending, want errTooManyInvites", err, maxPendingInvites)
+	}
+
+	// The approved user is persisted, the environment isn't.
+	t.Setenv("VESSELLOTRON_ADMINS", "")
+	saved, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := saved.Role(42); !ok || r != Contributor {
+		t.Errorf("saved Role(42) = %q, %v, want %q", r, ok, Contributor)
+	}
+	if _, ok := saved.Role(1); ok || saved.Token != "" {
+		t.Errorf("the environment leaked into the config: %+v", saved)
+	}
+}
+
+func TestConvertOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vessellotron.json")
+	t.Setenv("VESSELLOTRON_TOKEN", "env")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := cfg.ConvertOptions(1); o != defaultConvert {
+		t.Errorf("ConvertOptions(1) = %+v, want the defaults", o)
+	}
+
+	want := ConvertOptions{Hyphenate: "off", FontSize: "110%"}
+	if err := cfg.SetConvertOptions(1, want); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if o := cfg.ConvertOptions(1); o != want {
+		t.Errorf("ConvertOptions(1) = %+v, want %+v", o, want)
+	}
+	if o := cfg.ConvertOptions(2); o != defaultConvert {
+		t.Errorf("ConvertOptions(2) = %+v, want the defaults", o)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"convert": {"font_size": "1em; color: red"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); !errors.Is(err, errBadValue) {
+		t.Errorf("LoadConfig() error = %v, want errBadValue", err)
+	}
+}
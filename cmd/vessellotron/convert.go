@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pgaskin/kepubify/v4/kepub"
+)
+
+var (
+	fontSizeRe = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(em|rem|px|pt|%)$`)
+
+	errBadOption = errors.New("unknown conversion setting")
+	errBadValue  = errors.New("invalid value")
+	errNotEPUB   = errors.New("only EPUBs can be converted")
+
+	// Conversion of the users who haven't changed any setting.
+	defaultConvert = ConvertOptions{Smartypants: true}
+)
+
+// ConvertOptions are the settings of the EPUB to KEPUB conversion.
+type ConvertOptions struct {
+	// Smartypants turns the straight quotes and dashes into typographic ones.
+	Smartypants bool `json:"smartypants"`
+	// Hyphenate forces the hyphenation "on" or "off", empty leaves it to the
+	// book.
+	Hyphenate string `json:"hyphenate"`
+	// FullScreenFixes fixes the layout on the firmwares older than 4.19.
+	FullScreenFixes bool `json:"fullscreen_fixes"`
+	// FontSize overrides the base font size of the book with a CSS length,
+	// e.g. 1.2em.
+	FontSize string `json:"font_size"`
+	// KeepOriginal stores the EPUB alongside its KEPUB.
+	KeepOriginal bool `json:"keep_original"`
+}
+
+func (o ConvertOptions) validate() error {
+	if o.Hyphenate != "" && o.Hyphenate != "on" && o.Hyphenate != "off" {
+		return fmt.Errorf("%w %q for hyphenate", errBadValue, o.Hyphenate)
+	}
+	// It ends up in the CSS of the book.
+	if o.FontSize != "" && !fontSizeRe.MatchString(o.FontSize) {
+		return fmt.Errorf("%w %q for font_size", errBadValue, o.FontSize)
+	}
+	return nil
+}
+
+// converter returns a kepubify converter applying the options.
+func (o ConvertOptions) converter() *kepub.Converter {
+	var opts []kepub.ConverterOption
+
+	if o.Smartypants {
+		opts = append(opts, kepub.ConverterOptionSmartypants())
+	}
+	if o.Hyphenate != "" {
+		opts = append(opts, kepub.ConverterOptionHyphenate(o.Hyphenate == "on"))
+	}
+	if o.FullScreenFixes {
+		opts = append(opts, kepub.ConverterOptionFullScreenFixes())
+	}
+	if o.FontSize != "" {
+		opts = append(opts, kepub.ConverterOptionAddCSS(
+			fmt.Sprintf("body { font-size: %s !important; }", o.FontSize),
+		))
+	}
+	return kepub.NewConverterWithOptions(opts...)
+}
+
+// set changes the setting called name as in the /settings command.
+func (o *ConvertOptions) set(name, value string) error {
+	value = strings.ToLower(value)
+	onOff := func(b *bool) error {
+		switch value {
+		case "on":
+			*b = true
+		case "off":
+			*b = false
+		default:
+			return fmt.Errorf("%w %q, use on or off", errBadValue, value)
+		}
+		return nil
+	}
+
+	switch strings.ToLower(name) {
+	case "smartypants":
+		return onOff(&o.Smartypants)
+	case "fullscreen":
+		return onOff(&o.FullScreenFixes)
+	case "original":
+		return onOff(&o.KeepOriginal)
+
+	case "hyphenate":
+		switch value {
+		case "on", "off":
+			o.Hyphenate = value
+		case "auto":
+			o.Hyphenate = ""
+		default:
+			return fmt.Errorf("%w %q, use on, off or auto", errBadValue, value)
+		}
+
+	case "fontsize":
+		if value == "off" {
+			o.FontSize = ""
+			return nil
+		}
+		if !fontSizeRe.MatchString(value) {
+			return fmt.Errorf("%w %q, use a size like 1.2em or off", errBadValue, value)
+		}
+		o.FontSize = value
+
+	default:
+		return fmt.Errorf("%w %q", errBadOption, name)
+	}
+	return nil
+}
+
+func (o ConvertOptions) String() string {
+	onOff := func(b bool) string {
+		if b {
+			return "on"
+		}
+		return "off"
+	}
+	hyphenate, fontSize := o.Hyphenate, o.FontSize
+	if hyphenate == "" {
+		hyphenate = "auto"
+	}
+	if fontSize == "" {
+		fontSize = "off"
+	}
+
+	return fmt.Sprintf(
+		"smartypants %s\nhyphenate %s\nfullscreen %s\nfontsize %s\noriginal %s",
+		onOff(o.Smartypants), hyphenate, onOff(o.FullScreenFixes), fontSize, onOff(o.KeepOriginal),
+	)
+}
+
+// settings shows or changes the conversion settings of the chat.
+func (b *bot) settings(args []string) {
+	opts := cfg.ConvertOptions(b.chatID)
+
+	if len(args) < 2 {
+		b.send(fmt.Sprintf(
+			"Yer conversion settings:\n%s\n\nChange them with /settings <name> <value>.",
+			opts,
+		))
+		return
+	}
+
+	if err := opts.set(args[0], args[1]); err != nil {
+		b.send(err.Error())
+		return
+	}
+	if err := cfg.SetConvertOptions(b.chatID, opts); err != nil {
+		log.Println("b.settings", "cfg.SetConvertOptions", err)
+		b.send("An error occurred while saving the settings.")
+		return
+	}
+	b.send("ok")
+}
+
+// convert converts again the book with the hash in args with the settings
+// of the chat.
+func (b *bot) convert(args []string) {
+	if len(args) == 0 {
+		b.send("Usage: /convert <hash>")
+		return
+	}
+
+	path, err := convertBook(args[0], cfg.ConvertOptions(b.chatID))
+	switch {
+	case errors.Is(err, errNotEPUB):
+		b.send(err.Error())
+	case errors.Is(err, os.ErrNotExist):
+		b.send("unknown hash")
+	case err != nil:
+		log.Println("b.convert", err)
+		b.send("An error occurred while converting the book.")
+	default:
+		b.send("Converted to " + filepath.Base(path))
+	}
+}
+
+// convertBook converts the EPUB in the library with the given hash to KEPUB
+// and returns the path of the KEPUB.
+// A KEPUB is converted again from its original EPUB when it's been kept,
+// while an EPUB is replaced by its KEPUB unless opts keeps it.
+func convertBook(hash string, opts ConvertOptions) (string, error) {
+	bk, ok := lib.Get(hash)
+	if !ok {
+		return "", fmt.Errorf("convertBook: %s: %w", hash, os.ErrNotExist)
+	}
+	if !isEPUB(bk.Path) {
+		return "", fmt.Errorf("convertBook: %w", errNotEPUB)
+	}
+
+	src, dest := bk.Path, bk.Path
+	if isKepub(bk.Path) {
+		if orig := originalOf(bk.Path); orig != "" {
+			src = orig
+		}
+	} else {
+		dest = filepath.Join(filepath.Dir(bk.Path), kepubName(bk.Path))
+	}
+
+	tmp, err := kepubify(src, opts)
+	if err != nil {
+		return "", fmt.Errorf("convertBook: %w", err)
+	}
+	sum, err := md5sum(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("convertBook: md5sum: %w", err)
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if old, ok := lib.HashOf(dest); ok {
+		if _, _, err := lib.Remove(old); err != nil {
+			log.Println("convertBook", "lib.Remove", err)
+		}
+	}
+	if err := move(tmp, dest, sum); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("convertBook: %w", err)
+	}
+
+	if src == bk.Path && dest != bk.Path && !opts.KeepOriginal {
+		if _, _, err := lib.Remove(hash); err != nil {
+			log.Println("convertBook", "lib.Remove", err)
+		}
+		if err := os.Remove(bk.Path); err != nil {
+			log.Println("convertBook", "os.Remove", err)
+		}
+	}
+	return dest, nil
+}
+
+// originalOf returns the path of the EPUB the KEPUB at path was converted
+// from, or an empty string if it hasn't been kept.
+func originalOf(path string) string {
+	base := filepath.Base(path)
+	orig := filepath.Join(filepath.Dir(path), strings.TrimSuffix(base, bookExt(base))+".epub")
+	if !exists(orig) {
+		return ""
+	}
+	return orig
+}
+
+// convertAll converts the EPUBs in the library to KEPUB, and the KEPUBs too
+// if again is true, printing the outcome of each of them.
+// The EPUBs are kept next to their KEPUBs, and the ones already kept are
+// converted only through their KEPUBs.
+// It returns the number of failures.
+func convertAll(opts ConvertOptions, again bool) int {
+	var (
+		hashes []string
+		books  = lib.Books()
+		failed int
+	)
+
+	for h, p := range books {
+		if !isEPUB(p) || isKepub(p) && !again {
+			continue
+		}
+		if _, ok := lib.HashOf(filepath.Join(filepath.Dir(p), kepubName(p))); ok && !isKepub(p) {
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	// A batch never deletes a book.
+	opts.KeepOriginal = true
+	sort.Slice(hashes, func(i, j int) bool {
+		return books[hashes[i]] < books[hashes[j]]
+	})
+
+	for _, h := range hashes {
+		// Replaced by the conversion of a book earlier in the loop.
+		if _, ok := lib.Get(h); !ok {
+			continue
+		}
+		dest, err := convertBook(h, opts)
+		if err != nil {
+			failed++
+			fmt.Printf("✗ %s: %v\n", books[h], err)
+			continue
+		}
+		fmt.Printf("✓ %s\n", dest)
+	}
+	return failed
+}
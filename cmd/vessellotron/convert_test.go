@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConvertOptionsSet(t *testing.T) {
+	tests := []struct {
+		name, value string
+		want        ConvertOptions
+		wantErr     error
+	}{
+		{"smartypants", "off", ConvertOptions{}, nil},
+		{"hyphenate", "ON", ConvertOptions{Smartypants: true, Hyphenate: "on"}, nil},
+		{"hyphenate", "auto", defaultConvert, nil},
+		{"fullscreen", "on", ConvertOptions{Smartypants: true, FullScreenFixes: true}, nil},
+		{"fontsize", "1.2em", ConvertOptions{Smartypants: true, FontSize: "1.2em"}, nil},
+		{"fontsize", "1em}body{display:none", defaultConvert, errBadValue},
+		{"original", "yes", defaultConvert, errBadValue},
+		{"colour", "on", defaultConvert, errBadOption},
+	}
+
+	for _, tt := range tests {
+		o := defaultConvert
+		err := o.set(tt.name, tt.value)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("set(%q, %q) error = %v, want %v", tt.name, tt.value, err, tt.wantErr)
+		}
+		if o != tt.want {
+			t.Errorf("set(%q, %q) = %+v, want %+v", tt.name, tt.value, o, tt.want)
+		}
+	}
+}
+
+// bookCSS returns the content of the CSS files and the style elements of
+// the EPUB at path.
+func bookCSS(t *testing.T, path string) string {
+	t.Helper()
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	var buf strings.Builder
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(&buf, r)
+		r.Close()
+	}
+	return buf.String()
+}
+
+func TestConvertBook(t *testing.T) {
+	withHome(t)
+	l := newLibrary(t, map[string][2]string{
+		"dune.epub":    {"Dune", "Frank Herbert"},
+		"messiah.epub": {"Dune Messiah", "Frank Herbert"},
+		"children.pdf": {},
+	})
+	hashes := make(map[string]string)
+	for h, p := range l.Books() {
+		hashes[filepath.Base(p)] = h
+	}
+
+	if _, err := convertBook(hashes["children.pdf"], defaultConvert); !errors.Is(err, errNotEPUB) {
+		t.Errorf("convertBook() of a PDF error = %v, want errNotEPUB", err)
+	}
+	if _, err := convertBook("nope", defaultConvert); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("convertBook() of an unknown hash error = %v, want os.ErrNotExist", err)
+	}
+
+	dune, err := convertBook(hashes["dune.epub"], defaultConvert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(dune) != "dune.kepub.epub" {
+		t.Errorf("convertBook() = %s, want dune.kepub.epub", dune)
+	}
+	if _, ok := l.Get(hashes["dune.epub"]); ok || exists(filepath.Join(filepath.Dir(dune), "dune.epub")) {
+		t.Error("the EPUB hasn't been replaced by the KEPUB")
+	}
+
+	keep := ConvertOptions{KeepOriginal: true}
+	messiah, err := convertBook(hashes["messiah.epub"], keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.Get(hashes["messiah.epub"]); !ok {
+		t.Error("the original EPUB has been removed")
+	}
+
+	// Converting the KEPUB again starts from the original.
+	keep.FontSize = "1.2em"
+	h, ok := l.HashOf(messiah)
+	if !ok {
+		t.Fatalf("%s isn't in the library", messiah)
+	}
+	if _, err := convertBook(h, keep); err != nil {
+		t.Fatal(err)
+	}
+	if css := bookCSS(t, messiah); !strings.Contains(css, "font-size: 1.2em !important") {
+		t.Error("the font size hasn't been applied")
+	}
+	if css := bookCSS(t, filepath.Join(filepath.Dir(messiah), "messiah.epub")); strings.Contains(css, "font-size") {
+		t.Error("the original EPUB has been modified")
+	}
+
+	var paths []string
+	for _, p := range l.Books() {
+		paths = append(paths, filepath.Base(p))
+	}
+	if len(paths) != 4 {
+		t.Errorf("the library holds %q, want the PDF, the original and the two KEPUBs", paths)
+	}
+}
+
+func TestConvertAll(t *testing.T) {
+	withHome(t)
+	l := newLibrary(t, map[string][2]string{
+		"dune.epub":    {"Dune", "Frank Herbert"},
+		"messiah.epub": {"Dune Messiah", "Frank Herbert"},
+	})
+	hashes := make(map[string]string)
+	for h, p := range l.Books() {
+		hashes[filepath.Base(p)] = h
+	}
+
+	// The original of Dune Messiah has been kept on purpose.
+	messiah, err := convertBook(hashes["messiah.epub"], ConvertOptions{KeepOriginal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kepub, _ := l.HashOf(messiah)
+
+	if failed := convertAll(defaultConvert, false); failed != 0 {
+		t.Errorf("convertAll() = %d failures", failed)
+	}
+	for _, name := range []string{"dune.epub", "messiah.epub"} {
+		if _, ok := l.Get(hashes[name]); !ok || !exists(filepath.Join(filepath.Dir(messiah), name)) {
+			t.Errorf("%s has been removed", name)
+		}
+	}
+	if _, ok := l.HashOf(filepath.Join(filepath.Dir(messiah), "dune.kepub.epub")); !ok {
+		t.Error("dune.epub hasn't been converted")
+	}
+	if h, ok := l.HashOf(messiah); !ok || h != kepub {
+		t.Errorf("%s has been converted again", messiah)
+	}
+	if n := len(l.Books()); n != 4 {
+		t.Errorf("the library holds %d books, want both EPUBs and KEPUBs", n)
+	}
+}
+
+func TestPrepareKeepOriginal(t *testing.T) {
+	dir := withHome(t)
+	newLibrary(t, nil)
+
+	src := filepath.Join(t.TempDir(), "src.epub")
+	writeEPUB(t, src, "Dune", "Frank Herbert")
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up, err := prepare("Dune.epub", newUpload(t, string(data)), ConvertOptions{KeepOriginal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.OrigName != "Dune.epub" || up.Orig == "" {
+		t.Fatalf("the original hasn't been kept: %+v", up)
+	}
+	if err := commit(up, filepath.Join(dir, up.Name)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"Dune.kepub.epub", "Dune.epub"} {
+		if _, ok := lib.HashOf(filepath.Join(dir, name)); !ok {
+			t.Errorf("%s isn't in the library", name)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/NicoNex/echotron/v3"
+)
+
+const (
+	// How long a download from a link can take.
+	downloadTimeout = 10 * time.Minute
+	// How often the status message is updated while downloading.
+	progressInterval = 2 * time.Second
+)
+
+var (
+	urlRe = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+	errTooBig  = errors.New("the file is too big")
+	errWebPage = errors.New("the link leads to a web page, not to a book")
+	errBadExt  = errors.New("unsupported extension")
+	// The link leads to the bot's own host or network.
+	errPrivateAddr = errors.New("the link leads to a private address")
+
+	// Extensions of the book types by MIME type, for the links not naming
+	// the file.
+	mimeExts = map[string]string{
+		"application/epub+zip":           ".epub",
+		"application/x-mobipocket-ebook": ".mobi",
+		"application/pdf":                ".pdf",
+		"application/vnd.comicbook+zip":  ".cbz",
+		"application/x-cbz":              ".cbz",
+		"application/vnd.comicbook-rar":  ".cbr",
+		"application/x-cbr":              ".cbr",
+		"application/rtf":                ".rtf",
+		"text/plain":                     ".txt",
+		"text/html":                      ".html",
+		"text/markdown":                  ".md",
+		"image/jpeg":                     ".jpg",
+		"image/png":                      ".png",
+		"image/gif":                      ".gif",
+		"image/bmp":                      ".bmp",
+		"image/tiff":                     ".tiff",
+		"application/zip":                ".zip",
+		"application/gzip":               ".tar.gz",
+		"application/x-gzip":             ".tar.gz",
+	}
+
+	// Carrier-grade NAT addresses, shared like the private ones.
+	sharedAddrs = netip.MustParsePrefix("100.64.0.0/10")
+	// "This network", Linux connects to the local host through any of them.
+	thisNetAddrs = netip.MustParsePrefix("0.0.0.0/8")
+	// NAT64 addresses, embedding an IPv4 address in the last 32 bits.
+	nat64Addrs = netip.MustParsePrefix("64:ff9b::/96")
+
+	// blockedAddr tells the addresses the links can't lead to, a variable
+	// to let the tests reach their local servers.
+	blockedAddr = isPrivateAddr
+
+	// The client checks the address it connects to after resolving the
+	// host, so that neither the link nor its redirects can reach the
+	// services next to the bot, and it goes straight to the host since a
+	// proxy would connect on its behalf.
+	httpClient = &http.Client{
+		Timeout: downloadTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+				Control:   dialControl,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+)
+
+// isPrivateAddr reports whether ip is a loopback, private, link-local,
+// multicast or unspecified address, also when translated by NAT64.
+func isPrivateAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if nat64Addrs.Contains(ip) {
+		b := ip.As16()
+		return isPrivateAddr(netip.AddrFrom4([4]byte(b[12:])))
+	}
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() ||
+		sharedAddrs.Contains(ip) ||
+		thisNetAddrs.Contains(ip)
+}
+
+// dialControl refuses to connect to the blocked addresses, it runs for
+// every connection with the address already resolved.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("dialControl: %w", err)
+	}
+	if blockedAddr(ap.Addr()) {
+		return fmt.Errorf("dialControl: %w %s", errPrivateAddr, ap.Addr())
+	}
+	return nil
+}
+
+// findURLs returns the HTTP(S) links in the message, in its text or behind
+// its text links.
+func findURLs(msg *echotron.Message) []string {
+	var (
+		urls []string
+		seen = make(map[string]bool)
+	)
+
+	add := func(u string) {
+		u = strings.TrimRight(u, ".,;:!?)]}'")
+		if !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+
+	for _, u := range urlRe.FindAllString(msg.Text, -1) {
+		add(u)
+	}
+	for _, e := range msg.Entities {
+		if e.Type == echotron.TextLinkEntity && urlRe.MatchString(e.URL) {
+			add(e.URL)
+		}
+	}
+	return urls
+}
+
+// fileName picks the name of the file downloaded from u, from the
+// Content-Disposition header, the URL path or the content type.
+func fileName(u *url.URL, h http.Header) (string, error) {
+	var name string
+
+	if _, params, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		name = path.Base(strings.ReplaceAll(params["filename"], "\\", "/"))
+	}
+	if name == "" || name == "." || name == "/" {
+		name = path.Base(u.Path)
+	}
+	if name == "" || name == "." || name == "/" {
+		name = u.Hostname()
+	}
+
+	ctype, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	ext := strings.ToLower(path.Ext(name))
+	if !isAllowedExt(ext) && !isArchive(name) {
+		e, ok := mimeExts[ctype]
+		if !ok {
+			return "", fmt.Errorf("fileName: %w %q", errBadExt, ext)
+		}
+		name += e
+		ext = e
+	}
+
+	// A login or error page served in place of the book.
+	if ctype == "text/html" && ext != ".html" && ext != ".htm" {
+		return "", fmt.Errorf("fileName: %w", errWebPage)
+	}
+	return name, nil
+}
+
+// progressReader calls report with the bytes read so far at most once
+// every progressInterval.
+type progressReader struct {
+	r      io.Reader
+	n      int64
+	last   time.Time
+	report func(n int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		p.report(p.n)
+	}
+	return n, err
+}
+
+// fetch downloads the book at rawurl, refusing the ones bigger than limit
+// bytes, and returns its name and the temporary file it's been saved to.
+func fetch(rawurl string, limit int64, progress func(done, total int64)) (string, string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", "", fmt.Errorf("fetch: url.Parse: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", "", fmt.Errorf("fetch: unsupported scheme %q", u.Scheme)
+	}
+
+	res, err := httpClient.Get(u.String())
+	if err != nil {
+		return "", "", fmt.Errorf("fetch: httpClient.Get: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("fetch: %s", res.Status)
+	}
+	if res.ContentLength > limit {
+		return "", "", fmt.Errorf("fetch: %w (%s)", errTooBig, byteSize(res.ContentLength))
+	}
+
+	// Name the file after the URL it was redirected to.
+	name, err := fileName(res.Request.URL, res.Header)
+	if err != nil {
+		return "", "", fmt.Errorf("fetch: %w", err)
+	}
+
+	pr := &progressReader{
+		r:      res.Body,
+		last:   time.Now(),
+		report: func(n int64) { progress(n, res.ContentLength) },
+	}
+	tmp, err := spool(pr, limit)
+	if err != nil {
+		return "", "", fmt.Errorf("fetch: %w", err)
+	}
+	return name, tmp, nil
+}
+
+// saveURL downloads the book at u into the library, reporting the progress
+// by editing a status message.
+func (b *bot) saveURL(u string) {
+	res, err := b.SendMessage("Hoisting the barrel from "+u, b.chatID, &echotron.MessageOptions{
+		LinkPreviewOptions: echotron.LinkPreviewOptions{IsDisabled: true},
+	})
+	if err != nil {
+		log.Println("b.saveURL", "b.SendMessage", err)
+		return
+	}
+	msgID := echotron.NewMessageID(b.chatID, res.Result.ID)
+
+	status := func(text string) {
+		if _, err := b.EditMessageText(text, msgID, nil); err != nil {
+			log.Println("b.saveURL", "b.EditMessageText", err)
+		}
+	}
+
+	name, tmp, err := fetch(u, cfg.MaxDownload, func(done, total int64) {
+		if total > 0 {
+			status(fmt.Sprintf("Hoisting the barrel: %s of %s (%d%%)", byteSize(done), byteSize(total), done*100/total))
+		} else {
+			status(fmt.Sprintf("Hoisting the barrel: %s", byteSize(done)))
+		}
+	})
+	switch {
+	case errors.Is(err, errTooBig):
+		status(fmt.Sprintf("Arr, the barrel be too heavy, the limit is %s.", byteSize(cfg.MaxDownload)))
+		return
+	case errors.Is(err, errWebPage):
+		status("Arr, the link leads to a web page, not to a book.")
+		return
+	case errors.Is(err, errBadExt):
+		status("Unsupported extension")
+		return
+	case errors.Is(err, errPrivateAddr):
+		status("Arr, that link leads to private waters.")
+		return
+	case err != nil:
+		log.Println("b.saveURL", err)
+		status("An error occurred while downloading " + u)
+		return
+	}
+
+	status(fmt.Sprintf("Stowing %s…", name))
+	switch b.storeEbook(name, tmp) {
+	case storeSaved:
+		status("Thanks matey! " + name + " be aboard.")
+	case storeSkipped:
+		status(name + " already be aboard.")
+	case storeAsked:
+		status(name + " be waiting for yer orders.")
+	case storeUnpacked:
+		status("Unpacked " + name + ".")
+	default:
+		status("Couldn't stow " + name + ".")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/NicoNex/echotron/v3"
+)
+
+func TestFindURLs(t *testing.T) {
+	msg := &echotron.Message{
+		Text: "Here (https://example.com/dune.epub), and http://example.com/a.pdf. Again https://example.com/dune.epub",
+		Entities: []*echotron.MessageEntity{
+			{Type: echotron.TextLinkEntity, URL: "https://example.com/hidden.mobi"},
+			{Type: echotron.TextLinkEntity, URL: "tg://user?id=1"},
+		},
+	}
+
+	got := strings.Join(findURLs(msg), " ")
+	want := "https://example.com/dune.epub http://example.com/a.pdf https://example.com/hidden.mobi"
+	if got != want {
+		t.Errorf("findURLs() = %q, want %q", got, want)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	const book = "not really an epub"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/books/dune.epub", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/epub+zip")
+		w.Write([]byte(book))
+	})
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="../Neuromancer.pdf"`)
+		w.Write([]byte(book))
+	})
+	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/epub+zip")
+		w.Write([]byte(book))
+	})
+	mux.HandleFunc("/login/book.epub", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html>log in first</html>"))
+	})
+	mux.HandleFunc("/big.epub", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 100)))
+	})
+	mux.HandleFunc("/chunked.epub", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			w.Write([]byte(strings.Repeat("x", 10)))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/program.exe", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte(book))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	withHome(t)
+	allowLoopback(t)
+
+	tests := []struct {
+		path    string
+		name    string
+		wantErr error
+	}{
+		{"/books/dune.epub", "dune.epub", nil},
+		{"/download", "Neuromancer.pdf", nil},
+		{"/get", "get.epub", nil},
+		{"/login/book.epub", "", errWebPage},
+		{"/big.epub", "", errTooBig},
+		{"/chunked.epub", "", errTooBig},
+		{"/program.exe", "", errBadExt},
+		{"/missing.epub", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			name, tmp, err := fetch(srv.URL+tt.path, 50, func(_, _ int64) {})
+			switch {
+			case tt.name == "" && tt.wantErr == nil:
+				if err == nil {
+					t.Error("expected an error")
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("fetch() error = %v, want %v", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatal(err)
+			default:
+				data, err := os.ReadFile(tmp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if name != tt.name || string(data) != book {
+					t.Errorf("fetch() = %q, %q, want %q, %q", name, data, tt.name, book)
+				}
+			}
+		})
+	}
+}
+
+// allowLoopback lets fetch reach the test servers, while still blocking
+// the other private addresses.
+func allowLoopback(t *testing.T) {
+	t.Helper()
+
+	saved := blockedAddr
+	blockedAddr = func(ip netip.Addr) bool { return !ip.IsLoopback() && isPrivateAddr(ip) }
+	t.Cleanup(func() { blockedAddr = saved })
+}
+
+func TestFetchPrivate(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/book.epub", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not really an epub"))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://10.0.0.1/book.epub", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	withHome(t)
+
+	for _, u := range []string{
+		srv.URL + "/book.epub",
+		fmt.Sprintf("http://localhost:%d/book.epub", srv.Listener.Addr().(*net.TCPAddr).Port),
+		"http://[::1]/book.epub",
+		"http://169.254.169.254/latest/meta-data",
+	} {
+		if _, _, err := fetch(u, 50, func(_, _ int64) {}); !errors.Is(err, errPrivateAddr) {
+			t.Errorf("fetch(%q) error = %v, want errPrivateAddr", u, err)
+		}
+	}
+
+	// The redirects are checked too.
+	allowLoopback(t)
+	if _, _, err := fetch(srv.URL+"/book.epub", 50, func(_, _ int64) {}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fetch(srv.URL+"/redirect", 50, func(_, _ int64) {}); !errors.Is(err, errPrivateAddr) {
+		t.Errorf("fetch() error = %v after a redirect, want errPrivateAddr", err)
+	}
+}
+
+func TestIsPrivateAddr(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":        true,
+		"10.1.2.3":         true,
+		"172.16.0.1":       true,
+		"192.168.1.1":      true,
+		"169.254.169.254":  true,
+		"100.64.0.1":       true,
+		"0.0.0.0":          true,
+		"0.1.2.3":          true,
+		"::1":              true,
+		"fe80::1":          true,
+		"fd00::1":          true,
+		"::ffff:10.0.0.1":  true,
+		"64:ff9b::a00:1":   true,
+		"64:ff9b::7f00:1":  true,
+		"64:ff9b::808:808": false,
+		"8.8.8.8":          false,
+		"2606:4700::1111":  false,
+	}
+	for addr, want := range tests {
+		if got := isPrivateAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isPrivateAddr(%s) = %t, want %t", addr, got, want)
+		}
+	}
+}
+
+func TestDialControl(t *testing.T) {
+	tests := map[string]bool{
+		"0.0.0.0:80":              true,
+		"0.0.0.1:8080":            true,
+		"127.0.0.1:443":           true,
+		"[64:ff9b::7f00:1]:80":    true,
+		"[64:ff9b::c0a8:101]:443": true,
+		"[64:ff9b::808:808]:443":  false,
+		"8.8.8.8:443":             false,
+	}
+	for addr, blocked := range tests {
+		err := dialControl("tcp", addr, nil)
+		if got := errors.Is(err, errPrivateAddr); got != blocked {
+			t.Errorf("dialControl(%s) error = %v, want blocked %t", addr, err, blocked)
+		}
+	}
+}
+
+// withHome makes the bot save the books in a temporary directory.
+func withHome(t *testing.T) string {
+	t.Helper()
+
+	saved := home
+	home = t.TempDir()
+	t.Cleanup(func() { home = saved })
+	return home
+}
+
+func TestSpool(t *testing.T) {
+	dir := withHome(t)
+
+	tmp, err := spool(strings.NewReader("0123456789"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(tmp); err != nil || string(b) != "0123456789" {
+		t.Errorf("spooled %q, %v", b, err)
+	}
+	os.Remove(tmp)
+
+	if _, err := spool(strings.NewReader("0123456789"), 9); !errors.Is(err, errTooBig) {
+		t.Errorf("spool() error = %v, want errTooBig", err)
+	}
+	// Nothing is left behind.
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files left in the library", len(entries))
+	}
+}
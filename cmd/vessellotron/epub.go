@@ -0,0 +1,74 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// epubMeta is the part of the OPF package metadata vessellotron cares about.
+type epubMeta struct {
+	Title   string   `xml:"metadata>title"`
+	Authors []string `xml:"metadata>creator"`
+}
+
+type container struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// readEPUBMeta reads the title and the authors of the EPUB at fpath.
+func readEPUBMeta(fpath string) (epubMeta, error) {
+	var meta epubMeta
+
+	zr, err := zip.OpenReader(fpath)
+	if err != nil {
+		return meta, fmt.Errorf("readEPUBMeta: zip.OpenReader: %w", err)
+	}
+	defer zr.Close()
+
+	opf, err := opfPath(&zr.Reader)
+	if err != nil {
+		return meta, fmt.Errorf("readEPUBMeta: %w", err)
+	}
+	if err := decodeXML(&zr.Reader, opf, &meta); err != nil {
+		return meta, fmt.Errorf("readEPUBMeta: %w", err)
+	}
+
+	meta.Title = strings.TrimSpace(meta.Title)
+	for i, a := range meta.Authors {
+		meta.Authors[i] = strings.TrimSpace(a)
+	}
+	return meta, nil
+}
+
+// opfPath returns the path of the OPF package document from the container.
+func opfPath(zr *zip.Reader) (string, error) {
+	var c container
+
+	if err := decodeXML(zr, "META-INF/container.xml", &c); err != nil {
+		return "", fmt.Errorf("opfPath: %w", err)
+	}
+	for _, rf := range c.Rootfiles {
+		if rf.FullPath != "" {
+			return path.Clean(rf.FullPath), nil
+		}
+	}
+	return "", fmt.Errorf("opfPath: no rootfile in container.xml")
+}
+
+func decodeXML(zr *zip.Reader, name string, v any) error {
+	f, err := zr.Open(name)
+	if err != nil {
+		return fmt.Errorf("decodeXML: zr.Open: %w", err)
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("decodeXML: %s: %w", name, err)
+	}
+	return nil
+}
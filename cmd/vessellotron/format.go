@@ -0,0 +1,660 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nwaples/rardecode/v2"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// Rendered size after which a chapter is split even without a heading.
+	chapterSize = 64 << 10
+	// Biggest dictionary a RAR archive can ask to be unpacked with, far
+	// more than the archivers use by default.
+	maxRARDict = 256 << 20
+)
+
+var (
+	// Paragraphs of plain text taken as chapter titles.
+	txtHeadingRe = regexp.MustCompile(`(?i)^(chapter|part|book|prologue|epilogue|preface|introduction)\b`)
+
+	errBadCBR = errors.New("the CBR is neither a RAR nor a ZIP archive")
+
+	imageExts = map[string]bool{
+		".jpeg": true,
+		".jpg":  true,
+		".gif":  true,
+		".png":  true,
+		".bmp":  true,
+		".tiff": true,
+	}
+
+	// Elements the pages wrap their whole text in.
+	wrappers = map[atom.Atom]bool{
+		atom.Div:     true,
+		atom.Main:    true,
+		atom.Article: true,
+		atom.Section: true,
+	}
+
+	// XML namespaces of the foreign elements by html.Node.Namespace.
+	foreignNS = map[string]string{
+		"svg":  "http://www.w3.org/2000/svg",
+		"math": "http://www.w3.org/1998/Math/MathML",
+	}
+)
+
+// chapter is a content document of the EPUBs built by vessellotron.
+type chapter struct {
+	Title string
+	Body  bytes.Buffer
+}
+
+// convertFormat converts the book named name, saved at tmp, to a format the
+// Kobo renders better: TXT, HTML and Markdown to EPUB and CBR to CBZ.
+// It returns the new name and temporary file, empty if there's nothing to do,
+// which is tmp itself when only the name changes.
+func convertFormat(name, tmp string) (string, string, error) {
+	var (
+		ext  = strings.ToLower(filepath.Ext(name))
+		stem = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+		out  string
+		err  error
+	)
+
+	switch ext {
+	case ".txt", ".md", ".markdown", ".html", ".htm":
+		out, err = textToEPUB(ext, stem, tmp)
+		name = stem + ".epub"
+	case ".cbr":
+		out, err = cbrToCBZ(tmp)
+		name = stem + ".cbz"
+	default:
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("convertFormat: %w", err)
+	}
+	return name, out, nil
+}
+
+// textToEPUB converts the plain text, Markdown or HTML file at path to an
+// EPUB in a temporary file and returns its path.
+func textToEPUB(ext, title, path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("textToEPUB: os.ReadFile: %w", err)
+	}
+	src := decodeText(b)
+
+	switch ext {
+	case ".txt":
+		src = txtToHTML(src)
+	case ".md", ".markdown":
+		src = markdownToHTML(src)
+	}
+
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return "", fmt.Errorf("textToEPUB: html.Parse: %w", err)
+	}
+	meta := htmlMeta(doc)
+	if meta.Title == "" {
+		meta.Title = title
+	}
+
+	f, err := os.CreateTemp(home, ".vessellotron-*")
+	if err != nil {
+		return "", fmt.Errorf("textToEPUB: os.CreateTemp: %w", err)
+	}
+	defer f.Close()
+
+	if err := writeEPUBBook(f, meta, htmlLang(doc), splitChapters(doc, meta.Title)); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("textToEPUB: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// decodeText returns b as a string, reading it as Latin-1 if it isn't
+// valid UTF-8 like the texts saved by older editors.
+func decodeText(b []byte) string {
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	if utf8.Valid(b) {
+		return string(b)
+	}
+
+	var buf strings.Builder
+	for _, c := range b {
+		buf.WriteRune(rune(c))
+	}
+	return buf.String()
+}
+
+// txtToHTML turns the paragraphs of a plain text, separated by blank lines
+// or by line breaks if there are none, into HTML.
+func txtToHTML(s string) string {
+	s = strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\r", "\n")
+
+	sep := "\n\n"
+	if !strings.Contains(s, sep) {
+		sep = "\n"
+	}
+
+	var buf strings.Builder
+	for _, p := range strings.Split(s, sep) {
+		p = strings.Join(strings.Fields(p), " ")
+		switch {
+		case p == "":
+			continue
+		case len(p) < 80 && txtHeadingRe.MatchString(p):
+			fmt.Fprintf(&buf, "<h2>%s</h2>\n", html.EscapeString(p))
+		default:
+			fmt.Fprintf(&buf, "<p>%s</p>\n", html.EscapeString(p))
+		}
+	}
+	return buf.String()
+}
+
+// htmlMeta reads the title and the author of an HTML document, the title
+// falls back to the first heading.
+func htmlMeta(doc *html.Node) epubMeta {
+	var (
+		meta    epubMeta
+		heading string
+	)
+
+	walk(doc, func(n *html.Node) {
+		switch n.DataAtom {
+		case atom.Title:
+			if meta.Title == "" {
+				meta.Title = textOf(n)
+			}
+		case atom.Meta:
+			if strings.EqualFold(attr(n, "name"), "author") && attr(n, "content") != "" {
+				meta.Authors = append(meta.Authors, attr(n, "content"))
+			}
+		case atom.H1:
+			if heading == "" {
+				heading = textOf(n)
+			}
+		}
+	})
+	if meta.Title == "" {
+		meta.Title = heading
+	}
+	return meta
+}
+
+// htmlLang returns the language of the document, English if it's not set.
+func htmlLang(doc *html.Node) string {
+	var lang string
+	walk(doc, func(n *html.Node) {
+		if n.DataAtom == atom.Html && lang == "" {
+			lang = attr(n, "lang")
+		}
+	})
+	if lang == "" {
+		return "en"
+	}
+	return lang
+}
+
+// splitChapters renders the body of doc as XHTML, starting a chapter at
+// every top level heading, within the elements wrapping the whole body, and
+// whenever one grows past chapterSize.
+func splitChapters(doc *html.Node, title string) []*chapter {
+	var (
+		body  *html.Node
+		split = atom.H1
+		chs   []*chapter
+	)
+
+	walk(doc, func(n *html.Node) {
+		switch n.DataAtom {
+		case atom.Body:
+			if body == nil {
+				body = n
+			}
+		// Drop what can't work offline or outside of a browser.
+		case atom.Script, atom.Iframe, atom.Object, atom.Embed:
+			n.Parent.RemoveChild(n)
+		case atom.Img:
+			if src := attr(n, "src"); !strings.HasPrefix(src, "data:") {
+				n.Parent.RemoveChild(n)
+			}
+		// XHTML needs the namespace of the embedded SVG and MathML.
+		case atom.Svg, atom.Math:
+			if n.Namespace != "" && attr(n, "xmlns") == "" {
+				n.Attr = append(n.Attr, html.Attribute{Key: "xmlns", Val: foreignNS[n.Namespace]})
+			}
+		}
+	})
+	if body == nil {
+		return nil
+	}
+	// The pages often wrap the whole text in a single element.
+	for c := onlyChild(body); c != nil && wrappers[c.DataAtom]; c = onlyChild(body) {
+		body = c
+	}
+	if !hasChild(body, atom.H1) {
+		split = atom.H2
+	}
+
+	cur := &chapter{}
+	for n := body.FirstChild; n != nil; n = n.NextSibling {
+		if cur.Body.Len() > 0 && (n.DataAtom == split || cur.Body.Len() > chapterSize) {
+			chs = append(chs, cur)
+			cur = &chapter{}
+		}
+		if cur.Title == "" && n.DataAtom == split {
+			cur.Title = textOf(n)
+		}
+		html.Render(&cur.Body, n)
+	}
+	chs = append(chs, cur)
+
+	for i, ch := range chs {
+		if ch.Title == "" {
+			ch.Title = fmt.Sprintf("%s (%d)", title, i+1)
+		}
+	}
+	return chs
+}
+
+// walk calls fn on every node below n, fn may detach the node it's given.
+func walk(n *html.Node, fn func(*html.Node)) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode {
+			walk(c, fn)
+			fn(c)
+		}
+		c = next
+	}
+}
+
+// onlyChild returns the element n holds, if it's the only thing in it
+// besides blanks and comments.
+func onlyChild(n *html.Node) *html.Node {
+	var only *html.Node
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type == html.CommentNode:
+		case c.Type == html.TextNode && strings.TrimSpace(c.Data) == "":
+		case c.Type == html.ElementNode && only == nil:
+			only = c
+		default:
+			return nil
+		}
+	}
+	return only
+}
+
+func hasChild(n *html.Node, a atom.Atom) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom == a {
+			return true
+		}
+	}
+	return false
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func textOf(n *html.Node) string {
+	var buf strings.Builder
+	var rec func(*html.Node)
+	rec = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			buf.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			rec(c)
+		}
+	}
+	rec(n)
+	return strings.Join(strings.Fields(buf.String()), " ")
+}
+
+// writeEPUBBook writes an EPUB 3 with an NCX for the older readers, made of
+// the given chapters, to w.
+func writeEPUBBook(w io.Writer, meta epubMeta, lang string, chs []*chapter) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("writeEPUBBook: rand.Read: %w", err)
+	}
+	uuid := hex.EncodeToString(id)
+	uuid = fmt.Sprintf("urn:uuid:%s-%s-%s-%s-%s", uuid[:8], uuid[8:12], uuid[12:16], uuid[16:20], uuid[20:])
+
+	var (
+		manifest, spine, nav, ncx, creators strings.Builder
+		title                               = escapeXML(meta.Title)
+	)
+	for _, a := range meta.Authors {
+		fmt.Fprintf(&creators, "    <dc:creator>%s</dc:creator>\n", escapeXML(a))
+	}
+
+	files := []struct{ name, body string }{
+		{"META-INF/container.xml", `<?xml version="1.0" encoding="utf-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`},
+	}
+	for i, ch := range chs {
+		name := fmt.Sprintf("ch%03d.xhtml", i+1)
+		fmt.Fprintf(&manifest, "    <item id=\"ch%d\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", i+1, name)
+		fmt.Fprintf(&spine, "    <itemref idref=\"ch%d\"/>\n", i+1)
+		fmt.Fprintf(&nav, "      <li><a href=\"%s\">%s</a></li>\n", name, escapeXML(ch.Title))
+		fmt.Fprintf(&ncx, "    <navPoint id=\"np%[1]d\" playOrder=\"%[1]d\"><navLabel><text>%[2]s</text></navLabel><content src=\"%[3]s\"/></navPoint>\n", i+1, escapeXML(ch.Title), name)
+
+		files = append(files, struct{ name, body string }{"OEBPS/" + name, fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="%[1]s" lang="%[1]s">
+<head><title>%[2]s</title></head>
+<body>
+%[3]s
+</body>
+</html>
+`, escapeXML(lang), escapeXML(ch.Title), ch.Body.String())})
+	}
+
+	files = append(files,
+		struct{ name, body string }{"OEBPS/content.opf", fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">%s</dc:identifier>
+    <dc:title>%s</dc:title>
+%s    <dc:language>%s</dc:language>
+    <meta property="dcterms:modified">%s</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+%s  </manifest>
+  <spine toc="ncx">
+%s  </spine>
+</package>
+`, uuid, title, creators.String(), escapeXML(lang), time.Now().UTC().Format("2006-01-02T15:04:05Z"), manifest.String(), spine.String())},
+		struct{ name, body string }{"OEBPS/nav.xhtml", fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>%s</title></head>
+<body>
+  <nav epub:type="toc">
+    <ol>
+%s    </ol>
+  </nav>
+</body>
+</html>
+`, title, nav.String())},
+		struct{ name, body string }{"OEBPS/toc.ncx", fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head><meta name="dtb:uid" content="%s"/></head>
+  <docTitle><text>%s</text></docTitle>
+  <navMap>
+%s  </navMap>
+</ncx>
+`, uuid, title, ncx.String())},
+	)
+
+	zw := zip.NewWriter(w)
+	// The mimetype comes first and uncompressed.
+	mt, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return fmt.Errorf("writeEPUBBook: zw.CreateHeader: %w", err)
+	}
+	if _, err := io.WriteString(mt, "application/epub+zip"); err != nil {
+		return fmt.Errorf("writeEPUBBook: io.WriteString: %w", err)
+	}
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return fmt.Errorf("writeEPUBBook: zw.Create: %w", err)
+		}
+		if _, err := io.WriteString(fw, f.body); err != nil {
+			return fmt.Errorf("writeEPUBBook: io.WriteString: %w", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("writeEPUBBook: zw.Close: %w", err)
+	}
+	return nil
+}
+
+func escapeXML(s string) string {
+	var buf strings.Builder
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// cbrToCBZ repacks the CBR at src into a temporary CBZ and returns its path,
+// which is src itself if the CBR is actually a ZIP, as many are.
+func cbrToCBZ(src string) (string, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return "", fmt.Errorf("cbrToCBZ: os.Open: %w", err)
+	}
+	defer f.Close()
+
+	magic := make([]byte, 6)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return "", fmt.Errorf("cbrToCBZ: %w", errBadCBR)
+	}
+	switch {
+	case string(magic[:4]) == "PK\x03\x04":
+		return src, nil
+	case string(magic) != "Rar!\x1a\x07":
+		return "", fmt.Errorf("cbrToCBZ: %w", errBadCBR)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("cbrToCBZ: f.Seek: %w", err)
+	}
+	out, err := rarToCBZ(f)
+	if err != nil {
+		return "", fmt.Errorf("cbrToCBZ: %w", err)
+	}
+	return out, nil
+}
+
+// rarToCBZ repacks the pages of the RAR archive read from r into a
+// temporary CBZ, keeping their names and order, and returns its path.
+// Hidden files are dropped, and the archives with more pages or bytes than
+// the other archives are allowed are refused.
+func rarToCBZ(r io.Reader) (string, error) {
+	rr, err := rardecode.NewReader(r, rardecode.MaxDictionarySize(maxRARDict))
+	if err != nil {
+		return "", fmt.Errorf("rarToCBZ: rardecode.NewReader: %w", err)
+	}
+
+	f, err := os.CreateTemp(home, ".vessellotron-*")
+	if err != nil {
+		return "", fmt.Errorf("rarToCBZ: os.CreateTemp: %w", err)
+	}
+	defer f.Close()
+
+	fail := func(err error) (string, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("rarToCBZ: %w", err)
+	}
+
+	var (
+		zw    = zip.NewWriter(f)
+		pages int
+		size  int64
+	)
+	for {
+		h, err := rr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fail(err)
+		}
+		if !h.Mode().IsRegular() {
+			continue
+		}
+		// Keep the pages within the archive.
+		name := strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(h.Name, "\\", "/")), "/")
+		if strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		if pages++; pages > maxArchiveEntries {
+			return fail(errArchiveLimit)
+		}
+
+		// The images are compressed already.
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Store,
+			Modified: h.ModificationTime,
+		})
+		if err != nil {
+			return fail(err)
+		}
+		n, err := io.Copy(w, io.LimitReader(rr, maxArchiveSize-size+1))
+		if err != nil {
+			return fail(err)
+		}
+		if size += n; size > maxArchiveSize {
+			return fail(errArchiveLimit)
+		}
+	}
+	if pages == 0 {
+		return fail(errBadCBR)
+	}
+	if err := zw.Close(); err != nil {
+		return fail(err)
+	}
+	return f.Name(), nil
+}
+
+// isImageSet reports whether the entries of an archive are all images.
+func isImageSet(entries []entry) bool {
+	var n int
+	for _, en := range entries {
+		if en.Err != nil {
+			continue
+		}
+		if !imageExts[strings.ToLower(filepath.Ext(en.Name))] {
+			return false
+		}
+		n++
+	}
+	return n > 1
+}
+
+// packCBZ packs the images extracted from an archive into a temporary CBZ,
+// numbering the pages in the natural order of their names, and returns its
+// path.
+func packCBZ(entries []entry) (string, error) {
+	var pages []entry
+	for _, en := range entries {
+		if en.Err == nil {
+			pages = append(pages, en)
+		}
+	}
+	sort.SliceStable(pages, func(i, j int) bool {
+		return naturalLess(pages[i].Name, pages[j].Name)
+	})
+
+	f, err := os.CreateTemp(home, ".vessellotron-*")
+	if err != nil {
+		return "", fmt.Errorf("packCBZ: os.CreateTemp: %w", err)
+	}
+	defer f.Close()
+
+	fail := func(err error) (string, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("packCBZ: %w", err)
+	}
+
+	zw := zip.NewWriter(f)
+	for i, p := range pages {
+		// The images are compressed already.
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   fmt.Sprintf("%04d%s", i+1, strings.ToLower(filepath.Ext(p.Name))),
+			Method: zip.Store,
+		})
+		if err != nil {
+			return fail(err)
+		}
+		img, err := os.Open(p.Tmp)
+		if err != nil {
+			return fail(err)
+		}
+		_, err = io.Copy(w, img)
+		img.Close()
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fail(err)
+	}
+	return f.Name(), nil
+}
+
+// naturalLess compares a and b treating the runs of digits as numbers, so
+// that "page2" comes before "page10".
+func naturalLess(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	for a != "" && b != "" {
+		da, db := digits(a), digits(b)
+		if da != "" && db != "" {
+			na, nb := strings.TrimLeft(da, "0"), strings.TrimLeft(db, "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// digits returns the leading digits of s.
+func digits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestTxtToHTML(t *testing.T) {
+	src := "CHAPTER I\r\n\r\nIt was a dark\r\nand stormy <night>.\r\n\r\n\r\nThe end & all.\r\n"
+	want := "<h2>CHAPTER I</h2>\n<p>It was a dark and stormy &lt;night&gt;.</p>\n<p>The end &amp; all.</p>\n"
+	if got := txtToHTML(src); got != want {
+		t.Errorf("txtToHTML() = %q, want %q", got, want)
+	}
+
+	// One paragraph per line.
+	if got := txtToHTML("one\ntwo\n"); got != "<p>one</p>\n<p>two</p>\n" {
+		t.Errorf("txtToHTML() = %q", got)
+	}
+}
+
+func TestMarkdownToHTML(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"# Title #", "<h1>Title</h1>\n"},
+		{"Some *emphasis*, **strong** and `a <b>*`.", "<p>Some <em>emphasis</em>, <strong>strong</strong> and <code>a &lt;b&gt;*</code>.</p>\n"},
+		{"a [link](http://example.com \"title\") and ![alt](pic.png)", "<p>a <a href=\"http://example.com\">link</a> and alt</p>\n"},
+		{"line one\nline two\n\nnext", "<p>line one line two</p>\n<p>next</p>\n"},
+		{"- a\n- b\n1. c", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n<ol>\n<li>c</li>\n</ol>\n"},
+		{"> quoted\n> text", "<blockquote>\n<p>quoted text</p>\n</blockquote>\n"},
+		{"```\n<raw> *code*\n```", "<pre><code>&lt;raw&gt; *code*</code></pre>\n"},
+		{"***", "<hr/>\n"},
+		{"<script>alert(1)</script> snake_case_name", "<p>&lt;script&gt;alert(1)&lt;/script&gt; snake_case_name</p>\n"},
+	}
+
+	for _, tt := range tests {
+		if got := markdownToHTML(tt.src); got != tt.want {
+			t.Errorf("markdownToHTML(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+// checkEPUB checks that the XML files of the EPUB at path are well formed
+// and returns the names of its chapters.
+func checkEPUB(t *testing.T, path string) []string {
+	t.Helper()
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	if zr.File[0].Name != "mimetype" || zr.File[0].Method != zip.Store {
+		t.Error("the mimetype isn't the first file, stored")
+	}
+
+	var chapters []string
+	for _, f := range zr.File {
+		if f.Name == "mimetype" {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := xml.NewDecoder(r)
+		d.Strict = true
+		for {
+			if _, err := d.Token(); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Errorf("%s: %v", f.Name, err)
+				break
+			}
+		}
+		r.Close()
+		if strings.HasPrefix(f.Name, "OEBPS/ch") {
+			chapters = append(chapters, f.Name)
+		}
+	}
+	sort.Strings(chapters)
+	return chapters
+}
+
+func TestTextToEPUB(t *testing.T) {
+	withHome(t)
+
+	src := filepath.Join(t.TempDir(), "notes.md")
+	md := "# Dune\n\nA *desert* planet.<br>\n\n# Messiah\n\nTwelve years later & more.\n\n![map](map.png)\n"
+	if err := os.WriteFile(src, []byte(md), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := textToEPUB(".md", "notes", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out)
+
+	if chs := checkEPUB(t, out); len(chs) != 2 {
+		t.Errorf("chapters = %q, want one per heading", chs)
+	}
+	meta, err := readEPUBMeta(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "Dune" {
+		t.Errorf("Title = %q, want the first heading", meta.Title)
+	}
+
+	html := filepath.Join(t.TempDir(), "page.html")
+	page := `<html lang="it"><head><title>Il Libro</title><meta name="author" content="Anon"><script>x()</script></head>
+<body><h2>Uno</h2><p>Caff&egrave;<br>&nbsp;<img src="a.png"></p><h2>Due</h2><p>Fine</body></html>`
+	if err := os.WriteFile(html, []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = textToEPUB(".html", "page", html); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out)
+
+	if chs := checkEPUB(t, out); len(chs) != 2 {
+		t.Errorf("chapters = %q, want one per h2", chs)
+	}
+	if meta, err = readEPUBMeta(out); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "Il Libro" || len(meta.Authors) != 1 || meta.Authors[0] != "Anon" {
+		t.Errorf("meta = %+v", meta)
+	}
+}
+
+func TestSplitChapters(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<body><h1>One</h1><p>A&nbsp;circle: <svg viewBox="0 0 2 2"><circle r="1"/></svg></p><h1>Two</h1><p>End</p></body>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chs := splitChapters(doc, "Book")
+	if len(chs) != 2 || chs[0].Title != "One" || chs[1].Title != "Two" {
+		t.Fatalf("chapters = %d, want One and Two", len(chs))
+	}
+	if body := chs[0].Body.String(); !strings.Contains(body, `<svg viewBox="0 0 2 2" xmlns="http://www.w3.org/2000/svg">`) {
+		t.Errorf("chapter One = %q, want the SVG namespace", body)
+	}
+
+	// The headings inside the elements wrapping the whole body.
+	for _, page := range []string{
+		`<body><div id="page"><main><h2>One</h2><p>A</p><h2>Two</h2><p>B</p><h2>Three</h2></main></div></body>`,
+		`<body> <!-- text --> <article><section><h1>One</h1><p>A</p><h1>Two</h1><h2>Two.1</h2><h1>Three</h1></section></article>` + "\n</body>",
+	} {
+		if doc, err = html.Parse(strings.NewReader(page)); err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, ch := range splitChapters(doc, "Book") {
+			titles = append(titles, ch.Title)
+		}
+		if got := strings.Join(titles, ","); got != "One,Two,Three" {
+			t.Errorf("chapters = %s, want One,Two,Three", got)
+		}
+	}
+
+	// A wrapper with something else next to it isn't unwrapped.
+	if doc, err = html.Parse(strings.NewReader(`<body><p>Intro</p><div><h1>One</h1><h1>Two</h1></div></body>`)); err != nil {
+		t.Fatal(err)
+	}
+	if chs := splitChapters(doc, "Book"); len(chs) != 1 || chs[0].Title != "Book (1)" {
+		t.Errorf("chapters = %d, want the whole body", len(chs))
+	}
+}
+
+func TestPrepareFormats(t *testing.T) {
+	dir := withHome(t)
+
+	up, err := prepare("story.txt", newUpload(t, "Chapter 1\n\nOnce upon a time."), defaultConvert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.ConvErr != nil || up.Name != "story.kepub.epub" || up.Meta.Title != "story" {
+		t.Errorf("prepare() = %+v", up)
+	}
+	up.remove()
+
+	var zipped strings.Builder
+	zw := zip.NewWriter(&zipped)
+	w, _ := zw.Create("0001.jpg")
+	w.Write([]byte("jpeg"))
+	zw.Close()
+
+	up, err = prepare("comic.cbr", newUpload(t, zipped.String()), ConvertOptions{KeepOriginal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.ConvErr != nil || up.Name != "comic.cbz" || up.Orig != "" {
+		t.Errorf("prepare() = %+v, want a renamed CBZ and no copy of the original", up)
+	}
+	up.remove()
+
+	rar := rar5([2]string{"Comic/0002.jpg", "page two"}, [2]string{"Comic/0001.jpg", "page one"}, [2]string{".DS_Store", "junk"})
+	if up, err = prepare("comic.cbr", newUpload(t, string(rar)), defaultConvert); err != nil {
+		t.Fatal(err)
+	}
+	if up.ConvErr != nil || up.Name != "comic.cbz" {
+		t.Errorf("prepare() = %+v, want a CBZ", up)
+	}
+	var pages []string
+	zr := must(zip.OpenReader(up.Tmp))
+	for _, f := range zr.File {
+		r := must(f.Open())
+		pages = append(pages, f.Name+": "+string(must(io.ReadAll(r))))
+		r.Close()
+	}
+	zr.Close()
+	if got := strings.Join(pages, ", "); got != "Comic/0002.jpg: page two, Comic/0001.jpg: page one" {
+		t.Errorf("CBZ pages = %s", got)
+	}
+	up.remove()
+
+	for _, bad := range []string{"Rar!\x1a\x07\x01\x00broken", "not an archive"} {
+		if up, err = prepare("comic.cbr", newUpload(t, bad), defaultConvert); err != nil {
+			t.Fatal(err)
+		}
+		if up.ConvErr == nil || up.Name != "comic.cbr" {
+			t.Errorf("prepare() = %+v, want the CBR as it is", up)
+		}
+		up.remove()
+	}
+
+	if tmps, _ := filepath.Glob(filepath.Join(dir, ".vessellotron-*")); len(tmps) != 0 {
+		t.Errorf("temporary files left: %q", tmps)
+	}
+}
+
+// rar5 returns a RAR 5 archive of the given files, as name and content,
+// stored without compression.
+func rar5(files ...[2]string) []byte {
+	vint := func(b []byte, v int) []byte {
+		for ; v >= 0x80; v >>= 7 {
+			b = append(b, byte(v)|0x80)
+		}
+		return append(b, byte(v))
+	}
+	// Each header starts with its CRC32 and size.
+	header := func(buf *bytes.Buffer, fields []byte) {
+		h := append(vint(nil, len(fields)), fields...)
+		buf.Write(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(h)))
+		buf.Write(h)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("Rar!\x1a\x07\x01\x00")
+	// The main header, without flags.
+	header(&buf, []byte{1, 0, 0})
+	for _, f := range files {
+		// File header with a data area, holding its size, and a CRC32.
+		h := []byte{2, 2}
+		h = vint(h, len(f[1]))
+		h = vint(h, 4)
+		h = vint(h, len(f[1]))
+		h = vint(h, 0)
+		h = binary.LittleEndian.AppendUint32(h, crc32.ChecksumIEEE([]byte(f[1])))
+		// Stored, from Unix.
+		h = vint(h, 0)
+		h = vint(h, 1)
+		h = vint(h, len(f[0]))
+		h = append(h, f[0]...)
+		header(&buf, h)
+		buf.WriteString(f[1])
+	}
+	// The end of the archive.
+	header(&buf, []byte{5, 0, 0})
+	return buf.Bytes()
+}
+
+func TestPackCBZ(t *testing.T) {
+	withHome(t)
+
+	var entries []entry
+	for _, name := range []string{"page10.png", "page2.JPG", "page1.png", "notes.exe"} {
+		en := entry{Name: name}
+		if strings.HasSuffix(name, ".exe") {
+			en.Err = errBadExt
+		} else {
+			en.Tmp = newUpload(t, name)
+		}
+		entries = append(entries, en)
+	}
+	if !isImageSet(entries) {
+		t.Fatal("isImageSet() = false")
+	}
+	if isImageSet(append(entries, entry{Name: "book.epub", Tmp: "x"})) {
+		t.Error("isImageSet() = true with a book among the images")
+	}
+
+	out, err := packCBZ(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out)
+
+	zr, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	want := [][2]string{{"0001.png", "page1.png"}, {"0002.jpg", "page2.JPG"}, {"0003.png", "page10.png"}}
+	if len(zr.File) != len(want) {
+		t.Fatalf("the CBZ has %d pages, want %d", len(zr.File), len(want))
+	}
+	for i, f := range zr.File {
+		r, _ := f.Open()
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if f.Name != want[i][0] || string(b) != want[i][1] {
+			t.Errorf("page %d = %s (%s), want %s (%s)", i, f.Name, b, want[i][0], want[i][1])
+		}
+	}
+}
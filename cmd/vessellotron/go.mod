@@ -4,7 +4,10 @@ go 1.21.5
 
 require (
 	github.com/NicoNex/echotron/v3 v3.38.0
+	github.com/nwaples/rardecode/v2 v2.2.0
 	github.com/pgaskin/kepubify/v4 v4.0.4
+	golang.org/x/net v0.24.0
+	golang.org/x/text v0.14.0
 )
 
 require (
@@ -13,6 +16,5 @@ require (
 	github.com/pgaskin/kepubify/_/go116-zip.go117 v0.0.0-20210611152744-2d89b3182523 // indirect
 	github.com/pgaskin/kepubify/_/html v0.0.0-20211223234002-6ee2cc632cdc // indirect
 	golang.org/x/sync v0.1.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 )
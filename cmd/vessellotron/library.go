@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Library is the metadata of the books on the server, mapping their MD5 to
+// their path, shared by all the sessions.
+type Library struct {
+	path string
+	meta map[string]string
+	// Titles and authors of the books by hash, read lazily.
+	info map[string]epubMeta
+	mu   sync.Mutex
+}
+
+// Book is a book in the library.
+type Book struct {
+	Hash   string
+	Path   string
+	Title  string
+	Author string
+}
+
+// Name returns the title of the book, or its file name if it has none.
+func (b Book) Name() string {
+	if b.Title != "" {
+		return b.Title
+	}
+	return filepath.Base(b.Path)
+}
+
+func LoadLibrary(path string) (*Library, error) {
+	l := &Library{
+		path: path,
+		meta: make(map[string]string),
+		info: make(map[string]epubMeta),
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return l, nil
+		}
+		return nil, fmt.Errorf("LoadLibrary: os.ReadFile: %w", err)
+	}
+	if err := json.Unmarshal(b, &l.meta); err != nil {
+		return nil, fmt.Errorf("LoadLibrary: json.Unmarshal: %w", err)
+	}
+	return l, nil
+}
+
+// Add records the book at path with the given hash.
+func (l *Library) Add(hash, path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.meta[hash] = path
+	delete(l.info, hash)
+	return l.save()
+}
+
+// Remove forgets the book with the given hash and returns its path.
+func (l *Library) Remove(hash string) (string, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	path, ok := l.meta[hash]
+	if !ok {
+		return "", false, nil
+	}
+	delete(l.meta, hash)
+	delete(l.info, hash)
+	return path, true, l.save()
+}
+
+// Refresh drops the books no longer on disk and rehashes the changed ones.
+func (l *Library) Refresh() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for h, p := range l.meta {
+		sum, err := md5sum(p)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				delete(l.meta, h)
+				delete(l.info, h)
+				continue
+			}
+			log.Println("l.Refresh", "md5sum", err)
+			continue
+		}
+
+		if sum != h {
+			delete(l.meta, h)
+			delete(l.info, h)
+			l.meta[sum] = p
+		}
+	}
+	return l.save()
+}
+
+// Books returns a copy of the metadata.
+func (l *Library) Books() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	books := make(map[string]string, len(l.meta))
+	for h, p := range l.meta {
+		books[h] = p
+	}
+	return books
+}
+
+// Get returns the book with the given hash.
+func (l *Library) Get(hash string) (Book, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.meta[hash]; !ok {
+		return Book{}, false
+	}
+	return l.book(hash), true
+}
+
+// HashOf returns the hash of the book at path.
+func (l *Library) HashOf(path string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for h, p := range l.meta {
+		if p == path {
+			return h, true
+		}
+	}
+	return "", false
+}
+
+// FindTitle returns the books with the given title and, if both have them,
+// authors, ignoring the case.
+func (l *Library) FindTitle(title, author string) []Book {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var books []Book
+	for h := range l.meta {
+		b := l.book(h)
+		if !strings.EqualFold(b.Title, title) {
+			continue
+		}
+		if b.Author != "" && author != "" && !strings.EqualFold(b.Author, author) {
+			continue
+		}
+		books = append(books, b)
+	}
+	return books
+}
+
+// Search returns the books whose title, authors or file name contain all
+// the words in query, sorted by title. An empty query matches all the books.
+func (l *Library) Search(query string) []Book {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var (
+		books []Book
+		words = strings.Fields(strings.ToLower(query))
+	)
+	for h := range l.meta {
+		b := l.book(h)
+		text := strings.ToLower(b.Title + "\n" + b.Author + "\n" + filepath.Base(b.Path))
+		if matchAll(text, words) {
+			books = append(books, b)
+		}
+	}
+
+	sort.Slice(books, func(i, j int) bool {
+		ni, nj := strings.ToLower(books[i].Name()), strings.ToLower(books[j].Name())
+		if ni != nj {
+			return ni < nj
+		}
+		return books[i].Hash < books[j].Hash
+	})
+	return books
+}
+
+// book returns the book with the given hash, l.mu must be held.
+func (l *Library) book(hash string) Book {
+	p := l.meta[hash]
+	info, ok := l.info[hash]
+	if !ok {
+		if strings.EqualFold(filepath.Ext(p), ".epub") {
+			var err error
+			if info, err = readEPUBMeta(p); err != nil {
+				log.Println("l.book", "readEPUBMeta", err)
+			}
+		}
+		l.info[hash] = info
+	}
+
+	return Book{
+		Hash:   hash,
+		Path:   p,
+		Title:  info.Title,
+		Author: strings.Join(info.Authors, ", "),
+	}
+}
+
+func matchAll(text string, words []string) bool {
+	for _, w := range words {
+		if !strings.Contains(text, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// save writes the metadata to its file, l.mu must be held.
+func (l *Library) save() error {
+	j, err := json.MarshalIndent(l.meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("l.save: json.MarshalIndent: %w", err)
+	}
+	if err := os.WriteFile(l.path, j, 0644); err != nil {
+		return fmt.Errorf("l.save: os.WriteFile: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeEPUB writes a minimal EPUB with the given title and author at path.
+func writeEPUB(t *testing.T, path, title, author string) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	files := []struct{ name, body string }{
+		{"mimetype", "application/epub+zip"},
+		{"META-INF/container.xml", `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`},
+		{"OEBPS/content.opf", fmt.Sprintf(`<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">%[1]s</dc:identifier>
+    <dc:title>%[1]s</dc:title>
+    <dc:creator>%[2]s</dc:creator>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+  </spine>
+</package>`, title, author)},
+		{"OEBPS/ch1.xhtml", `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>1</title></head><body><p>Ahoy!</p></body></html>`},
+	}
+
+	zw := zip.NewWriter(f)
+	for _, file := range files {
+		w, err := zw.Create(file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(file.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newLibrary makes a library in a temporary directory with the given EPUBs,
+// as title and author by file name, and sets it as the global one.
+func newLibrary(t *testing.T, books map[string][2]string) *Library {
+	t.Helper()
+
+	dir := t.TempDir()
+	l, err := LoadLibrary(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, meta := range books {
+		path := filepath.Join(dir, name)
+		if strings.HasSuffix(name, ".epub") {
+			writeEPUB(t, path, meta[0], meta[1])
+		} else if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := md5sum(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Add(sum, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := lib
+	lib = l
+	t.Cleanup(func() { lib = saved })
+	return l
+}
+
+func TestLibrarySearch(t *testing.T) {
+	l := newLibrary(t, map[string][2]string{
+		"dune.kepub.epub":  {"Dune", "Frank Herbert"},
+		"messiah.epub":     {"Dune Messiah", "Frank Herbert"},
+		"neuromancer.epub": {"Neuromancer", "William Gibson"},
+		"notes.pdf":        {},
+	})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"Dune", "Dune Messiah", "Neuromancer", "notes.pdf"}},
+		{"dune", []string{"Dune", "Dune Messiah"}},
+		{"HERBERT messiah", []string{"Dune Messiah"}},
+		{"gibson", []string{"Neuromancer"}},
+		{"pdf", []string{"notes.pdf"}},
+		{"tolkien", nil},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, b := range l.Search(tt.query) {
+			got = append(got, b.Name())
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("Search(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	// The metadata is kept in the format read by tortuga.
+	b := l.Search("neuromancer")[0]
+	data, err := os.ReadFile(b.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := md5.Sum(data); hex.EncodeToString(sum[:]) != b.Hash {
+		t.Errorf("hash of %s = %x, want %s", b.Path, sum, b.Hash)
+	}
+	if b.Author != "William Gibson" {
+		t.Errorf("author = %q, want %q", b.Author, "William Gibson")
+	}
+}
+
+func TestPage(t *testing.T) {
+	books := make(map[string][2]string)
+	for i := 0; i < pageSize*2+1; i++ {
+		books[fmt.Sprintf("%02d.txt", i)] = [2]string{}
+	}
+	newLibrary(t, books)
+
+	tests := []struct {
+		n, books int
+		nav      string
+	}{
+		{0, pageSize, "1/3|Next »"},
+		{1, pageSize, "« Prev|2/3|Next »"},
+		{2, 1, "« Prev|3/3"},
+		// Out of range pages are clamped.
+		{7, 1, "« Prev|3/3"},
+	}
+
+	for _, tt := range tests {
+		_, kbd := page("", tt.n)
+		rows := kbd.InlineKeyboard
+		if len(rows) != tt.books+1 {
+			t.Fatalf("page %d has %d rows, want %d", tt.n, len(rows), tt.books+1)
+		}
+		var nav []string
+		for _, btn := range rows[len(rows)-1] {
+			nav = append(nav, btn.Text)
+		}
+		if got := strings.Join(nav, "|"); got != tt.nav {
+			t.Errorf("page %d navigation = %q, want %q", tt.n, got, tt.nav)
+		}
+		for _, row := range rows {
+			for _, btn := range row {
+				if len(btn.CallbackData) > 64 {
+					t.Errorf("callback data %q exceeds 64 bytes", btn.CallbackData)
+				}
+			}
+		}
+	}
+}
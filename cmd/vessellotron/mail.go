@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// Most recipients of a message.
+	maxRecipients = 100
+	// Deepest nesting of multipart bodies.
+	maxMIMEDepth = 10
+	// Longest line of a client, more lenient than the 1000 bytes of RFC 5321.
+	maxLineLength = 4096
+	// Most messages sent over a connection.
+	maxMessages = 10
+	// Most clients served at once.
+	maxSessions = 10
+)
+
+var (
+	errNotAllowed = errors.New("sender not allowed")
+	errNoBooks    = errors.New("no books attached")
+	wordDecoder   = new(mime.WordDecoder)
+
+	// No Authentication-Results header of the MTA vouches for the sender.
+	errNotAuthenticated = errors.New("sender not authenticated")
+	// Anyone could reach the SMTP server and claim to be a sender.
+	errMailExposed = errors.New("the SMTP server can listen beyond localhost only with auth_serv_id")
+
+	// The comments of the Authentication-Results header.
+	arCommentRe = regexp.MustCompile(`\([^()]*\)`)
+
+	errLineTooLong = errors.New("line too long")
+
+	// How long an SMTP client can stay idle, and connected at all,
+	// variables to let the tests shorten them.
+	smtpTimeout    = 5 * time.Minute
+	maxSessionTime = 30 * time.Minute
+)
+
+// MailConfig configures the ingestion of the books sent by email.
+type MailConfig struct {
+	// Listen is the address of the SMTP server receiving the books, e.g.
+	// 127.0.0.1:2525, empty disables it. A port alone listens on localhost.
+	Listen string `json:"listen"`
+	// AuthServID is the authserv-id of the MTA relaying the messages,
+	// whose Authentication-Results header has to prove that they come from
+	// the domain of the sender. It's required to listen beyond localhost.
+	AuthServID string `json:"auth_serv_id"`
+	// Domain is the name the server greets the clients with.
+	Domain string `json:"domain"`
+	// Senders are the addresses allowed to send books.
+	Senders []string `json:"senders"`
+	// MaxSize is the size in bytes of the biggest message accepted.
+	MaxSize int64 `json:"max_size"`
+	// Smarthost is the SMTP server, as host:port, that relays the
+	// confirmations, empty disables them.
+	Smarthost string `json:"smarthost"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	// From is the address of the confirmations.
+	From string `json:"from"`
+}
+
+// allowed reports whether addr can send books.
+func (m MailConfig) allowed(addr string) bool {
+	for _, s := range m.Senders {
+		if strings.EqualFold(strings.TrimSpace(s), addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenAddr returns the address the SMTP server listens on, localhost if
+// Listen is only a port.
+func (m MailConfig) listenAddr() string {
+	host, port, err := net.SplitHostPort(m.Listen)
+	if err != nil {
+		host, port = "", m.Listen
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// exposed reports whether the SMTP server can be reached from other hosts.
+func (m MailConfig) exposed() bool {
+	host, _, _ := net.SplitHostPort(m.listenAddr())
+	if strings.EqualFold(host, "localhost") {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	return err != nil || !ip.IsLoopback()
+}
+
+// authenticated reports whether an Authentication-Results header added by
+// the MTA AuthServID shows that the message comes from the domain of from:
+// DMARC passed, or SPF or DKIM passed for that domain.
+func (m MailConfig) authenticated(h mail.Header, from string) bool {
+	domain := strings.ToLower(from[strings.LastIndexByte(from, '@')+1:])
+
+	for _, ar := range h["Authentication-Results"] {
+		results := strings.Split(arCommentRe.ReplaceAllString(ar, ""), ";")
+		if id := strings.Fields(results[0]); len(id) == 0 || !strings.EqualFold(id[0], m.AuthServID) {
+			continue
+		}
+
+		for _, res := range results[1:] {
+			fields := strings.Fields(strings.ToLower(res))
+			if len(fields) == 0 {
+				continue
+			}
+			method, result, _ := strings.Cut(fields[0], "=")
+			if result != "pass" {
+				continue
+			}
+			props := make(map[string]string)
+			for _, f := range fields[1:] {
+				if k, v, ok := strings.Cut(f, "="); ok {
+					v = strings.Trim(v, `"`)
+					props[k] = v[strings.LastIndexByte(v, '@')+1:]
+				}
+			}
+
+			switch method {
+			case "dmarc":
+				if d, ok := props["header.from"]; !ok || d == domain {
+					return true
+				}
+			case "dkim":
+				if props["header.d"] == domain {
+					return true
+				}
+			case "spf":
+				if props["smtp.mailfrom"] == domain {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// serveMail accepts the messages carrying books over SMTP on m.Listen.
+func serveMail(m MailConfig) error {
+	l, err := net.Listen("tcp", m.listenAddr())
+	if err != nil {
+		return fmt.Errorf("serveMail: net.Listen: %w", err)
+	}
+	defer l.Close()
+
+	if err := serveSMTP(l, m); err != nil {
+		return fmt.Errorf("serveMail: %w", err)
+	}
+	return nil
+}
+
+// serveSMTP runs an SMTP session for each client connecting to l, up to
+// maxSessions at once, the others are turned away.
+func serveSMTP(l net.Listener, m MailConfig) error {
+	sessions := make(chan struct{}, maxSessions)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("serveSMTP: l.Accept: %w", err)
+		}
+
+		select {
+		case sessions <- struct{}{}:
+		default:
+			conn.SetWriteDeadline(time.Now().Add(smtpTimeout))
+			fmt.Fprintf(conn, "421 %s Too many connections, try again later\r\n", m.Domain)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-sessions }()
+			defer conn.Close()
+			if err := smtpSession(conn, m); err != nil {
+				log.Println("serveSMTP", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// smtpReader reads what an SMTP client sends, failing with errLineTooLong
+// once a line is longer than maxLineLength.
+// Each read times out after smtpTimeout, or once the session lasted
+// maxSessionTime.
+type smtpReader struct {
+	conn net.Conn
+	end  time.Time
+	// Length of the current line.
+	line int
+}
+
+func (r *smtpReader) Read(p []byte) (int, error) {
+	if r.line > maxLineLength {
+		return 0, errLineTooLong
+	}
+
+	deadline := time.Now().Add(smtpTimeout)
+	if deadline.After(r.end) {
+		deadline = r.end
+	}
+	r.conn.SetReadDeadline(deadline)
+
+	n, err := r.conn.Read(p)
+	for i, c := range p[:n] {
+		if c == '\n' {
+			r.line = 0
+		} else if r.line++; r.line > maxLineLength {
+			return i, errLineTooLong
+		}
+	}
+	return n, err
+}
+
+// smtpSession speaks the minimum of SMTP needed to receive messages on conn
+// and hands them to deliver.
+func smtpSession(conn net.Conn, m MailConfig) error {
+	var (
+		r  = &smtpReader{conn: conn, end: time.Now().Add(maxSessionTime)}
+		tp = textproto.NewConn(struct {
+			io.Reader
+			io.WriteCloser
+		}{r, conn})
+		from     string
+		rcpt     int
+		messages int
+	)
+
+	reply := func(format string, args ...any) error {
+		conn.SetWriteDeadline(time.Now().Add(smtpTimeout))
+		return tp.PrintfLine(format, args...)
+	}
+
+	if err := reply("220 %s ESMTP vessellotron", m.Domain); err != nil {
+		return fmt.Errorf("smtpSession: %w", err)
+	}
+	for {
+		line, err := tp.ReadLine()
+		if errors.Is(err, errLineTooLong) {
+			reply("500 Line too long")
+		}
+		if err != nil {
+			return fmt.Errorf("smtpSession: tp.ReadLine: %w", err)
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			err = reply("250 %s", m.Domain)
+		case "EHLO":
+			err = reply("250-%s\r\n250-SIZE %d\r\n250 8BITMIME", m.Domain, m.MaxSize)
+
+		case "MAIL":
+			if messages == maxMessages {
+				reply("421 %s Too many messages, closing the connection", m.Domain)
+				return nil
+			}
+			addr, ok := pathArg(arg, "FROM:")
+			switch {
+			case !ok:
+				err = reply("501 Syntax: MAIL FROM:<address>")
+			case !m.allowed(strings.Trim(addr, "<>")):
+				err = reply("550 Sender not allowed")
+			default:
+				from, rcpt = strings.Trim(addr, "<>"), 0
+				err = reply("250 OK")
+			}
+
+		case "RCPT":
+			switch _, ok := pathArg(arg, "TO:"); {
+			case !ok:
+				err = reply("501 Syntax: RCPT TO:<address>")
+			case from == "":
+				err = reply("503 MAIL first")
+			case rcpt == maxRecipients:
+				err = reply("452 Too many recipients")
+			default:
+				rcpt++
+				err = reply("250 OK")
+			}
+
+		case "DATA":
+			if rcpt == 0 {
+				err = reply("503 RCPT first")
+				break
+			}
+			if err = reply("354 End data with <CR><LF>.<CR><LF>"); err != nil {
+				break
+			}
+			err = receive(tp, m, from, reply)
+			if errors.Is(err, errLineTooLong) {
+				reply("500 Line too long")
+			}
+			from, rcpt = "", 0
+			messages++
+
+		case "RSET":
+			from, rcpt = "", 0
+			err = reply("250 OK")
+		case "NOOP":
+			err = reply("250 OK")
+		case "VRFY":
+			err = reply("252 Cannot VRFY user")
+		case "QUIT":
+			reply("221 Bye")
+			return nil
+		default:
+			err = reply("502 Command not implemented")
+		}
+		if err != nil {
+			return fmt.Errorf("smtpSession: %w", err)
+		}
+	}
+}
+
+// pathArg parses the address of the MAIL and RCPT commands, ignoring their
+// parameters. The null path <> is valid.
+func pathArg(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", false
+	}
+	addr, _, ok := strings.Cut(arg[1:], ">")
+	return "<" + addr + ">", ok
+}
+
+// receive reads the message following the DATA command, from the envelope
+// sender from, and, once it's been accepted, stores its books in the
+// background.
+func receive(tp *textproto.Conn, m MailConfig, from string, reply func(string, ...any) error) error {
+	r := tp.DotReader()
+	tmp, err := spool(r, m.MaxSize)
+	if errors.Is(err, errLineTooLong) {
+		return fmt.Errorf("receive: %w", err)
+	}
+	if errors.Is(err, errTooBig) {
+		io.Copy(io.Discard, r)
+		return reply("552 Message exceeds the maximum size of %d bytes", m.MaxSize)
+	}
+	if err != nil {
+		log.Println("receive", err)
+		io.Copy(io.Discard, r)
+		return reply("451 Local error, try again later")
+	}
+	if err := reply("250 OK, queued"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	go deliver(tmp, m, from)
+	return nil
+}
+
+// deliver stores the books attached to the message spooled at tmp, from
+// the envelope sender envelope, and confirms the outcome to the sender.
+func deliver(tmp string, m MailConfig, envelope string) {
+	defer os.Remove(tmp)
+
+	f, err := os.Open(tmp)
+	if err != nil {
+		log.Println("deliver", "os.Open", err)
+		return
+	}
+	defer f.Close()
+
+	from, subject, lines, err := ingestMail(f, m, envelope)
+	switch {
+	// Replying to a forged sender would spam someone else.
+	case errors.Is(err, errNotAllowed), errors.Is(err, errNotAuthenticated):
+		log.Println("deliver", err, from)
+		return
+	case errors.Is(err, errNoBooks):
+		lines = []string{"No books were attached to the message."}
+	case err != nil:
+		log.Println("deliver", err)
+		if from == "" {
+			return
+		}
+		if len(lines) == 0 {
+			lines = []string{"The message couldn't be read."}
+		} else {
+			lines = append(lines, "The rest of the message couldn't be read.")
+		}
+	}
+
+	if err := confirm(m, from, subject, lines); err != nil {
+		log.Println("deliver", err)
+	}
+}
+
+// ingestMail stores the books attached to the message read from r, sent by
+// one of the allowed senders, and returns the sender, the subject and the
+// outcome of each book.
+// The From header has to match the envelope sender and, with AuthServID,
+// the message has to be authenticated by the MTA.
+func ingestMail(r io.Reader, m MailConfig, envelope string) (string, string, []string, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("ingestMail: mail.ReadMessage: %w", err)
+	}
+	addr, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return "", "", nil, fmt.Errorf("ingestMail: mail.ParseAddress: %w", err)
+	}
+	from := addr.Address
+	subject, _ := wordDecoder.DecodeHeader(msg.Header.Get("Subject"))
+	if !m.allowed(from) || !strings.EqualFold(from, envelope) {
+		return from, subject, nil, fmt.Errorf("ingestMail: %w", errNotAllowed)
+	}
+	if m.AuthServID != "" && !m.authenticated(msg.Header, from) {
+		return from, subject, nil, fmt.Errorf("ingestMail: %w", errNotAuthenticated)
+	}
+
+	var lines []string
+	err = walkParts(textproto.MIMEHeader(msg.Header), msg.Body, 0, func(name string, body io.Reader) {
+		lines = append(lines, storeAttachment(name, body, m.MaxSize)...)
+	})
+	if err != nil {
+		return from, subject, lines, fmt.Errorf("ingestMail: %w", err)
+	}
+	if len(lines) == 0 {
+		return from, subject, nil, fmt.Errorf("ingestMail: %w", errNoBooks)
+	}
+	return from, subject, lines, nil
+}
+
+// walkParts calls fn with the name and the decoded content of every
+// attachment in the MIME body with the given header.
+func walkParts(h textproto.MIMEHeader, body io.Reader, depth int, fn func(string, io.Reader)) error {
+	ctype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		ctype = "text/plain"
+	}
+
+	if strings.HasPrefix(ctype, "multipart/") {
+		if depth == maxMIMEDepth {
+			return fmt.Errorf("walkParts: nested too deep")
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("walkParts: mr.NextRawPart: %w", err)
+			}
+			if err := walkParts(p.Header, p, depth+1, fn); err != nil {
+				return err
+			}
+		}
+	}
+
+	name := params["name"]
+	if _, dparams, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && dparams["filename"] != "" {
+		name = dparams["filename"]
+	}
+	if dec, err := wordDecoder.DecodeHeader(name); err == nil {
+		name = dec
+	}
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "" || name == "." || name == "/" {
+		return nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineSkipper{bufio.NewReader(body)})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	fn(name, body)
+	return nil
+}
+
+// newlineSkipper drops the line breaks of base64 encoded bodies.
+type newlineSkipper struct {
+	r io.ByteReader
+}
+
+func (n *newlineSkipper) Read(p []byte) (int, error) {
+	var i int
+	for i < len(p) {
+		c, err := n.r.ReadByte()
+		if err != nil {
+			return i, err
+		}
+		if c != '\r' && c != '\n' && c != ' ' && c != '\t' {
+			p[i] = c
+			i++
+		}
+	}
+	return i, nil
+}
+
+// storeAttachment stores the attached book, or the books in the attached
+// archive, and returns the outcome of each of them.
+func storeAttachment(name string, body io.Reader, limit int64) []string {
+	if !isAllowedExt(filepath.Ext(name)) && !isArchive(name) {
+		return nil
+	}
+
+	tmp, err := spool(body, limit)
+	if err != nil {
+		log.Println("storeAttachment", err)
+		return []string{fmt.Sprintf("✗ %s: couldn't be read", name)}
+	}
+	if !isArchive(name) {
+		return []string{storeMailed(name, tmp)}
+	}
+
+	entries, err := extractArchive(name, tmp)
+	os.Remove(tmp)
+	if err != nil {
+		log.Println("storeAttachment", err)
+		return []string{fmt.Sprintf("✗ %s: couldn't be unpacked", name)}
+	}
+	if isImageSet(entries) {
+		cbz, err := packCBZ(entries)
+		for _, en := range entries {
+			os.Remove(en.Tmp)
+		}
+		if err != nil {
+			log.Println("storeAttachment", err)
+			return []string{fmt.Sprintf("✗ %s: couldn't be packed", name)}
+		}
+		return []string{storeMailed(archiveStem(name)+".cbz", cbz)}
+	}
+
+	var lines []string
+	for _, en := range entries {
+		if en.Err != nil {
+			lines = append(lines, fmt.Sprintf("✗ %s: %v", en.Name, en.Err))
+			continue
+		}
+		lines = append(lines, storeMailed(en.Name, en.Tmp))
+	}
+	return lines
+}
+
+// storeMailed stores a book received by email and returns its outcome.
+// Nobody can be asked about the duplicates, so the identical books are
+// skipped and the ones with the same name or title are kept both.
+func storeMailed(name, tmp string) string {
+	up, err := prepare(name, tmp, cfg.Convert)
+	if err != nil {
+		var broken epubError
+		if errors.As(err, &broken) {
+			return fmt.Sprintf("✗ %s: %v", name, broken)
+		}
+		log.Println("storeMailed", err)
+		return fmt.Sprintf("✗ %s: couldn't be stored", name)
+	}
+
+	same, dest, err := stowRenamed(up)
+	if same.Path != "" {
+		up.remove()
+		return fmt.Sprintf("= %s: already in the library as %s", name, filepath.Base(same.Path))
+	}
+	if err != nil {
+		log.Println("storeMailed", err)
+		up.remove()
+		return fmt.Sprintf("✗ %s: couldn't be stored", name)
+	}
+
+	line := "✓ " + filepath.Base(dest)
+	if len(up.Fixes) > 0 {
+		line += " (repaired: " + strings.Join(up.Fixes, "; ") + ")"
+	}
+	if up.ConvErr != nil {
+		line += " (not converted)"
+	}
+	return line
+}
+
+// confirm emails the outcome of the books sent by to through the smarthost.
+func confirm(m MailConfig, to, subject string, lines []string) error {
+	if m.Smarthost == "" {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(m.Smarthost)
+	if err != nil {
+		return fmt.Errorf("confirm: net.SplitHostPort: %w", err)
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	msg := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\nAuto-Submitted: auto-replied\r\n\r\n%s\r\n",
+		m.From, to, mime.QEncoding.Encode("utf-8", subject), time.Now().Format(time.RFC1123Z),
+		strings.Join(lines, "\r\n"),
+	)
+	if err := smtp.SendMail(m.Smarthost, auth, m.From, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("confirm: smtp.SendMail: %w", err)
+	}
+	return nil
+}
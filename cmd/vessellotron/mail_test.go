@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeMail returns a message from sender with the files attached, by name,
+// encoded in base64 but for the text files.
+func writeMail(sender string, files map[string]string) string {
+	var buf strings.Builder
+
+	fmt.Fprintf(&buf, "From: Sailor <%s>\r\nTo: books@localhost\r\nSubject: =?utf-8?q?Libri_=C3=A0_bord?=\r\n", sender)
+	buf.WriteString("MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"XX\"\r\n\r\n")
+	buf.WriteString("--XX\r\nContent-Type: text/plain\r\n\r\nHere you go.\r\n")
+	for name, body := range files {
+		buf.WriteString("--XX\r\n")
+		if strings.HasSuffix(name, ".txt") {
+			fmt.Fprintf(&buf, "Content-Type: text/plain; name=\"%s\"\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n%s\r\n", name, body)
+			continue
+		}
+		fmt.Fprintf(&buf, "Content-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"%s\"\r\nContent-Transfer-Encoding: base64\r\n\r\n", name)
+		enc := base64.StdEncoding.EncodeToString([]byte(body))
+		for len(enc) > 76 {
+			buf.WriteString(enc[:76] + "\r\n")
+			enc = enc[76:]
+		}
+		buf.WriteString(enc + "\r\n")
+	}
+	buf.WriteString("--XX--\r\n")
+	return buf.String()
+}
+
+func TestIngestMail(t *testing.T) {
+	dir := withHome(t)
+	newLibrary(t, nil)
+
+	saved := cfg
+	cfg = &Config{Convert: defaultConvert}
+	t.Cleanup(func() { cfg = saved })
+
+	src := filepath.Join(t.TempDir(), "dune.epub")
+	writeEPUB(t, src, "Dune", "Frank Herbert")
+	epub := string(must(os.ReadFile(src)))
+
+	m := MailConfig{Senders: []string{" Sailor@Example.com"}, MaxSize: 1 << 20}
+	msg := writeMail("sailor@example.com", map[string]string{
+		"dune.epub":  epub,
+		"notes.txt":  "Caff=C3=A8 and a very long line that has been split by=\r\n the encoder.",
+		"virus.exe":  "MZ",
+		"../up.epub": epub,
+	})
+
+	from, subject, lines, err := ingestMail(strings.NewReader(msg), m, "Sailor@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != "sailor@example.com" || subject != "Libri à bord" {
+		t.Errorf("ingestMail() = %q, %q", from, subject)
+	}
+	var stored, skipped int
+	for _, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "✓ "):
+			stored++
+		case strings.HasPrefix(l, "= "):
+			skipped++
+		default:
+			t.Errorf("unexpected outcome %q", l)
+		}
+	}
+	// The same EPUB is attached twice.
+	if stored != 2 || skipped != 1 {
+		t.Errorf("outcomes = %q, want two books stored and one skipped", lines)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.kepub.epub")); err != nil {
+		t.Error(err)
+	}
+	if len(lib.Books()) != 2 {
+		t.Errorf("the library holds %d books, want 2", len(lib.Books()))
+	}
+
+	_, _, _, err = ingestMail(strings.NewReader(writeMail("pirate@example.com", map[string]string{"x.epub": epub})), m, "pirate@example.com")
+	if !errors.Is(err, errNotAllowed) {
+		t.Errorf("ingestMail() error = %v, want errNotAllowed", err)
+	}
+	// A From header forged by another envelope sender.
+	_, _, _, err = ingestMail(strings.NewReader(writeMail("sailor@example.com", map[string]string{"x.epub": epub})), m, "pirate@example.com")
+	if !errors.Is(err, errNotAllowed) {
+		t.Errorf("ingestMail() error = %v, want errNotAllowed", err)
+	}
+	m.AuthServID = "mx.example.org"
+	_, _, _, err = ingestMail(strings.NewReader(writeMail("sailor@example.com", map[string]string{"x.epub": epub})), m, "sailor@example.com")
+	if !errors.Is(err, errNotAuthenticated) {
+		t.Errorf("ingestMail() error = %v, want errNotAuthenticated", err)
+	}
+	msg = "Authentication-Results: mx.example.org; dmarc=pass header.from=example.com\r\n" + writeMail("sailor@example.com", nil)
+	_, _, _, err = ingestMail(strings.NewReader(msg), m, "sailor@example.com")
+	if !errors.Is(err, errNoBooks) {
+		t.Errorf("ingestMail() error = %v, want errNoBooks", err)
+	}
+	if len(lib.Books()) != 2 {
+		t.Errorf("the library holds %d books, want 2", len(lib.Books()))
+	}
+
+	if tmps, _ := filepath.Glob(filepath.Join(dir, ".vessellotron-*")); len(tmps) != 0 {
+		t.Errorf("temporary files left: %q", tmps)
+	}
+}
+
+func TestStoreMailedConcurrent(t *testing.T) {
+	dir := withHome(t)
+	newLibrary(t, nil)
+
+	saved := cfg
+	cfg = &Config{Convert: defaultConvert}
+	t.Cleanup(func() { cfg = saved })
+
+	const n = 8
+	var (
+		lines = make([]string, 2*n)
+		tmps  = make([]string, 2*n)
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < n; i++ {
+		// Different books with the same name and the same book with
+		// different names.
+		tmps[i] = newUpload(t, fmt.Sprint("book ", i))
+		tmps[n+i] = newUpload(t, "the copy")
+	}
+	start := make(chan struct{})
+	for i := range tmps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			name := "book.pdf"
+			if i >= n {
+				name = fmt.Sprintf("copy %d.pdf", i)
+			}
+			lines[i] = storeMailed(name, tmps[i])
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	var stored, skipped int
+	for _, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "✓ "):
+			stored++
+		case strings.HasPrefix(l, "= "):
+			skipped++
+		default:
+			t.Errorf("unexpected outcome %q", l)
+		}
+	}
+	if stored != n+1 || skipped != n-1 {
+		t.Errorf("outcomes = %q, want %d books stored and %d skipped", lines, n+1, n-1)
+	}
+	books, _ := filepath.Glob(filepath.Join(dir, "book*.pdf"))
+	if len(books) != n || len(lib.Books()) != n+1 {
+		t.Errorf("files = %q and %d books, want %d and %d", books, len(lib.Books()), n, n+1)
+	}
+}
+
+func TestPathArg(t *testing.T) {
+	tests := []struct {
+		arg  string
+		addr string
+		ok   bool
+	}{
+		{"FROM:<a@b.c>", "<a@b.c>", true},
+		{"from: <a@b.c> SIZE=100", "<a@b.c>", true},
+		{"FROM:<>", "<>", true},
+		{"FROM:a@b.c", "", false},
+		{"FROM:<a@b.c", "<a@b.c>", false},
+		{"TO:<a@b.c>", "", false},
+	}
+
+	for _, tt := range tests {
+		if addr, ok := pathArg(tt.arg, "FROM:"); ok != tt.ok || (ok && addr != tt.addr) {
+			t.Errorf("pathArg(%q) = %q, %t, want %q, %t", tt.arg, addr, ok, tt.addr, tt.ok)
+		}
+	}
+}
+
+func TestSMTPSession(t *testing.T) {
+	withHome(t)
+
+	server, client := net.Pipe()
+	done := make(chan error)
+	go func() {
+		m := MailConfig{Domain: "localhost", MaxSize: 256, Senders: []string{"sailor@example.com"}, AuthServID: "mx.example.org"}
+		done <- smtpSession(server, m)
+		server.Close()
+	}()
+
+	c, err := smtp.NewClient(client, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Hello("client"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, size := c.Extension("SIZE"); !ok || size != "256" {
+		t.Errorf("SIZE = %t, %q", ok, size)
+	}
+
+	send := func(body string) error {
+		if err := c.Mail("sailor@example.com"); err != nil {
+			return err
+		}
+		if err := c.Rcpt("books@localhost"); err != nil {
+			return err
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	// Nothing authenticates the message, it's dropped once accepted.
+	if err := send("From: sailor@example.com\r\n\r\nAhoy!\r\n"); err != nil {
+		t.Errorf("send() error = %v", err)
+	}
+	var perr *textproto.Error
+	if err := c.Mail("pirate@example.com"); !errors.As(err, &perr) || perr.Code != 550 {
+		t.Errorf("Mail() error = %v, want 550", err)
+	}
+	if err := send("From: sailor@example.com\r\n\r\n" + strings.Repeat("x", 300) + "\r\n"); !errors.As(err, &perr) || perr.Code != 552 {
+		t.Errorf("send() error = %v, want 552", err)
+	}
+	if err := c.Rcpt("books@localhost"); !errors.As(err, &perr) || perr.Code != 503 {
+		t.Errorf("Rcpt() error = %v, want 503", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMailListen(t *testing.T) {
+	tests := []struct {
+		listen  string
+		addr    string
+		exposed bool
+	}{
+		{"2525", "127.0.0.1:2525", false},
+		{":2525", "127.0.0.1:2525", false},
+		{"localhost:2525", "localhost:2525", false},
+		{"[::1]:2525", "[::1]:2525", false},
+		{"0.0.0.0:2525", "0.0.0.0:2525", true},
+		{"mail.example.com:25", "mail.example.com:25", true},
+	}
+
+	for _, tt := range tests {
+		m := MailConfig{Listen: tt.listen}
+		if addr := m.listenAddr(); addr != tt.addr {
+			t.Errorf("listenAddr(%q) = %q, want %q", tt.listen, addr, tt.addr)
+		}
+		if exposed := m.exposed(); exposed != tt.exposed {
+			t.Errorf("exposed(%q) = %t, want %t", tt.listen, exposed, tt.exposed)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "vessellotron.json")
+	t.Setenv("VESSELLOTRON_TOKEN", "token")
+	os.WriteFile(path, []byte(`{"mail": {"listen": ":25", "senders": ["sailor@example.com"]}}`), 0600)
+	if _, err := LoadConfig(path); err != nil {
+		t.Errorf("LoadConfig() error = %v", err)
+	}
+	os.WriteFile(path, []byte(`{"mail": {"listen": "0.0.0.0:25", "senders": ["sailor@example.com"]}}`), 0600)
+	if _, err := LoadConfig(path); !errors.Is(err, errMailExposed) {
+		t.Errorf("LoadConfig() error = %v, want errMailExposed", err)
+	}
+	os.WriteFile(path, []byte(`{"mail": {"listen": "0.0.0.0:25", "senders": ["sailor@example.com"], "auth_serv_id": "mx.example.org"}}`), 0600)
+	if _, err := LoadConfig(path); err != nil {
+		t.Errorf("LoadConfig() error = %v", err)
+	}
+}
+
+func TestMailAuthenticated(t *testing.T) {
+	m := MailConfig{AuthServID: "mx.example.org"}
+
+	tests := []struct {
+		results []string
+		want    bool
+	}{
+		{nil, false},
+		{[]string{"mx.example.org; dmarc=pass (p=none) header.from=example.com"}, true},
+		{[]string{"MX.example.org 1; dmarc=pass"}, true},
+		{[]string{"mx.example.org; dmarc=pass header.from=evil.com"}, false},
+		{[]string{"mx.example.org; dmarc=fail header.from=example.com"}, false},
+		{[]string{"mx.example.org; spf=pass smtp.mailfrom=sailor@example.com"}, true},
+		{[]string{"mx.example.org; spf=pass smtp.mailfrom=pirate@evil.com"}, false},
+		{[]string{"mx.example.org; spf=fail smtp.mailfrom=example.com; dkim=pass header.d=example.com"}, true},
+		{[]string{"mx.example.org; dkim=pass (good signature) header.d=evil.com"}, false},
+		// Added by someone else than the MTA.
+		{[]string{"evil.com; dmarc=pass header.from=example.com"}, false},
+		{[]string{"evil.com; dmarc=pass", "mx.example.org; dmarc=none"}, false},
+		{[]string{"mx.example.org; none"}, false},
+	}
+
+	for _, tt := range tests {
+		h := mail.Header{"Authentication-Results": tt.results}
+		if got := m.authenticated(h, "Sailor@Example.com"); got != tt.want {
+			t.Errorf("authenticated(%q) = %t, want %t", tt.results, got, tt.want)
+		}
+	}
+}
+
+// startSMTP runs an SMTP session over a pipe and returns the client side,
+// greeted already, and the channel receiving the outcome of the session.
+func startSMTP(t *testing.T, m MailConfig) (*textproto.Conn, <-chan error) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- smtpSession(server, m)
+		server.Close()
+	}()
+	t.Cleanup(func() { client.Close() })
+
+	c := textproto.NewConn(client)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	return c, done
+}
+
+// startData sends a message from sailor@example.com up to the DATA command.
+func startData(c *textproto.Conn) error {
+	for _, cmd := range []struct {
+		line string
+		code int
+	}{{"MAIL FROM:<sailor@example.com>", 250}, {"RCPT TO:<books@localhost>", 250}, {"DATA", 354}} {
+		if _, err := c.Cmd(cmd.line); err != nil {
+			return err
+		}
+		if _, _, err := c.ReadResponse(cmd.code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSMTPLimits(t *testing.T) {
+	withHome(t)
+	m := MailConfig{Domain: "localhost", MaxSize: 1 << 20, Senders: []string{"sailor@example.com"}, AuthServID: "mx.example.org"}
+
+	t.Run("command line", func(t *testing.T) {
+		c, done := startSMTP(t, m)
+		go c.PrintfLine("NOOP %s", strings.Repeat("x", maxLineLength))
+		if _, _, err := c.ReadResponse(500); err != nil {
+			t.Errorf("ReadResponse() error = %v, want 500", err)
+		}
+		if err := <-done; !errors.Is(err, errLineTooLong) {
+			t.Errorf("smtpSession() error = %v, want errLineTooLong", err)
+		}
+	})
+
+	t.Run("data line", func(t *testing.T) {
+		c, done := startSMTP(t, m)
+		if err := startData(c); err != nil {
+			t.Fatal(err)
+		}
+		go c.PrintfLine("Subject: ahoy\r\n\r\n%s", strings.Repeat("x", maxLineLength+1))
+		if _, _, err := c.ReadResponse(500); err != nil {
+			t.Errorf("ReadResponse() error = %v, want 500", err)
+		}
+		if err := <-done; !errors.Is(err, errLineTooLong) {
+			t.Errorf("smtpSession() error = %v, want errLineTooLong", err)
+		}
+	})
+
+	t.Run("messages", func(t *testing.T) {
+		c, done := startSMTP(t, m)
+		send := func() error {
+			if err := startData(c); err != nil {
+				return err
+			}
+			w := c.DotWriter()
+			w.Write([]byte("From: sailor@example.com\r\n\r\nAhoy!\r\n"))
+			w.Close()
+			_, _, err := c.ReadResponse(250)
+			return err
+		}
+
+		for i := 0; i < maxMessages; i++ {
+			if err := send(); err != nil {
+				t.Fatalf("message %d: %v", i, err)
+			}
+		}
+		var perr *textproto.Error
+		if err := send(); !errors.As(err, &perr) || perr.Code != 421 {
+			t.Errorf("send() error = %v, want 421", err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("smtpSession() error = %v", err)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		saved := smtpTimeout
+		smtpTimeout = 50 * time.Millisecond
+		t.Cleanup(func() { smtpTimeout = saved })
+
+		_, done := startSMTP(t, m)
+		if err := <-done; !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("smtpSession() error = %v, want a timeout", err)
+		}
+	})
+
+	t.Run("session time", func(t *testing.T) {
+		saved := maxSessionTime
+		maxSessionTime = 100 * time.Millisecond
+		t.Cleanup(func() { maxSessionTime = saved })
+
+		c, done := startSMTP(t, m)
+		// A chatty client is still cut off.
+		for {
+			select {
+			case err := <-done:
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Errorf("smtpSession() error = %v, want a timeout", err)
+				}
+				return
+			case <-time.After(10 * time.Millisecond):
+				if _, err := c.Cmd("NOOP"); err == nil {
+					c.ReadResponse(250)
+				}
+			}
+		}
+	})
+}
+
+func TestServeSMTPSessions(t *testing.T) {
+	withHome(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serveSMTP(l, MailConfig{Domain: "localhost", MaxSize: 256})
+
+	greet := func() (net.Conn, int, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return nil, 0, err
+		}
+		code, _, err := textproto.NewConn(conn).ReadResponse(0)
+		return conn, code, err
+	}
+
+	var conns []net.Conn
+	for i := 0; i < maxSessions; i++ {
+		conn, code, err := greet()
+		if err != nil || code != 220 {
+			t.Fatalf("session %d greeted with %d, %v", i, code, err)
+		}
+		conns = append(conns, conn)
+	}
+	if conn, code, err := greet(); err != nil || code != 421 {
+		t.Errorf("a session too many greeted with %d, %v, want 421", code, err)
+	} else {
+		conn.Close()
+	}
+
+	// A session ending makes room for another.
+	conns[0].Close()
+	for deadline := time.Now().Add(time.Second); ; {
+		conn, code, err := greet()
+		if err == nil {
+			conn.Close()
+		}
+		if code == 220 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no room for a new session: %d, %v", code, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, conn := range conns[1:] {
+		conn.Close()
+	}
+}
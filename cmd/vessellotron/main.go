@@ -1,51 +1,47 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
-	"context"
 	"crypto/md5"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/NicoNex/echotron/v3"
-	"github.com/pgaskin/kepubify/v4/kepub"
-
-	_ "embed"
 )
 
 type bot struct {
 	chatID int64
-	meta   map[string]string
+	// Search queries of the listings sent, by message ID.
+	queries map[int]string
+	// Uploads waiting for the user to choose what to do with a duplicate.
+	pending map[int]pendingUpload
+	nextID  int
+	mu      sync.Mutex
 	echotron.API
 }
 
-type empty struct{}
-
-func (e empty) Update(_ *echotron.Update) {}
-
 const (
-	NicoNex = 41876271
-
-	intro  = "Ahoy there, me hearty! I be Vessellotron, the swashbucklin’ robot ship who’ll help ye transport yer book barrels to yer Kobo!"
-	noBook = "Arr, there be no barrels to be had, matey!"
+	intro      = "Ahoy there, me hearty! I be Vessellotron, the swashbucklin’ robot ship who’ll help ye transport yer book barrels to yer Kobo!"
+	noBook     = "Arr, there be no barrels to be had, matey!"
+	notCaptain = "You're not the capitain! Send /invite to ask for a place aboard."
+	noRights   = "Ye can't do that on this ship, matey."
 )
 
 var (
-	//go:embed token
-	token    string
 	home     string
 	metaPath string
-	dsp      *echotron.Dispatcher
+	cfgPath  string
+	cfg      *Config
+	lib      *Library
 
 	supportedExts = []string{
 		".epub",
@@ -59,6 +55,9 @@ var (
 		".tiff",
 		".txt",
 		".html",
+		".htm",
+		".md",
+		".markdown",
 		".rtf",
 		".cbz",
 		".cbr",
@@ -89,211 +88,287 @@ var (
 )
 
 func newBot(chatID int64) echotron.Bot {
-	if chatID != NicoNex {
-		echotron.NewAPI(token).SendMessage("You're not the capitain!", chatID, nil)
-		go func() {
-			time.Sleep(3 * time.Second)
-			dsp.DelSession(chatID)
-		}()
-		return &empty{}
-	}
-
 	return &bot{
-		chatID: chatID,
-		meta:   loadMeta(metaPath),
-		API:    echotron.NewAPI(token),
+		chatID:  chatID,
+		queries: make(map[int]string),
+		pending: make(map[int]pendingUpload),
+		API:     cfg.API(),
 	}
 }
 
+// busy reports whether the session holds uploads waiting for a choice.
+func (b *bot) busy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pending) > 0
+}
+
 func (b *bot) Update(update *echotron.Update) {
+	role, ok := cfg.Role(b.chatID)
+	if cq := update.CallbackQuery; cq != nil {
+		b.callback(cq, role)
+		return
+	}
+	if update.Message == nil {
+		return
+	}
+
 	switch msg := update.Message.Text; {
 	case msg == "/start":
-		if _, err := b.SendMessage(intro, b.chatID, nil); err != nil {
-			log.Println("Update", "b.SendMessage", err)
+		b.send(intro)
+
+	case msg == "/invite":
+		b.invite(update.Message, ok)
+
+	case !ok:
+		b.send(notCaptain)
+
+	case strings.HasPrefix(msg, "/approve"):
+		if !role.CanManage() {
+			b.send(noRights)
+			return
+		}
+		b.approve(strings.Fields(msg)[1:])
+
+	case strings.HasPrefix(msg, "/revoke"):
+		if !role.CanManage() {
+			b.send(noRights)
+			return
 		}
+		b.revoke(strings.Fields(msg)[1:])
 
 	case msg == "/refresh":
-		b.refreshMeta()
-		b.sendMeta()
+		if !role.CanManage() {
+			b.send(noRights)
+			return
+		}
+		if err := lib.Refresh(); err != nil {
+			log.Println("b.Update", "lib.Refresh", err)
+		}
+		b.sendPage("")
 
-	case msg == "/metadata":
-		b.sendMeta()
+	case strings.HasPrefix(msg, "/settings"):
+		if !role.CanUpload() {
+			b.send(noRights)
+			return
+		}
+		b.settings(strings.Fields(msg)[1:])
+
+	case strings.HasPrefix(msg, "/convert"):
+		if !role.CanManage() {
+			b.send(noRights)
+			return
+		}
+		b.convert(strings.Fields(msg)[1:])
+
+	case msg == "/list", msg == "/metadata":
+		if !role.CanList() {
+			b.send(noRights)
+			return
+		}
+		b.sendPage("")
+
+	case strings.HasPrefix(msg, "/search"):
+		if !role.CanList() {
+			b.send(noRights)
+			return
+		}
+		query := strings.TrimSpace(strings.TrimPrefix(msg, "/search"))
+		if query == "" {
+			b.send("Usage: /search <title or author>")
+			return
+		}
+		b.sendPage(query)
 
 	case strings.HasPrefix(msg, "/delete"):
+		if !role.CanManage() {
+			b.send(noRights)
+			return
+		}
 		toks := strings.Split(msg, " ")
 		if len(toks) < 2 {
-			_, err := b.SendMessage("No hash provided", b.chatID, nil)
-			if err != nil {
-				log.Println("b.Update", "b.SendMessage", err)
-			}
+			b.send("No hash provided")
 			return
 		}
 		b.delEbook(toks[1])
 
 	default:
-		if update.Message.Document == nil {
-			_, err := b.SendMessage(noBook, b.chatID, nil)
-			if err != nil {
-				log.Println("Update", "b.SendMessage", err)
-			}
+		urls := findURLs(update.Message)
+		if update.Message.Document == nil && len(urls) == 0 {
+			b.send(noBook)
+			return
+		}
+		if !role.CanUpload() {
+			b.send(noRights)
 			return
 		}
-		b.saveEbook(update.Message.Document)
-		b.SendMessage("Thanks matey!", b.chatID, nil)
-	}
-}
-
-func (b bot) delEbook(h string) {
-	defer b.updateMeta()
 
-	if p, ok := b.meta[h]; ok {
-		if err := os.Remove(p); err != nil {
-			log.Println("b.Update", "os.Remove", err)
+		if doc := update.Message.Document; doc != nil {
+			if b.saveEbook(doc) == storeSaved {
+				b.send("Thanks matey!")
+			}
+			return
 		}
-		delete(b.meta, h)
-		b.SendMessage("ok", b.chatID, nil)
-	} else {
-		_, err := b.SendMessage("Unknown hash", b.chatID, nil)
-		if err != nil {
-			log.Println("b.Update", "b.SendMessage", err)
+		for _, u := range urls {
+			b.saveURL(u)
 		}
 	}
 }
 
-func (b bot) saveEbook(doc *echotron.Document) {
-	defer b.updateMeta()
-
-	ext := filepath.Ext(doc.FileName)
-
-	if !isAllowedExt(ext) {
-		b.SendMessage("Unsupported extension", b.chatID, nil)
-		return
+// send sends a plain text message to the chat and logs the failures.
+func (b *bot) send(text string) {
+	if _, err := b.SendMessage(text, b.chatID, nil); err != nil {
+		log.Println("b.send", "b.SendMessage", err)
 	}
+}
 
-	res, err := b.GetFile(doc.FileID)
-	if err != nil {
-		log.Println("b.saveEbook", "b.GetFile", err)
-		b.SendMessage("An error occurred while downloading the eBook.", b.chatID, nil)
+// invite issues a one-time code for the chat and forwards it to the admins
+// for approval.
+func (b *bot) invite(msg *echotron.Message, aboard bool) {
+	if aboard {
+		b.send("Ye're already aboard, matey!")
 		return
 	}
 
-	data, err := b.DownloadFile(res.Result.FilePath)
-	if err != nil {
-		log.Println("b.saveEbook", "b.DownloadFile", err)
-		b.SendMessage("An error occurred while downloading the eBook.", b.chatID, nil)
+	code, err := cfg.Invite(b.chatID)
+	switch {
+	case errors.Is(err, errInvitePending):
+		b.send("Yer invite be still waitin' for an admin.")
+		return
+	case errors.Is(err, errInviteCooldown):
+		b.send("Hold yer horses, ye can ask again in a while.")
+		return
+	case errors.Is(err, errTooManyInvites):
+		b.send("Too many sailors be waitin' already, try again later.")
+		return
+	case err != nil:
+		log.Println("b.invite", "cfg.Invite", err)
+		b.send("An error occurred while issuing the invite.")
 		return
 	}
 
-	if !strings.Contains(doc.FileName, ".kepub") && ext == ".epub" {
-		if err := b.kepubify(doc.FileName, data); err != nil {
-			log.Println(err)
-			b.SendMessage("An error occurred while converting to kepub, normal epub will be saved.", b.chatID, nil)
-			goto saveOnDisK
+	name := fmt.Sprint(b.chatID)
+	if u := msg.From; u != nil {
+		name = strings.TrimSpace(u.FirstName + " " + u.LastName)
+		if u.Username != "" {
+			name += " @" + u.Username
+		}
+	}
+	req := fmt.Sprintf(
+		"*%s* \\(`%d`\\) asks to come aboard, approve with:\n`/approve %s reader`",
+		escapeMD(name), b.chatID, code,
+	)
+	for _, id := range cfg.Admins() {
+		if _, err := b.SendMessage(req, id, mdopt); err != nil {
+			log.Println("b.invite", "b.SendMessage", err)
 		}
+	}
+	b.send(fmt.Sprintf("Yer invite code be %s, an admin has to approve it.", code))
+}
+
+// approve grants a role to the chat that requested the invite code in args.
+func (b *bot) approve(args []string) {
+	if len(args) == 0 {
+		b.send("Usage: /approve <code> [admin|contributor|reader]")
 		return
 	}
 
-saveOnDisK:
-	fname := filepath.Join(home, doc.FileName)
-	if err := os.WriteFile(fname, data, 0644); err != nil {
-		b.SendMessage("An error occurred while saving the file.", b.chatID, nil)
-		log.Println("b.saveEbook", "os.WriteFile", err)
+	role := Reader
+	if len(args) > 1 {
+		role = Role(strings.ToLower(args[1]))
 	}
-	hash := md5.New()
 
-	if _, err := io.Copy(hash, bytes.NewReader(data)); err != nil {
-		b.SendMessage("An error occurred while hashing the book", b.chatID, nil)
-		log.Println("b.saveEbook", "io.Copy", err)
+	id, err := cfg.Approve(args[0], role)
+	switch {
+	case errors.Is(err, errBadInvite), errors.Is(err, errBadRole):
+		b.send(err.Error())
 		return
+	case err != nil:
+		log.Println("b.approve", "cfg.Approve", err)
+		b.send("Approved, but the config couldn't be saved.")
+	default:
+		b.send("ok")
 	}
-	b.meta[hex.EncodeToString(hash.Sum(nil))] = fname
-}
 
-func (b *bot) kepubify(fname string, data []byte) error {
-	fpath := filepath.Join(home, kepubName(fname))
-	f, err := os.Create(fpath)
-	if err != nil {
-		return fmt.Errorf("b.kepubify: os.Create:%w", err)
+	msg := fmt.Sprintf("Welcome aboard, ye be a %s now!", role)
+	if _, err := b.SendMessage(msg, id, nil); err != nil {
+		log.Println("b.approve", "b.SendMessage", err)
 	}
-	defer f.Close()
+}
 
-	bfs, tmpname, err := fsFromBytes(fname, data)
-	if err != nil {
-		return fmt.Errorf("b.kepubify: fsFromBytes: %w", err)
+// revoke removes the chat ID in args from the allowed users.
+func (b *bot) revoke(args []string) {
+	if len(args) == 0 {
+		b.send("Usage: /revoke <chat id>")
+		return
 	}
-	defer os.Remove(tmpname)
 
-	conv := kepub.NewConverterWithOptions(kepub.ConverterOptionSmartypants())
-	if err := conv.Convert(context.Background(), f, bfs); err != nil {
-		return fmt.Errorf("b.kepubify: conv.Convert: %w", err)
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		b.send("Invalid chat ID")
+		return
 	}
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		return fmt.Errorf("b.kepubify: f.Seek: %w", err)
+	if err := cfg.Revoke(id); err != nil {
+		if errors.Is(err, errNoSuchUser) {
+			b.send(err.Error())
+			return
+		}
+		log.Println("b.revoke", "cfg.Revoke", err)
+		b.send("An error occurred while saving the config.")
+		return
 	}
+	b.send("ok")
+}
 
-	hash := md5.New()
-	if _, err := io.Copy(hash, f); err != nil {
-		return fmt.Errorf("b.kepubify: io.Copy: %w", err)
+func (b *bot) delEbook(h string) {
+	if err := b.removeBook(h); err != nil {
+		b.send(err.Error())
+		return
 	}
-	b.meta[hex.EncodeToString(hash.Sum(nil))] = fpath
-
-	return nil
+	b.send("ok")
 }
 
-func (b bot) updateMeta() {
-	j, err := json.MarshalIndent(b.meta, "", "  ")
+// removeBook deletes the book with the given hash from the library and the
+// disk, the returned error is meant for the user.
+func (b *bot) removeBook(h string) error {
+	p, ok, err := lib.Remove(h)
 	if err != nil {
-		log.Println("b.updateMeta", "json.MarshalIndent", err)
+		log.Println("b.removeBook", "lib.Remove", err)
 	}
-	if err := os.WriteFile(metaPath, j, 0644); err != nil {
-		log.Println("b.updateMeta", "os.WriteFile", err)
+	if !ok {
+		return errors.New("unknown hash")
 	}
-}
-
-func (b bot) refreshMeta() {
-	for h, p := range b.meta {
-		sum, err := md5sum(p)
-		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				delete(b.meta, h)
-			} else {
-				log.Println("b.refreshMeta", "md5sum", err)
-			}
-			continue
-		}
 
-		if sum != h {
-			delete(b.meta, h)
-			b.meta[sum] = p
-		}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("b.removeBook", "os.Remove", err)
+		return errors.New("an error occurred while deleting the file")
 	}
-	b.updateMeta()
+	return nil
 }
 
-func (b bot) sendMeta() {
-	var (
-		cnt int
-		buf strings.Builder
-	)
-
-	for h, p := range b.meta {
-		if cnt >= 10 {
-			_, err := b.SendMessage(buf.String(), b.chatID, mdopt)
-			if err != nil {
-				log.Println("b.sendMeta", "b.SendMessage", err)
-			}
-			buf.Reset()
-			cnt = 0
-		}
+// saveEbook stores the document in the library, the user is notified of the
+// failures.
+func (b *bot) saveEbook(doc *echotron.Document) storeResult {
+	if !isAllowedExt(filepath.Ext(doc.FileName)) && !isArchive(doc.FileName) {
+		b.send("Unsupported extension")
+		return storeFailed
+	}
 
-		buf.WriteString(fmt.Sprintf("*%s*\n`%s`\n\n", escapeMD(filepath.Base(p)), h))
-		cnt++
+	if limit := fileLimit(); doc.FileSize > limit {
+		b.send(fmt.Sprintf(
+			"Arr, the barrel be too heavy: %s, the bot can only fetch files up to %s.",
+			byteSize(doc.FileSize), byteSize(limit),
+		))
+		return storeFailed
 	}
 
-	_, err := b.SendMessage(buf.String(), b.chatID, mdopt)
+	tmp, err := b.downloadFile(doc.FileID)
 	if err != nil {
-		log.Println("b.sendMeta", "b.SendMessage", err)
+		log.Println("b.saveEbook", "b.downloadFile", err)
+		b.send("An error occurred while downloading the eBook.")
+		return storeFailed
 	}
+	return b.storeEbook(doc.FileName, tmp)
 }
 
 func md5sum(path string) (string, error) {
@@ -303,6 +378,7 @@ func md5sum(path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer f.Close()
 
 	if _, err := io.Copy(hash, f); err != nil {
 		return "", err
@@ -310,22 +386,6 @@ func md5sum(path string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func fsFromBytes(fname string, b []byte) (fs.FS, string, error) {
-	tmpf, err := os.CreateTemp("", fname)
-	if err != nil {
-		return nil, "", err
-	}
-
-	if _, err := tmpf.Write(b); err != nil {
-		return nil, "", err
-	}
-	if _, err := tmpf.Seek(0, io.SeekStart); err != nil {
-		return nil, "", err
-	}
-	reader, err := zip.NewReader(tmpf, int64(len(b)))
-	return reader, tmpf.Name(), err
-}
-
 func isAllowedExt(ext string) bool {
 	ext = strings.ToLower(ext)
 	for _, e := range supportedExts {
@@ -342,32 +402,62 @@ func kepubName(name string) string {
 	return name[:len(name)-len(ext)] + ".kepub.epub"
 }
 
-func loadMeta(path string) (m map[string]string) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return make(map[string]string)
+func main() {
+	var (
+		err                error
+		convert, reconvert bool
+	)
+
+	flag.StringVar(&cfgPath, "c", cfgPath, "Path of the config file")
+	flag.BoolVar(&convert, "convert", false, "Convert the EPUBs in the library to KEPUB and exit")
+	flag.BoolVar(&reconvert, "reconvert", false, "Like -convert, but convert the KEPUBs again too")
+	flag.Parse()
+
+	if cfg, err = LoadConfig(cfgPath); err != nil {
+		log.Fatalln(err)
+	}
+	if lib, err = LoadLibrary(metaPath); err != nil {
+		log.Fatalln(err)
+	}
+	cleanSpool()
+
+	if convert || reconvert {
+		if convertAll(cfg.Convert, reconvert) > 0 {
+			os.Exit(1)
 		}
-		log.Fatalln("loadMeta", "os.ReadFile", err)
+		return
 	}
 
-	if err := json.Unmarshal(b, &m); err != nil {
-		log.Fatalln("loadMeta", "json.Unmarshal", err)
+	if cfg.Mail.Listen != "" {
+		go func() {
+			log.Println(serveMail(cfg.Mail))
+		}()
 	}
-	return
-}
 
-func main() {
+	cfg.API().SetMyCommands(
+		nil,
+		echotron.BotCommand{Command: "/start", Description: "Start the chat with the bot"},
+		echotron.BotCommand{Command: "/invite", Description: "Ask an admin for access to the library"},
+		echotron.BotCommand{Command: "/approve", Description: "Approves an invite code with a role"},
+		echotron.BotCommand{Command: "/revoke", Description: "Revokes the access of a chat"},
+		echotron.BotCommand{Command: "/refresh", Description: "Refresh books' metadata"},
+		echotron.BotCommand{Command: "/list", Description: "Lists the eBooks"},
+		echotron.BotCommand{Command: "/search", Description: "Searches the eBooks by title or author"},
+		echotron.BotCommand{Command: "/delete", Description: "Deletes an eBook"},
+		echotron.BotCommand{Command: "/convert", Description: "Converts an eBook to KEPUB again"},
+		echotron.BotCommand{Command: "/settings", Description: "Shows or changes the KEPUB conversion settings"},
+	)
+
 	opts := echotron.UpdateOptions{
 		Timeout: 120,
 		AllowedUpdates: []echotron.UpdateType{
 			echotron.MessageUpdate,
+			echotron.CallbackQueryUpdate,
 		},
 	}
 
-	dsp = echotron.NewDispatcher(token, newBot)
 	for {
-		log.Println("dsp.PollOptions", dsp.PollOptions(false, opts))
+		log.Println(poll(opts))
 		time.Sleep(5 * time.Second)
 	}
 }
@@ -379,12 +469,5 @@ func init() {
 	}
 	home = h
 	metaPath = filepath.Join(home, "metadata.json")
-
-	echotron.NewAPI(token).SetMyCommands(
-		nil,
-		echotron.BotCommand{Command: "/start", Description: "Start the chat with the bot"},
-		echotron.BotCommand{Command: "/refresh", Description: "Refresh books' metadata"},
-		echotron.BotCommand{Command: "/metadata", Description: "Sends the eBooks' metadata"},
-		echotron.BotCommand{Command: "/delete", Description: "Deletes an eBook"},
-	)
+	cfgPath = filepath.Join(home, ".vessellotron.json")
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	mdHeadingRe = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdRuleRe    = regexp.MustCompile(`^\s{0,3}([-*_])(\s*([-*_])){2,}\s*$`)
+	mdULRe      = regexp.MustCompile(`^\s{0,3}[-*+]\s+(.*)$`)
+	mdOLRe      = regexp.MustCompile(`^\s{0,3}\d+[.)]\s+(.*)$`)
+	mdQuoteRe   = regexp.MustCompile(`^\s{0,3}>\s?(.*)$`)
+	mdFenceRe   = regexp.MustCompile("^\\s{0,3}(```|~~~)")
+
+	// Inline markup, matched on the escaped text.
+	mdCodeRe   = regexp.MustCompile("`([^`]+)`")
+	mdImageRe  = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLinkRe   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)[^)]*\)`)
+	mdStrongRe = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdEmRe     = regexp.MustCompile(`\*([^*\s][^*]*)\*|\b_([^_\s][^_]*)_\b`)
+)
+
+// markdownToHTML converts the common subset of Markdown used in books to
+// HTML: headings, paragraphs, lists, quotes, code, rules, emphasis and links.
+// Raw HTML is escaped and images are replaced by their alternative text, as
+// the book can't hold the files they point to.
+func markdownToHTML(src string) string {
+	var (
+		buf   strings.Builder
+		para  []string
+		list  string
+		quote []string
+		lines = strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	)
+
+	flushPara := func() {
+		if len(para) > 0 {
+			fmt.Fprintf(&buf, "<p>%s</p>\n", mdInline(strings.Join(para, " ")))
+			para = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			fmt.Fprintf(&buf, "</%s>\n", list)
+			list = ""
+		}
+	}
+	flushQuote := func() {
+		if len(quote) > 0 {
+			fmt.Fprintf(&buf, "<blockquote>\n%s</blockquote>\n", markdownToHTML(strings.Join(quote, "\n")))
+			quote = nil
+		}
+	}
+	flush := func() {
+		flushPara()
+		closeList()
+		flushQuote()
+	}
+	openList := func(tag string) {
+		flushPara()
+		flushQuote()
+		if list != tag {
+			closeList()
+			fmt.Fprintf(&buf, "<%s>\n", tag)
+			list = tag
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if m := mdFenceRe.FindStringSubmatch(line); m != nil {
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), m[1]); i++ {
+				code = append(code, lines[i])
+			}
+			fmt.Fprintf(&buf, "<pre><code>%s</code></pre>\n", html.EscapeString(strings.Join(code, "\n")))
+			continue
+		}
+
+		if m := mdQuoteRe.FindStringSubmatch(line); m != nil {
+			flushPara()
+			closeList()
+			quote = append(quote, m[1])
+			continue
+		}
+		flushQuote()
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			flushPara()
+			closeList()
+
+		case mdHeadingRe.MatchString(line):
+			flush()
+			m := mdHeadingRe.FindStringSubmatch(line)
+			fmt.Fprintf(&buf, "<h%[1]d>%[2]s</h%[1]d>\n", len(m[1]), mdInline(m[2]))
+
+		case mdRuleRe.MatchString(line):
+			flush()
+			buf.WriteString("<hr/>\n")
+
+		case mdULRe.MatchString(line):
+			openList("ul")
+			fmt.Fprintf(&buf, "<li>%s</li>\n", mdInline(mdULRe.FindStringSubmatch(line)[1]))
+
+		case mdOLRe.MatchString(line):
+			openList("ol")
+			fmt.Fprintf(&buf, "<li>%s</li>\n", mdInline(mdOLRe.FindStringSubmatch(line)[1]))
+
+		default:
+			closeList()
+			para = append(para, strings.TrimSpace(line))
+		}
+	}
+	flush()
+	return buf.String()
+}
+
+// mdInline converts the inline markup of s, leaving the code spans alone.
+func mdInline(s string) string {
+	var (
+		buf  strings.Builder
+		last int
+	)
+
+	inline := func(s string) string {
+		s = html.EscapeString(s)
+		s = mdImageRe.ReplaceAllString(s, "$1")
+		s = mdLinkRe.ReplaceAllString(s, `<a href="$2">$1</a>`)
+		s = mdStrongRe.ReplaceAllString(s, "<strong>$1$2</strong>")
+		return mdEmRe.ReplaceAllString(s, "<em>$1$2</em>")
+	}
+
+	for _, m := range mdCodeRe.FindAllStringSubmatchIndex(s, -1) {
+		buf.WriteString(inline(s[last:m[0]]))
+		fmt.Fprintf(&buf, "<code>%s</code>", html.EscapeString(s[m[2]:m[3]]))
+		last = m[1]
+	}
+	buf.WriteString(inline(s[last:]))
+	return buf.String()
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/NicoNex/echotron/v3"
+)
+
+// storeResult is the outcome of storeEbook.
+type storeResult int
+
+const (
+	storeFailed storeResult = iota
+	storeSaved
+	// The same book is already in the library.
+	storeSkipped
+	// The user has been asked what to do with a duplicate.
+	storeAsked
+	// The archive has been unpacked and the outcome of each book reported.
+	storeUnpacked
+)
+
+// storeMu serializes the moves into the library folder, since the uploads
+// of the chats and the emails arrive at once: looking for the same book, a
+// clashing name or title has to be done along with moving the book in.
+var storeMu sync.Mutex
+
+// upload is a book ready to be moved into the library.
+type upload struct {
+	// Name is the file name the book will have in the library.
+	Name string
+	Tmp  string
+	Hash string
+	Meta epubMeta
+	// Orig is the temporary file of the EPUB the book was converted from,
+	// when it's kept alongside the KEPUB, and OrigName its name.
+	Orig     string
+	OrigName string
+	// ConvErr is why the book couldn't be converted.
+	ConvErr error
+	// Fixes are the problems of the EPUB that have been repaired.
+	Fixes []string
+}
+
+// remove deletes the temporary files of the upload.
+func (up upload) remove() {
+	os.Remove(up.Tmp)
+	if up.Orig != "" {
+		os.Remove(up.Orig)
+	}
+}
+
+// conflicts are the books an upload clashes with.
+type conflicts struct {
+	// Path is the file with the same name, if any, which may not be in the
+	// library.
+	Path string
+	// Title are the books with the same title and authors.
+	Title []Book
+}
+
+func (c conflicts) empty() bool {
+	return c.Path == "" && len(c.Title) == 0
+}
+
+// storeEbook moves the book named name from the temporary file tmp into the
+// library, converting the EPUBs to KEPUB, or unpacks it if it's an archive.
+// If a book with the same name or title is already there the user is asked
+// whether to replace it, keep both or skip the new one.
+// The user is notified of the failures.
+func (b *bot) storeEbook(name, tmp string) storeResult {
+	if isArchive(name) {
+		return b.storeArchive(name, tmp)
+	}
+
+	res, stored, err := b.ingest(name, tmp)
+	switch res {
+	case storeFailed:
+		var broken epubError
+		if errors.As(err, &broken) {
+			b.send(fmt.Sprintf("Arr, %s be beyond repair, %v.", name, broken))
+			break
+		}
+		log.Println("b.storeEbook", err)
+		b.send("An error occurred while saving the file.")
+	case storeSkipped:
+		b.send(fmt.Sprintf("This barrel already be aboard as %s.", stored))
+	}
+	return res
+}
+
+// ingest is like storeEbook but leaves reporting the outcome to the caller,
+// except for the questions on duplicates.
+// It returns the name of the book in the library, or of the identical one
+// already there.
+func (b *bot) ingest(name, tmp string) (storeResult, string, error) {
+	up, err := prepare(name, tmp, cfg.ConvertOptions(b.chatID))
+	if err != nil {
+		return storeFailed, "", fmt.Errorf("b.ingest: %w", err)
+	}
+	if len(up.Fixes) > 0 {
+		b.send(fmt.Sprintf("Repaired %s: %s.", up.Name, strings.Join(up.Fixes, "; ")))
+	}
+	if up.ConvErr != nil {
+		log.Println("b.ingest", up.ConvErr)
+		msg := fmt.Sprintf("Couldn't convert %s, it'll be stowed as it is.", up.Name)
+		if errors.Is(up.ConvErr, errBadCBR) {
+			msg = fmt.Sprintf("%s can't be repacked as CBZ: %v.", up.Name, errBadCBR)
+		}
+		b.send(msg)
+	}
+
+	same, c, err := stow(up)
+	switch {
+	case same.Path != "":
+		up.remove()
+		return storeSkipped, filepath.Base(same.Path), nil
+	case !c.empty():
+		b.askDuplicate(up, c)
+		return storeAsked, up.Name, nil
+	case err != nil:
+		up.remove()
+		return storeFailed, "", fmt.Errorf("b.ingest: %w", err)
+	}
+	return storeSaved, up.Name, nil
+}
+
+// stow moves the upload into the library under its name, unless the same
+// book is already there, returned as same, or it clashes with other books,
+// returned as c. No other upload can slip in between the checks and the
+// move.
+func stow(up upload) (same Book, c conflicts, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	if same, ok := lib.Get(up.Hash); ok {
+		return same, c, nil
+	}
+	if c = findConflicts(up); !c.empty() {
+		return same, c, nil
+	}
+	if err := commit(up, filepath.Join(home, up.Name)); err != nil {
+		return same, c, fmt.Errorf("stow: %w", err)
+	}
+	return same, c, nil
+}
+
+// stowRenamed is like stow but gives the upload a numbered name when its own
+// is taken, and returns where it's been moved to.
+func stowRenamed(up upload) (same Book, dest string, err error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	if same, ok := lib.Get(up.Hash); ok {
+		return same, "", nil
+	}
+	dest = uniquePath(filepath.Join(home, up.Name))
+	if err := commit(up, dest); err != nil {
+		return same, "", fmt.Errorf("stowRenamed: %w", err)
+	}
+	return same, dest, nil
+}
+
+// prepare converts the book to a format the Kobo renders better, the EPUBs
+// to KEPUB with opts, and hashes it. tmp is replaced by the converted file
+// unless the original is kept.
+// A failed conversion is reported in ConvErr and leaves the book as it is.
+func prepare(name, tmp string, opts ConvertOptions) (upload, error) {
+	up := upload{Name: filepath.Base(name), Tmp: tmp}
+
+	if conv, out, err := convertFormat(up.Name, tmp); err != nil {
+		up.ConvErr = fmt.Errorf("prepare: %w", err)
+	} else if out != "" {
+		up.Name, up.Tmp = conv, out
+	}
+
+	if isEPUB(up.Name) {
+		fixed, fixes, err := repairEPUB(up.Tmp)
+		if err != nil {
+			up.remove()
+			if up.Tmp != tmp {
+				os.Remove(tmp)
+			}
+			return up, fmt.Errorf("prepare: %w", err)
+		}
+		if fixed != "" {
+			if err := os.Rename(fixed, up.Tmp); err != nil {
+				os.Remove(fixed)
+				log.Println("prepare", "os.Rename", err)
+			} else {
+				up.Fixes = fixes
+			}
+		}
+
+		if !isKepub(up.Name) {
+			if conv, err := kepubify(up.Tmp, opts); err != nil {
+				up.ConvErr = fmt.Errorf("prepare: %w", err)
+			} else {
+				// An EPUB made from another format.
+				if up.Tmp != tmp {
+					os.Remove(up.Tmp)
+				}
+				up.Name, up.Tmp = kepubName(up.Name), conv
+			}
+		}
+
+		meta, err := readEPUBMeta(up.Tmp)
+		if err != nil {
+			log.Println("prepare", err)
+		}
+		up.Meta = meta
+	}
+
+	if up.Tmp != tmp {
+		if opts.KeepOriginal {
+			up.Orig, up.OrigName = tmp, filepath.Base(name)
+		} else {
+			os.Remove(tmp)
+		}
+	}
+
+	sum, err := md5sum(up.Tmp)
+	if err != nil {
+		up.remove()
+		return up, fmt.Errorf("prepare: md5sum: %w", err)
+	}
+	up.Hash = sum
+	return up, nil
+}
+
+// kepubify converts the EPUB at src with opts into a temporary KEPUB file
+// next to the library and returns its path.
+func kepubify(src string, opts ConvertOptions) (string, error) {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return "", fmt.Errorf("kepubify: zip.OpenReader: %w", err)
+	}
+	defer zr.Close()
+
+	f, err := os.CreateTemp(home, ".vessellotron-*")
+	if err != nil {
+		return "", fmt.Errorf("kepubify: os.CreateTemp: %w", err)
+	}
+	defer f.Close()
+
+	if err := opts.converter().Convert(context.Background(), f, zr); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("kepubify: conv.Convert: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// commit moves the upload to dest and adds it to the library, along with
+// the original EPUB if it's kept.
+// The caller holds storeMu.
+func commit(up upload, dest string) error {
+	if err := move(up.Tmp, dest, up.Hash); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	if up.Orig == "" {
+		return nil
+	}
+
+	sum, err := md5sum(up.Orig)
+	if err != nil {
+		return fmt.Errorf("commit: md5sum: %w", err)
+	}
+	if _, ok := lib.Get(sum); ok {
+		os.Remove(up.Orig)
+		return nil
+	}
+	orig := uniquePath(filepath.Join(filepath.Dir(dest), up.OrigName))
+	if err := move(up.Orig, orig, sum); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// move renames the temporary file tmp to dest and adds it to the library
+// with the given hash.
+func move(tmp, dest, hash string) error {
+	if err := os.Rename(tmp, dest); err != nil {
+		return fmt.Errorf("move: os.Rename: %w", err)
+	}
+	if err := os.Chmod(dest, 0644); err != nil {
+		log.Println("move", "os.Chmod", err)
+	}
+	if err := lib.Add(hash, dest); err != nil {
+		return fmt.Errorf("move: %w", err)
+	}
+	return nil
+}
+
+// findConflicts returns the books in the way of the upload.
+func findConflicts(up upload) conflicts {
+	var c conflicts
+
+	if p := filepath.Join(home, up.Name); exists(p) {
+		c.Path = p
+	}
+	if up.Meta.Title != "" {
+		for _, bk := range lib.FindTitle(up.Meta.Title, strings.Join(up.Meta.Authors, ", ")) {
+			if bk.Path != c.Path {
+				c.Title = append(c.Title, bk)
+			}
+		}
+	}
+	return c
+}
+
+// askDuplicate keeps the upload aside and asks the user what to do with it.
+func (b *bot) askDuplicate(up upload, c conflicts) {
+	var buf strings.Builder
+
+	if c.Path != "" {
+		fmt.Fprintf(&buf, "A barrel named *%s* already be aboard\\.\n", escapeMD(up.Name))
+	}
+	for _, bk := range c.Title {
+		fmt.Fprintf(&buf, "*%s* already be aboard as `%s`\\.\n", escapeMD(bk.Name()), escapeCode(filepath.Base(bk.Path)))
+	}
+	buf.WriteString("\nWhat shall we do with the new one?")
+
+	b.mu.Lock()
+	b.nextID++
+	id := b.nextID
+	b.pending[id] = pendingUpload{up, c}
+	b.mu.Unlock()
+
+	kbd := echotron.InlineKeyboardMarkup{
+		InlineKeyboard: [][]echotron.InlineKeyboardButton{{
+			{Text: "Replace", CallbackData: fmt.Sprintf("dup:replace:%d", id)},
+			{Text: "Keep both", CallbackData: fmt.Sprintf("dup:keep:%d", id)},
+			{Text: "Skip", CallbackData: fmt.Sprintf("dup:skip:%d", id)},
+		}},
+	}
+	_, err := b.SendMessage(buf.String(), b.chatID, &echotron.MessageOptions{
+		ParseMode:   echotron.MarkdownV2,
+		ReplyMarkup: kbd,
+	})
+	if err != nil {
+		log.Println("b.askDuplicate", "b.SendMessage", err)
+	}
+}
+
+type pendingUpload struct {
+	upload
+	conflicts
+}
+
+// resolveDuplicate applies the choice of the user for the pending upload
+// with the given ID and returns the outcome.
+func (b *bot) resolveDuplicate(choice string, id int) string {
+	b.mu.Lock()
+	p, ok := b.pending[id]
+	delete(b.pending, id)
+	b.mu.Unlock()
+
+	if !ok {
+		return "This barrel has already been dealt with."
+	}
+	if choice != "replace" && choice != "keep" {
+		p.remove()
+		return "Skipped " + p.Name
+	}
+
+	// Other books may have come aboard while the user was choosing.
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if same, ok := lib.Get(p.Hash); ok {
+		p.remove()
+		return "This barrel already be aboard as " + filepath.Base(same.Path) + "."
+	}
+
+	if choice == "replace" {
+		if p.Path != "" {
+			b.discard(p.Path)
+		}
+		for _, bk := range p.Title {
+			b.discard(bk.Path)
+		}
+	}
+	dest := uniquePath(filepath.Join(home, p.Name))
+
+	if err := commit(p.upload, dest); err != nil {
+		log.Println("b.resolveDuplicate", err)
+		p.remove()
+		return "An error occurred while saving the file."
+	}
+	return "Thanks matey! " + filepath.Base(dest) + " be aboard."
+}
+
+// discard removes the file at path and its book from the library.
+func (b *bot) discard(path string) {
+	if hash, ok := lib.HashOf(path); ok {
+		if err := b.removeBook(hash); err != nil {
+			log.Println("b.discard", "b.removeBook", err)
+		}
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Println("b.discard", "os.Remove", err)
+	}
+}
+
+// uniquePath appends a number to the file name in path until it doesn't
+// name any existing file, e.g. "book (2).epub".
+func uniquePath(path string) string {
+	dir, base := filepath.Split(path)
+	ext := bookExt(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	for i := 2; exists(path); i++ {
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+	}
+	return path
+}
+
+func isEPUB(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".epub")
+}
+
+func isKepub(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".kepub.epub")
+}
+
+// bookExt is like filepath.Ext but treats ".kepub.epub" as a single extension.
+func bookExt(name string) string {
+	if isKepub(name) {
+		return name[len(name)-len(".kepub.epub"):]
+	}
+	return filepath.Ext(name)
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
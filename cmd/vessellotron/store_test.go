@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newUpload spools content as if it had just been uploaded.
+func newUpload(t *testing.T, content string) string {
+	t.Helper()
+
+	tmp, err := spool(strings.NewReader(content), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmp
+}
+
+func TestPrepare(t *testing.T) {
+	dir := withHome(t)
+	newLibrary(t, nil)
+
+	src := filepath.Join(dir, "src.epub")
+	writeEPUB(t, src, "Dune", "Frank Herbert")
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up, err := prepare("Dune.epub", newUpload(t, string(data)), defaultConvert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.Name != "Dune.kepub.epub" {
+		t.Errorf("Name = %q, want Dune.kepub.epub", up.Name)
+	}
+	if up.Meta.Title != "Dune" || strings.Join(up.Meta.Authors, ",") != "Frank Herbert" {
+		t.Errorf("Meta = %+v", up.Meta)
+	}
+	if sum, err := md5sum(up.Tmp); err != nil || sum != up.Hash {
+		t.Errorf("Hash = %s, the file hashes to %s (%v)", up.Hash, sum, err)
+	}
+	// Only the converted file is left besides the source.
+	if tmps, _ := filepath.Glob(filepath.Join(dir, ".vessellotron-*")); len(tmps) != 1 {
+		t.Errorf("temporary files = %q, want 1", tmps)
+	}
+}
+
+func TestFindConflicts(t *testing.T) {
+	dir := withHome(t)
+	newLibrary(t, nil)
+
+	for name, meta := range map[string][2]string{
+		"dune.kepub.epub": {"Dune", "Frank Herbert"},
+		"other.epub":      {"DUNE", ""},
+		"messiah.epub":    {"Dune Messiah", "Frank Herbert"},
+		"fake.epub":       {"Dune", "Brian Herbert"},
+	} {
+		p := filepath.Join(dir, name)
+		writeEPUB(t, p, meta[0], meta[1])
+		if err := commit(upload{Tmp: p, Hash: name}, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	up := upload{Name: "dune.kepub.epub", Meta: epubMeta{Title: "Dune", Authors: []string{"Frank Herbert"}}}
+	c := findConflicts(up)
+	if c.Path != filepath.Join(dir, "dune.kepub.epub") {
+		t.Errorf("Path = %q", c.Path)
+	}
+	if len(c.Title) != 1 || filepath.Base(c.Title[0].Path) != "other.epub" {
+		t.Errorf("Title = %+v, want only other.epub", c.Title)
+	}
+
+	if c := findConflicts(upload{Name: "new.pdf"}); !c.empty() {
+		t.Errorf("unexpected conflicts for a new book: %+v", c)
+	}
+}
+
+func TestResolveDuplicate(t *testing.T) {
+	dir := withHome(t)
+
+	tests := []struct {
+		choice string
+		want   map[string]string
+	}{
+		{"replace", map[string]string{"book.pdf": "new"}},
+		{"keep", map[string]string{"book.pdf": "old", "book (2).pdf": "new"}},
+		{"skip", map[string]string{"book.pdf": "old"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.choice, func(t *testing.T) {
+			l := newLibrary(t, nil)
+			for _, e := range must(os.ReadDir(dir)) {
+				os.Remove(filepath.Join(dir, e.Name()))
+			}
+
+			old := filepath.Join(dir, "book.pdf")
+			if err := os.WriteFile(old, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := l.Add(must(md5sum(old)), old); err != nil {
+				t.Fatal(err)
+			}
+
+			up, err := prepare("book.pdf", newUpload(t, "new"), defaultConvert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := &bot{pending: map[int]pendingUpload{1: {up, findConflicts(up)}}}
+			b.resolveDuplicate(tt.choice, 1)
+
+			var files []string
+			for _, e := range must(os.ReadDir(dir)) {
+				if !strings.HasPrefix(e.Name(), ".") && e.Name() != "metadata.json" {
+					files = append(files, e.Name())
+				}
+			}
+			if len(files) != len(tt.want) {
+				t.Errorf("files = %q, want %v", files, tt.want)
+			}
+			for name, content := range tt.want {
+				if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != content {
+					t.Errorf("%s = %q, %v, want %q", name, b, err, content)
+				}
+			}
+			if n := len(l.Books()); n != len(tt.want) {
+				t.Errorf("the library has %d books, want %d", n, len(tt.want))
+			}
+			if tmps, _ := filepath.Glob(filepath.Join(dir, ".vessellotron-*")); len(tmps) != 0 {
+				t.Errorf("temporary files left: %q", tmps)
+			}
+
+			if msg := b.resolveDuplicate(tt.choice, 1); !strings.Contains(msg, "already") {
+				t.Errorf("resolving twice = %q", msg)
+			}
+		})
+	}
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func TestStowConcurrent(t *testing.T) {
+	dir := withHome(t)
+	l := newLibrary(t, nil)
+
+	const n = 8
+	var (
+		ups     = make([]upload, 2*n)
+		clashes = make([]conflicts, 2*n)
+		sames   = make([]Book, 2*n)
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < n; i++ {
+		// Different books with the same name and the same book with
+		// different names.
+		ups[i] = must(prepare("book.pdf", newUpload(t, fmt.Sprint("book ", i)), defaultConvert))
+		ups[n+i] = must(prepare(fmt.Sprintf("copy %d.pdf", i), newUpload(t, "the copy"), defaultConvert))
+	}
+	start := make(chan struct{})
+	for i, up := range ups {
+		wg.Add(1)
+		go func(i int, up upload) {
+			defer wg.Done()
+			<-start
+			var err error
+			if sames[i], clashes[i], err = stow(up); err != nil {
+				t.Error(err)
+			}
+		}(i, up)
+	}
+	close(start)
+	wg.Wait()
+
+	var stowed, clashed, skipped int
+	for i := range ups {
+		switch {
+		case sames[i].Path != "":
+			skipped++
+		case !clashes[i].empty():
+			clashed++
+		default:
+			stowed++
+		}
+	}
+	if stowed != 2 || clashed != n-1 || skipped != n-1 {
+		t.Errorf("%d stowed, %d clashing and %d skipped, want 2, %d and %d", stowed, clashed, skipped, n-1, n-1)
+	}
+	if got := len(l.Books()); got != 2 {
+		t.Errorf("the library has %d books, want 2", got)
+	}
+
+	// Keeping all the clashing ones gives each its own name.
+	b := &bot{pending: make(map[int]pendingUpload)}
+	for i := 0; i < n; i++ {
+		if !clashes[i].empty() {
+			b.pending[i] = pendingUpload{ups[i], clashes[i]}
+		}
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			b.resolveDuplicate("keep", id)
+		}(i)
+	}
+	wg.Wait()
+
+	books, _ := filepath.Glob(filepath.Join(dir, "book*.pdf"))
+	if len(books) != n || len(l.Books()) != n+1 {
+		t.Errorf("files = %q and %d books, want %d and %d", books, len(l.Books()), n, n+1)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/NicoNex/echotron/v3"
+)
+
+const (
+	// Biggest file bots can download from the cloud Bot API.
+	cloudFileLimit = 20 << 20
+	// Biggest file a local Bot API server handles.
+	localFileLimit = 2000 << 20
+	// How long a chat can stay silent before its session is dropped.
+	sessionTTL = time.Hour
+)
+
+// fileClient downloads the files from the Bot API server, which can be a
+// local one, so unlike httpClient it reaches any address.
+var fileClient = &http.Client{Timeout: downloadTimeout}
+
+// fileLimit returns the size of the biggest file the bot can download from
+// Telegram.
+func fileLimit() int64 {
+	if cfg.APIURL != "" {
+		return localFileLimit
+	}
+	return cloudFileLimit
+}
+
+// spool copies r into a temporary file next to the library, failing if it
+// exceeds limit bytes, and returns its path.
+func spool(r io.Reader, limit int64) (string, error) {
+	f, err := os.CreateTemp(home, ".vessellotron-*")
+	if err != nil {
+		return "", fmt.Errorf("spool: os.CreateTemp: %w", err)
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, io.LimitReader(r, limit+1))
+	if err == nil && n > limit {
+		err = errTooBig
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("spool: io.Copy: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// cleanSpool removes the temporary files left by a previous run, e.g. the
+// uploads still waiting for a choice on duplicates.
+func cleanSpool() {
+	tmps, err := filepath.Glob(filepath.Join(home, ".vessellotron-*"))
+	if err != nil {
+		log.Println("cleanSpool", "filepath.Glob", err)
+		return
+	}
+	for _, p := range tmps {
+		if err := os.Remove(p); err != nil {
+			log.Println("cleanSpool", "os.Remove", err)
+		}
+	}
+}
+
+// downloadFile streams the Telegram file with the given ID to a temporary
+// file and returns its path.
+func (b *bot) downloadFile(fileID string) (string, error) {
+	res, err := b.GetFile(fileID)
+	if err != nil {
+		return "", fmt.Errorf("b.downloadFile: b.GetFile: %w", err)
+	}
+	if res.Result == nil {
+		return "", fmt.Errorf("b.downloadFile: b.GetFile: %s", res.Description)
+	}
+
+	// A local Bot API server started with --local returns the path of the
+	// file on its disk.
+	if p := res.Result.FilePath; filepath.IsAbs(p) {
+		f, err := os.Open(p)
+		if err != nil {
+			return "", fmt.Errorf("b.downloadFile: os.Open: %w", err)
+		}
+		defer f.Close()
+		return spool(f, fileLimit())
+	}
+
+	// The URL holds the bot token, keep it out of the errors and the logs.
+	req, err := http.NewRequest(http.MethodGet, cfg.fileURL(res.Result.FilePath), nil)
+	if err != nil {
+		return "", fmt.Errorf("b.downloadFile: http.NewRequest: %w", redactURL(err, res.Result.FilePath))
+	}
+	resp, err := fileClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("b.downloadFile: fileClient.Do: %w", redactURL(err, res.Result.FilePath))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("b.downloadFile: %s", resp.Status)
+	}
+	return spool(resp.Body, fileLimit())
+}
+
+// redactURL replaces the URL in err, if it's a *url.Error, with the path of
+// the file alone.
+func redactURL(err error, path string) error {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		uerr.URL = path
+	}
+	return err
+}
+
+// session is the bot of a chat and when it got its last update.
+type session struct {
+	bot  echotron.Bot
+	last time.Time
+}
+
+// pruneSessions drops the sessions silent for longer than sessionTTL,
+// unless they hold uploads still waiting for a choice.
+func pruneSessions(sessions map[int64]*session, now time.Time) {
+	for id, s := range sessions {
+		if now.Sub(s.last) < sessionTTL {
+			continue
+		}
+		if b, ok := s.bot.(interface{ busy() bool }); ok && b.busy() {
+			continue
+		}
+		delete(sessions, id)
+	}
+}
+
+// poll hands the updates received from the Bot API server in use to the
+// session of their chat, like echotron.Dispatcher which only talks to the
+// cloud one.
+func poll(opts echotron.UpdateOptions) error {
+	var (
+		api      = cfg.API()
+		sessions = make(map[int64]*session)
+	)
+
+	if _, err := api.DeleteWebhook(false); err != nil {
+		return fmt.Errorf("poll: api.DeleteWebhook: %w", err)
+	}
+
+	for {
+		res, err := api.GetUpdates(&opts)
+		if err != nil {
+			return fmt.Errorf("poll: api.GetUpdates: %w", err)
+		}
+
+		now := time.Now()
+		for _, u := range res.Result {
+			opts.Offset = u.ID + 1
+
+			id := u.ChatID()
+			s, ok := sessions[id]
+			if !ok {
+				s = &session{bot: newBot(id)}
+				sessions[id] = s
+			}
+			s.last = now
+			go s.bot.Update(u)
+		}
+		pruneSessions(sessions, now)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadFile(t *testing.T) {
+	const token = "123:secret"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bot"+token+"/getFile", func(w http.ResponseWriter, r *http.Request) {
+		path := "documents/book.epub"
+		if r.FormValue("file_id") == "broken" {
+			path = "documents/broken.epub"
+		}
+		w.Write([]byte(`{"ok": true, "result": {"file_id": "x", "file_path": "` + path + `"}}`))
+	})
+	mux.HandleFunc("/file/bot"+token+"/documents/book.epub", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not really an epub"))
+	})
+	mux.HandleFunc("/file/bot"+token+"/documents/broken.epub", func(w http.ResponseWriter, r *http.Request) {
+		// Drop the connection to make the request fail.
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	withHome(t)
+
+	saved := cfg
+	cfg = &Config{Token: token, APIURL: srv.URL}
+	t.Cleanup(func() { cfg = saved })
+	b := &bot{API: cfg.API()}
+
+	tmp, err := b.downloadFile("book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(tmp); err != nil || string(data) != "not really an epub" {
+		t.Errorf("downloadFile() = %q, %v", data, err)
+	}
+
+	_, err = b.downloadFile("broken")
+	if err == nil {
+		t.Fatal("downloadFile() succeeded with the connection dropped")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("downloadFile() error = %v leaks the token", err)
+	}
+}
+
+func TestPruneSessions(t *testing.T) {
+	var (
+		now  = time.Now()
+		busy = &bot{pending: map[int]pendingUpload{1: {}}}
+	)
+
+	sessions := map[int64]*session{
+		1: {bot: &bot{pending: make(map[int]pendingUpload)}, last: now},
+		2: {bot: &bot{pending: make(map[int]pendingUpload)}, last: now.Add(-sessionTTL)},
+		3: {bot: busy, last: now.Add(-sessionTTL)},
+	}
+	pruneSessions(sessions, now)
+	if len(sessions) != 2 || sessions[1] == nil || sessions[3] == nil {
+		t.Errorf("sessions = %v, want the recent and the busy one", sessions)
+	}
+
+	// The session goes once the user has chosen.
+	busy.pending = make(map[int]pendingUpload)
+	pruneSessions(sessions, now.Add(sessionTTL))
+	if len(sessions) != 0 {
+		t.Errorf("sessions = %v, want none", sessions)
+	}
+}
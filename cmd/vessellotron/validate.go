@@ -0,0 +1,460 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+var (
+	// An ampersand and what follows it, if it's a valid reference.
+	entityRe   = regexp.MustCompile(`&(#[0-9]+;|#[xX][0-9a-fA-F]+;|[A-Za-z][A-Za-z0-9]*;)?`)
+	xmlDeclRe  = regexp.MustCompile(`^\s*<\?xml[^>]*\?>`)
+	encodingRe = regexp.MustCompile(`encoding\s*=\s*["']([^"']*)["']`)
+	// The tags match their whole line, so removing them leaves no blank one.
+	itemRe      = regexp.MustCompile(`[ \t]*<(?:\w+:)?item\b[^>]*?(?:/>|>\s*</(?:\w+:)?item>)[ \t]*\r?\n?`)
+	itemrefRe   = regexp.MustCompile(`[ \t]*<(?:\w+:)?itemref\b[^>]*?(?:/>|>\s*</(?:\w+:)?itemref>)[ \t]*\r?\n?`)
+	languageRe  = regexp.MustCompile(`<(?:\w+:)?language\b[^>]*>\s*[^<\s]`)
+	metadataEnd = regexp.MustCompile(`</(?:\w+:)?metadata>`)
+	attrRes     = map[string]*regexp.Regexp{
+		"id":    regexp.MustCompile(`\sid\s*=\s*(?:"([^"]*)"|'([^']*)')`),
+		"idref": regexp.MustCompile(`\sidref\s*=\s*(?:"([^"]*)"|'([^']*)')`),
+		"href":  regexp.MustCompile(`\shref\s*=\s*(?:"([^"]*)"|'([^']*)')`),
+	}
+	// What XML leaves as it is, the entities aren't parsed in there.
+	verbatimRe = regexp.MustCompile(`(?s)<!\[CDATA\[.*?\]\]>|<!--.*?-->`)
+
+	// Biggest XML file of an EPUB that's read to be checked and repaired.
+	maxXMLSize uint64 = 32 << 20
+
+	errXMLTooBig = errors.New("the file is too big to be checked")
+
+	// The XML files of the EPUBs that are checked and repaired.
+	xmlExts = map[string]bool{
+		".opf":   true,
+		".ncx":   true,
+		".xhtml": true,
+		".html":  true,
+		".htm":   true,
+		".xml":   true,
+	}
+)
+
+// epubError is why an EPUB can't be repaired, meant for the user.
+type epubError string
+
+func (e epubError) Error() string {
+	return "broken EPUB: " + string(e)
+}
+
+// repairEPUB checks the structure of the EPUB at fpath and fixes the common
+// problems: a misplaced or wrong mimetype, a missing container.xml, XML
+// files not in UTF-8 or using HTML entities, manifest items missing from
+// the archive and a missing language.
+// It returns the repaired EPUB in a temporary file and the fixes applied, or
+// an empty path if it's fine as it is.
+func repairEPUB(fpath string) (string, []string, error) {
+	zr, err := zip.OpenReader(fpath)
+	if err != nil {
+		return "", nil, fmt.Errorf("repairEPUB: %w", epubError("it isn't a ZIP archive"))
+	}
+	defer zr.Close()
+	if len(zr.File) == 0 {
+		return "", nil, fmt.Errorf("repairEPUB: %w", epubError("the archive is empty"))
+	}
+
+	var (
+		fixes   []string
+		files   = make(map[string]*zip.File)
+		changed = make(map[string][]byte)
+	)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	if mt, err := readZipFile(files["mimetype"]); err != nil ||
+		zr.File[0].Name != "mimetype" ||
+		zr.File[0].Method != zip.Store ||
+		string(mt) != "application/epub+zip" {
+		fixes = append(fixes, "rewrote the mimetype")
+	}
+
+	opf, err := opfPath(&zr.Reader)
+	if err != nil || files[opf] == nil {
+		if opf = findOPF(zr.File); opf == "" {
+			return "", nil, fmt.Errorf("repairEPUB: %w", epubError("there's no OPF package document"))
+		}
+		changed["META-INF/container.xml"] = []byte(fmt.Sprintf(containerXML, opf))
+		fixes = append(fixes, "rebuilt container.xml")
+	}
+
+	var encoded, entities int
+	for _, f := range zr.File {
+		if !xmlExts[strings.ToLower(path.Ext(f.Name))] || changed[f.Name] != nil {
+			continue
+		}
+		b, err := readZipFile(f)
+		if errors.Is(err, errXMLTooBig) {
+			continue
+		} else if err != nil {
+			return "", nil, fmt.Errorf("repairEPUB: %w", epubError(fmt.Sprintf("%s can't be read", f.Name)))
+		}
+
+		fixed, utf, n := fixXML(b)
+		if utf {
+			encoded++
+		}
+		entities += n
+		if utf || n > 0 {
+			changed[f.Name] = fixed
+		}
+	}
+	if encoded > 0 {
+		fixes = append(fixes, fmt.Sprintf("converted %d files to UTF-8", encoded))
+	}
+	if entities > 0 {
+		fixes = append(fixes, fmt.Sprintf("fixed %d broken XML entities", entities))
+	}
+
+	pkg := changed[opf]
+	if pkg == nil {
+		if pkg, err = readZipFile(files[opf]); err != nil {
+			return "", nil, fmt.Errorf("repairEPUB: %w", epubError("the OPF can't be read"))
+		}
+	}
+	pkg, opfFixes, err := fixOPF(pkg, path.Dir(opf), files)
+	if err != nil {
+		return "", nil, fmt.Errorf("repairEPUB: %w", err)
+	}
+	if len(opfFixes) > 0 {
+		changed[opf] = pkg
+		fixes = append(fixes, opfFixes...)
+	}
+	if err := checkXML(pkg); err != nil {
+		return "", nil, fmt.Errorf("repairEPUB: %w", epubError("the OPF isn't valid XML: "+err.Error()))
+	}
+
+	if len(fixes) == 0 {
+		return "", nil, nil
+	}
+	tmp, err := rewriteEPUB(zr.File, changed)
+	if err != nil {
+		return "", nil, fmt.Errorf("repairEPUB: %w", err)
+	}
+	return tmp, fixes, nil
+}
+
+const containerXML = `<?xml version="1.0" encoding="utf-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="%s" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+// readZipFile reads the file of the archive, up to maxXMLSize bytes and no
+// more than its header declares.
+func readZipFile(f *zip.File) ([]byte, error) {
+	if f == nil {
+		return nil, os.ErrNotExist
+	}
+	if f.UncompressedSize64 > maxXMLSize {
+		return nil, errXMLTooBig
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(io.LimitReader(r, int64(f.UncompressedSize64)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(b)) > f.UncompressedSize64 {
+		return nil, errXMLTooBig
+	}
+	return b, nil
+}
+
+// findOPF returns the first OPF file in the archive by name.
+func findOPF(files []*zip.File) string {
+	var opfs []string
+	for _, f := range files {
+		if strings.EqualFold(path.Ext(f.Name), ".opf") {
+			opfs = append(opfs, f.Name)
+		}
+	}
+	sort.Strings(opfs)
+	if len(opfs) == 0 {
+		return ""
+	}
+	return opfs[0]
+}
+
+// fixXML converts the XML document b to UTF-8 if it's in UTF-16, in the
+// encoding it declares or, failing that, not valid UTF-8, taken as Latin-1.
+// Outside of the CDATA sections and the comments, it replaces the HTML
+// entities XML doesn't know with numeric references and the bare ampersands
+// with &amp;.
+// It returns the new document, whether it's been converted and the number
+// of entities fixed.
+func fixXML(b []byte) ([]byte, bool, int) {
+	var utf bool
+
+	if order, ok := utf16Order(b); ok {
+		b, utf = transcode(b, unicode.UTF16(order, unicode.UseBOM)), true
+	} else if enc := declaredEncoding(b); enc != nil && !utf8.Valid(b) {
+		b, utf = transcode(b, enc), true
+	} else if enc != nil || !utf8.Valid(b) {
+		// Already in UTF-8 despite the declaration, or in an unknown
+		// encoding.
+		b, utf = []byte(decodeText(b)), true
+	}
+	if utf {
+		b = xmlDeclRe.ReplaceAll(b, []byte(`<?xml version="1.0" encoding="utf-8"?>`))
+	}
+
+	var (
+		out   []byte
+		fixed int
+		last  int
+	)
+	for _, loc := range verbatimRe.FindAllIndex(b, -1) {
+		out = append(out, fixEntities(b[last:loc[0]], &fixed)...)
+		out = append(out, b[loc[0]:loc[1]]...)
+		last = loc[1]
+	}
+	out = append(out, fixEntities(b[last:], &fixed)...)
+	return out, utf, fixed
+}
+
+// fixEntities replaces the HTML entities in the XML text b with numeric
+// references and the bare ampersands with &amp;, adding their number to
+// fixed.
+func fixEntities(b []byte, fixed *int) []byte {
+	return entityRe.ReplaceAllFunc(b, func(ref []byte) []byte {
+		switch s := string(ref); {
+		case s == "&":
+			*fixed++
+			return []byte("&amp;")
+		case s[1] == '#', s == "&amp;", s == "&lt;", s == "&gt;", s == "&quot;", s == "&apos;":
+			return ref
+		default:
+			r := html.UnescapeString(s)
+			*fixed++
+			if r == s {
+				// Unknown, it was meant as text.
+				return []byte("&amp;" + s[1:])
+			}
+			var buf bytes.Buffer
+			for _, c := range r {
+				fmt.Fprintf(&buf, "&#%d;", c)
+			}
+			return buf.Bytes()
+		}
+	})
+}
+
+// utf16Order reports whether the XML document b is in UTF-16, by its byte
+// order mark or by the way its declaration starts, and its byte order.
+func utf16Order(b []byte) (unicode.Endianness, bool) {
+	switch {
+	case bytes.HasPrefix(b, []byte("\xff\xfe")), bytes.HasPrefix(b, []byte("<\x00?\x00")):
+		return unicode.LittleEndian, true
+	case bytes.HasPrefix(b, []byte("\xfe\xff")), bytes.HasPrefix(b, []byte("\x00<\x00?")):
+		return unicode.BigEndian, true
+	}
+	return unicode.LittleEndian, false
+}
+
+// declaredEncoding returns the encoding declared by the XML document b, nil
+// if it's UTF-8 or unknown.
+func declaredEncoding(b []byte) encoding.Encoding {
+	m := encodingRe.FindSubmatch(xmlDeclRe.Find(b))
+	if m == nil {
+		return nil
+	}
+	// A declaration that can be read isn't in UTF-16.
+	label := strings.ToLower(strings.TrimSpace(string(m[1])))
+	if strings.HasPrefix(label, "utf-16") {
+		return nil
+	}
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return nil
+	}
+	if name, _ := htmlindex.Name(enc); name == "utf-8" {
+		return nil
+	}
+	return enc
+}
+
+// transcode converts b from enc to UTF-8, taking it as Latin-1 if it can't.
+func transcode(b []byte, enc encoding.Encoding) []byte {
+	d, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		return []byte(decodeText(b))
+	}
+	return d
+}
+
+// fixOPF removes from the OPF package document the manifest items missing
+// from the archive, and their references from the spine, and adds the
+// language if it's missing. dir is the directory of the OPF in the archive.
+func fixOPF(pkg []byte, dir string, files map[string]*zip.File) ([]byte, []string, error) {
+	var (
+		fixes   []string
+		missing []string
+		ids     = make(map[string]bool)
+	)
+
+	pkg = itemRe.ReplaceAllFunc(pkg, func(item []byte) []byte {
+		href := attrOf(item, "href")
+		if href == "" || strings.Contains(href, "://") {
+			return item
+		}
+		if i := strings.IndexByte(href, '#'); i >= 0 {
+			href = href[:i]
+		}
+		if p, err := url.PathUnescape(href); err == nil {
+			href = p
+		}
+		name := path.Join(dir, href)
+		if files[name] != nil {
+			return item
+		}
+		missing = append(missing, name)
+		ids[attrOf(item, "id")] = true
+		return nil
+	})
+
+	if len(missing) > 0 {
+		pkg = itemrefRe.ReplaceAllFunc(pkg, func(ref []byte) []byte {
+			if ids[attrOf(ref, "idref")] {
+				return nil
+			}
+			return ref
+		})
+		fixes = append(fixes, "removed the missing "+strings.Join(missing, ", "))
+	}
+	if !itemrefRe.Match(pkg) {
+		return nil, nil, epubError("the book has no readable content")
+	}
+
+	if !languageRe.Match(pkg) {
+		loc := metadataEnd.FindIndex(pkg)
+		if loc == nil {
+			return nil, nil, epubError("the OPF has no metadata")
+		}
+		lang := []byte(`<dc:language xmlns:dc="http://purl.org/dc/elements/1.1/">en</dc:language>`)
+		pkg = append(pkg[:loc[0]:loc[0]], append(lang, pkg[loc[0]:]...)...)
+		fixes = append(fixes, "set the missing language to English")
+	}
+	return pkg, fixes, nil
+}
+
+// attrOf returns the value of the attribute name, one of attrRes, of the
+// XML tag.
+func attrOf(tag []byte, name string) string {
+	m := attrRes[name].FindSubmatch(tag)
+	if m == nil {
+		return ""
+	}
+	return html.UnescapeString(string(m[1]) + string(m[2]))
+}
+
+// checkXML reports whether b is well formed XML.
+func checkXML(b []byte) error {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		_, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rewriteEPUB writes a copy of the EPUB made of files, with the mimetype
+// first and the content of the changed ones replaced, to a temporary file.
+func rewriteEPUB(files []*zip.File, changed map[string][]byte) (string, error) {
+	f, err := os.CreateTemp(home, ".vessellotron-*")
+	if err != nil {
+		return "", fmt.Errorf("rewriteEPUB: os.CreateTemp: %w", err)
+	}
+	defer f.Close()
+
+	fail := func(err error) (string, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("rewriteEPUB: %w", err)
+	}
+
+	zw := zip.NewWriter(f)
+	mt, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := io.WriteString(mt, "application/epub+zip"); err != nil {
+		return fail(err)
+	}
+
+	written := map[string]bool{"mimetype": true}
+	for _, zf := range files {
+		if written[zf.Name] {
+			continue
+		}
+		written[zf.Name] = true
+
+		b, ok := changed[zf.Name]
+		if !ok {
+			if err := zw.Copy(zf); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+		w, err := zw.Create(zf.Name)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err := w.Write(b); err != nil {
+			return fail(err)
+		}
+	}
+	// A rebuilt container.xml.
+	for name, b := range changed {
+		if written[name] {
+			continue
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err := w.Write(b); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return fail(err)
+	}
+	return f.Name(), nil
+}
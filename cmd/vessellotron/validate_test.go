@@ -0,0 +1,324 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/unicode"
+)
+
+const (
+	testOPF = `<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">x</dc:identifier>
+    <dc:title>Dune</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="ch%202.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="ch1"/>
+    <itemref idref="ch2"/>
+  </spine>
+</package>`
+	testXHTML = `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>1</title></head><body><p>Ahoy!</p></body></html>`
+)
+
+// epubFiles returns the files of a valid EPUB, to be broken by the tests.
+func epubFiles() map[string]string {
+	return map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": fmt.Sprintf(containerXML, "OEBPS/content.opf"),
+		"OEBPS/content.opf":      testOPF,
+		"OEBPS/ch1.xhtml":        testXHTML,
+		"OEBPS/ch 2.xhtml":       testXHTML,
+	}
+}
+
+// zipEPUB writes files to path, with the mimetype first and stored unless
+// deflate is true.
+func zipEPUB(t *testing.T, path string, files map[string]string, deflate bool) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	write := func(name string, method uint16) {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[name]))
+	}
+	if _, ok := files["mimetype"]; ok && !deflate {
+		write("mimetype", zip.Store)
+	}
+	for name := range files {
+		if name != "mimetype" || deflate {
+			write(name, zip.Deflate)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairEPUB(t *testing.T) {
+	withHome(t)
+
+	tests := []struct {
+		name  string
+		edit  func(map[string]string)
+		fixes []string
+		// Expected in the file named by the first element.
+		want [2]string
+	}{
+		{"valid", func(map[string]string) {}, nil, [2]string{}},
+		{"mimetype", func(map[string]string) {}, []string{"rewrote the mimetype"}, [2]string{}},
+		{
+			"container",
+			func(f map[string]string) { delete(f, "META-INF/container.xml") },
+			[]string{"rebuilt container.xml"},
+			[2]string{"META-INF/container.xml", `full-path="OEBPS/content.opf"`},
+		},
+		{
+			"entities",
+			func(f map[string]string) {
+				f["OEBPS/ch1.xhtml"] = strings.Replace(testXHTML, "Ahoy!", "Caf&eacute;&nbsp;&amp; R&D &bogus; &#233;", 1)
+			},
+			[]string{"fixed 4 broken XML entities"},
+			[2]string{"OEBPS/ch1.xhtml", "Caf&#233;&#160;&amp; R&amp;D &amp;bogus; &#233;"},
+		},
+		{
+			"encoding",
+			func(f map[string]string) {
+				f["OEBPS/ch1.xhtml"] = strings.NewReplacer(`encoding="utf-8"`, `encoding="ISO-8859-1"`, "Ahoy!", "Caf\xe9").Replace(testXHTML)
+			},
+			[]string{"converted 1 files to UTF-8"},
+			[2]string{"OEBPS/ch1.xhtml", `encoding="utf-8"?>`},
+		},
+		{
+			"cdata",
+			func(f map[string]string) {
+				f["OEBPS/ch1.xhtml"] = strings.Replace(testXHTML, "Ahoy!", "<![CDATA[a && b &nbsp;]]><!-- Q&A -->R&D", 1)
+			},
+			[]string{"fixed 1 broken XML entities"},
+			[2]string{"OEBPS/ch1.xhtml", "<![CDATA[a && b &nbsp;]]><!-- Q&A -->R&amp;D"},
+		},
+		{
+			"utf-16",
+			func(f map[string]string) {
+				xhtml := strings.NewReplacer(`encoding="utf-8"`, `encoding="UTF-16"`, "Ahoy!", "Caffè").Replace(testXHTML)
+				f["OEBPS/ch1.xhtml"] = must(unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().String(xhtml))
+				f["OEBPS/ch 2.xhtml"] = must(unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM).NewEncoder().String(xhtml))
+			},
+			[]string{"converted 2 files to UTF-8"},
+			[2]string{"OEBPS/ch1.xhtml", "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<html xmlns=\"http://www.w3.org/1999/xhtml\"><head><title>1</title></head><body><p>Caffè</p>"},
+		},
+		{
+			"declared encoding",
+			func(f map[string]string) {
+				f["OEBPS/ch1.xhtml"] = strings.NewReplacer(`encoding="utf-8"`, `encoding="windows-1251"`, "Ahoy!", "\xcf\xf0\xe8\xe2\xe5\xf2").Replace(testXHTML)
+			},
+			[]string{"converted 1 files to UTF-8"},
+			[2]string{"OEBPS/ch1.xhtml", "<p>Привет</p>"},
+		},
+		{
+			"manifest",
+			func(f map[string]string) { delete(f, "OEBPS/ch 2.xhtml") },
+			[]string{"removed the missing OEBPS/ch 2.xhtml"},
+			[2]string{"OEBPS/content.opf", "<itemref idref=\"ch1\"/>\n  </spine>"},
+		},
+		{
+			"language",
+			func(f map[string]string) {
+				f["OEBPS/content.opf"] = strings.Replace(testOPF, "<dc:language>en</dc:language>", "<dc:language/>", 1)
+			},
+			[]string{"set the missing language to English"},
+			[2]string{"OEBPS/content.opf", ">en</dc:language></metadata>"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := epubFiles()
+			tt.edit(files)
+			src := filepath.Join(t.TempDir(), "book.epub")
+			zipEPUB(t, src, files, tt.name == "mimetype")
+
+			out, fixes, err := repairEPUB(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(fixes, "|") != strings.Join(tt.fixes, "|") {
+				t.Errorf("fixes = %q, want %q", fixes, tt.fixes)
+			}
+			if len(tt.fixes) == 0 {
+				if out != "" {
+					t.Errorf("a valid EPUB has been rewritten to %s", out)
+				}
+				return
+			}
+			defer os.Remove(out)
+
+			// The repaired EPUB needs no more fixes.
+			if again, fixes, err := repairEPUB(out); err != nil || again != "" {
+				t.Errorf("repairing again = %v, %v", fixes, err)
+			}
+			checkEPUB(t, out)
+
+			if tt.want[0] != "" {
+				zr, err := zip.OpenReader(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer zr.Close()
+				var f *zip.File
+				for _, zf := range zr.File {
+					if zf.Name == tt.want[0] {
+						f = zf
+					}
+				}
+				b, err := readZipFile(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.Contains(string(b), tt.want[1]) {
+					t.Errorf("%s = %s, want it to contain %s", tt.want[0], b, tt.want[1])
+				}
+			}
+		})
+	}
+}
+
+func TestReadZipFile(t *testing.T) {
+	saved := maxXMLSize
+	maxXMLSize = 16
+	t.Cleanup(func() { maxXMLSize = saved })
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{"small.xhtml": "<p>Ahoy!</p>", "big.xhtml": "<p>Ahoy there, matey!</p>"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	// A header lying about the size of the file.
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "liar.xhtml",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE([]byte("<p>Ahoy there!</p>")),
+		CompressedSize64:   18,
+		UncompressedSize64: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("<p>Ahoy there!</p>"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		b, err := readZipFile(f)
+		switch f.Name {
+		case "small.xhtml":
+			if err != nil || string(b) != "<p>Ahoy!</p>" {
+				t.Errorf("readZipFile(%s) = %q, %v", f.Name, b, err)
+			}
+		case "big.xhtml":
+			if !errors.Is(err, errXMLTooBig) {
+				t.Errorf("readZipFile(%s) error = %v, want errXMLTooBig", f.Name, err)
+			}
+		default:
+			if err == nil {
+				t.Errorf("readZipFile(%s) = %q, want an error", f.Name, b)
+			}
+		}
+	}
+}
+
+func TestRepairEPUBBroken(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := map[string]func(string){
+		"not a zip": func(p string) { os.WriteFile(p, []byte("not a zip"), 0644) },
+		"no opf": func(p string) {
+			files := epubFiles()
+			delete(files, "OEBPS/content.opf")
+			zipEPUB(t, p, files, false)
+		},
+		"no content": func(p string) {
+			files := epubFiles()
+			delete(files, "OEBPS/ch1.xhtml")
+			delete(files, "OEBPS/ch 2.xhtml")
+			zipEPUB(t, p, files, false)
+		},
+		"broken opf": func(p string) {
+			files := epubFiles()
+			files["OEBPS/content.opf"] = strings.Replace(testOPF, "</manifest>", "", 1)
+			zipEPUB(t, p, files, false)
+		},
+	}
+
+	for name, write := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := filepath.Join(dir, name+".epub")
+			write(p)
+
+			var broken epubError
+			if _, _, err := repairEPUB(p); !errors.As(err, &broken) {
+				t.Errorf("repairEPUB() error = %v, want an epubError", err)
+			}
+		})
+	}
+}
+
+func TestPrepareRepairs(t *testing.T) {
+	dir := withHome(t)
+
+	src := filepath.Join(t.TempDir(), "book.epub")
+	zipEPUB(t, src, epubFiles(), true)
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up, err := prepare("book.epub", newUpload(t, string(data)), defaultConvert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(up.Fixes) != 1 || up.Name != "book.kepub.epub" {
+		t.Errorf("prepare() = %+v, want the mimetype fixed and a KEPUB", up)
+	}
+	up.remove()
+
+	var broken epubError
+	if _, err := prepare("broken.epub", newUpload(t, "PK garbage"), defaultConvert); !errors.As(err, &broken) {
+		t.Errorf("prepare() error = %v, want an epubError", err)
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(dir, ".vessellotron-*")); len(tmps) != 0 {
+		t.Errorf("temporary files left: %q", tmps)
+	}
+}
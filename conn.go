@@ -0,0 +1,136 @@
+package tortugasync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	dialTimeout       = 5 * time.Second
+	keepAliveInterval = 15 * time.Second
+	minBackoff        = 500 * time.Millisecond
+	maxBackoff        = 30 * time.Second
+)
+
+// dial opens an SSH connection with a single attempt.
+func dial(ctx context.Context, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	nconn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial: d.DialContext: %w", err)
+	}
+
+	// Bound the handshake as well.
+	deadline, _ := ctx.Deadline()
+	nconn.SetDeadline(deadline)
+	conn, chans, reqs, err := ssh.NewClientConn(nconn, addr, cfg)
+	if err != nil {
+		nconn.Close()
+		return nil, fmt.Errorf("dial: ssh.NewClientConn: %w", err)
+	}
+	nconn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(conn, chans, reqs), nil
+}
+
+// dialRetry keeps dialing with exponential backoff until it succeeds or ctx
+// is done.
+// Only network errors are retried, failing to verify the server or to
+// authenticate is returned immediately.
+func dialRetry(ctx context.Context, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	var backoff = minBackoff
+
+	for {
+		conn, err := dial(ctx, addr, cfg)
+		if err == nil {
+			return conn, nil
+		}
+		if !isConnError(err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Join(ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// keepAlive pings the server until the connection is closed and closes it
+// when the server stops answering, so that pending operations fail instead
+// of hanging forever.
+func keepAlive(conn *ssh.Client) {
+	var (
+		done   = make(chan struct{})
+		ticker = time.NewTicker(keepAliveInterval)
+	)
+	defer ticker.Stop()
+
+	go func() {
+		conn.Wait()
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+
+			select {
+			case err := <-reply:
+				if err != nil {
+					conn.Close()
+					return
+				}
+			case <-time.After(keepAliveInterval):
+				conn.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// isConnError reports whether err means the server couldn't be reached or
+// the connection has been lost.
+func isConnError(err error) bool {
+	var nerr net.Error
+
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.As(err, &nerr)
+}
+
+// ctxReader is an io.Reader that stops reading once its context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,147 @@
+package tortugasync
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// FixedHostKey returns a callback accepting only the given marshalled
+// public key.
+// The server must be asked for that key with FixedHostKeyAlgorithms, or it
+// may present another one of its keys.
+func FixedHostKey(hostKey []byte) ssh.HostKeyCallback {
+	return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		if !bytes.Equal(key.Marshal(), hostKey) {
+			return errors.New("HostKeyCallback: invalid host key")
+		}
+		return nil
+	}
+}
+
+// FixedHostKeyAlgorithms returns the host key algorithms to negotiate for
+// the server to present the given marshalled public key, nil if it can't be
+// parsed.
+func FixedHostKeyAlgorithms(hostKey []byte) []string {
+	key, err := ssh.ParsePublicKey(hostKey)
+	if err != nil {
+		return nil
+	}
+
+	switch key.Type() {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	case ssh.CertAlgoRSAv01:
+		return []string{ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01}
+	default:
+		return []string{key.Type()}
+	}
+}
+
+// hostKeyPreference is the order in which the key types listed in a
+// known_hosts file are asked to the server, the one OpenSSH uses.
+var hostKeyPreference = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoSKED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoDSA,
+}
+
+// KnownHostsAlgorithms returns the host key algorithms to negotiate for the
+// server at addr to present one of the keys listed for it in the OpenSSH
+// known_hosts file at path, nil if none is listed.
+// Without them the server may present a key of another type and be
+// rejected even though its key is known.
+func KnownHostsAlgorithms(path, addr string) ([]string, error) {
+	check, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("KnownHostsAlgorithms: knownhosts.New: %w", err)
+	}
+
+	// A key no host has makes the check list the known ones.
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil, fmt.Errorf("KnownHostsAlgorithms: ssh.NewPublicKey: %w", err)
+	}
+	var kerr *knownhosts.KeyError
+	if err := check(addr, &net.TCPAddr{}, probe); !errors.As(err, &kerr) {
+		return nil, nil
+	}
+
+	known := make(map[string][]byte)
+	for _, k := range kerr.Want {
+		known[k.Key.Type()] = k.Key.Marshal()
+	}
+	var algos []string
+	for _, typ := range hostKeyPreference {
+		if key, ok := known[typ]; ok {
+			algos = append(algos, FixedHostKeyAlgorithms(key)...)
+		}
+	}
+	return algos, nil
+}
+
+// KnownHosts returns a callback verifying the server against the OpenSSH
+// known_hosts file at path, any of the keys listed for a host is accepted.
+// If tofu is true, the first key seen for a host that isn't in the file is
+// trusted and appended to it, a key that changed is still rejected, also
+// when it's presented by a later connection with the same callback.
+func KnownHosts(path string, tofu bool) (ssh.HostKeyCallback, error) {
+	if tofu {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("KnownHosts: os.OpenFile: %w", err)
+		}
+		f.Close()
+	}
+
+	check, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("KnownHosts: knownhosts.New: %w", err)
+	}
+	if !tofu {
+		return check, nil
+	}
+
+	var mu sync.Mutex
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		err := check(hostname, remote, key)
+
+		var kerr *knownhosts.KeyError
+		if !errors.As(err, &kerr) || len(kerr.Want) > 0 {
+			return err
+		}
+
+		// Unknown host, pin its key.
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("HostKeyCallback: os.OpenFile: %w", err)
+		}
+		defer f.Close()
+
+		line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+		if _, err := fmt.Fprintln(f, line); err != nil {
+			return fmt.Errorf("HostKeyCallback: fmt.Fprintln: %w", err)
+		}
+
+		// Reload the file so that the pinned key is enforced from now on.
+		if check, err = knownhosts.New(path); err != nil {
+			return fmt.Errorf("HostKeyCallback: knownhosts.New: %w", err)
+		}
+		return nil
+	}, nil
+}
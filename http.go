@@ -0,0 +1,265 @@
+package tortugasync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+// HTTPStorage is a Storage talking to a server that exposes its library with
+// StorageHandler.
+// Credentials in the URL are sent with HTTP basic authentication.
+//
+// The API maps the storage operations on the URL path of the file:
+//
+//	GET    /name         the content of the file
+//	GET    /name?stat    the JSON encoded file info
+//	GET    /dir?list     the JSON encoded list of file infos in dir
+//	PUT    /name         creates or truncates the file with the request body
+//	DELETE /name         removes the file
+//	POST   /name?rename=/newname
+type HTTPStorage struct {
+	Base   *url.URL
+	Client *http.Client
+
+	// ctx cancels the requests, see WithContext.
+	ctx context.Context
+}
+
+// httpClient gives up on the servers that don't answer without limiting
+// how long a transfer can take, that's left to the context.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: keepAliveInterval,
+		}).DialContext,
+		TLSHandshakeTimeout:   dialTimeout,
+		ResponseHeaderTimeout: httpResponseTimeout,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// How long the server can take to answer a request.
+const httpResponseTimeout = 30 * time.Second
+
+func NewHTTPStorage(base *url.URL) *HTTPStorage {
+	return &HTTPStorage{Base: base, Client: httpClient}
+}
+
+// WithContext returns a copy of h whose requests are cancelled once ctx is
+// done.
+func (h *HTTPStorage) WithContext(ctx context.Context) Storage {
+	c := *h
+	c.ctx = ctx
+	return &c
+}
+
+func (h *HTTPStorage) url(name string, query string) string {
+	u := *h.Base
+	u.Path = path.Join(u.Path, path.Clean("/"+name))
+	u.RawQuery = query
+	return u.String()
+}
+
+// do sends the request and turns the non 2xx responses into errors.
+func (h *HTTPStorage) do(method, name, query string, body io.Reader) (*http.Response, error) {
+	ctx := h.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, h.url(name, query), body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := h.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return nil, &fs.PathError{Op: method, Path: name, Err: fs.ErrNotExist}
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return nil, &fs.PathError{Op: method, Path: name, Err: fs.ErrPermission}
+	default:
+		return nil, fmt.Errorf("%s %s: %s: %s", method, name, res.Status, msg)
+	}
+}
+
+func (h *HTTPStorage) Open(name string) (io.ReadCloser, error) {
+	res, err := h.do(http.MethodGet, name, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Create streams what's written to the returned writer to the server, the
+// upload completes when it's closed.
+func (h *HTTPStorage) Create(name string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+
+	go func() {
+		res, err := h.do(http.MethodPut, name, "", pr)
+		if err == nil {
+			res.Body.Close()
+		}
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	return &httpWriter{PipeWriter: pw, done: done}, nil
+}
+
+func (h *HTTPStorage) Stat(name string) (fs.FileInfo, error) {
+	var fi fileInfo
+
+	res, err := h.do(http.MethodGet, name, "stat", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(&fi); err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+func (h *HTTPStorage) List(dir string) ([]fs.FileInfo, error) {
+	var list []fileInfo
+
+	res, err := h.do(http.MethodGet, dir, "list", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	infos := make([]fs.FileInfo, len(list))
+	for i, fi := range list {
+		infos[i] = fi
+	}
+	return infos, nil
+}
+
+func (h *HTTPStorage) Remove(name string) error {
+	res, err := h.do(http.MethodDelete, name, "", nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (h *HTTPStorage) Rename(oldname, newname string) error {
+	q := url.Values{"rename": {newname}}
+	res, err := h.do(http.MethodPost, oldname, q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (h *HTTPStorage) Close() error {
+	return nil
+}
+
+type httpWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *httpWriter) Close() error {
+	w.PipeWriter.Close()
+	return <-w.done
+}
+
+// StorageHandler serves st with the API described in HTTPStorage.
+func StorageHandler(st Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			name = r.URL.Path
+			q    = r.URL.Query()
+			err  error
+		)
+
+		switch {
+		case r.Method == http.MethodGet && q.Has("stat"):
+			var fi fs.FileInfo
+			if fi, err = st.Stat(name); err == nil {
+				err = writeJSON(w, newFileInfo(fi))
+			}
+
+		case r.Method == http.MethodGet && q.Has("list"):
+			var infos []fs.FileInfo
+			if infos, err = st.List(name); err == nil {
+				list := make([]fileInfo, len(infos))
+				for i, fi := range infos {
+					list[i] = newFileInfo(fi)
+				}
+				err = writeJSON(w, list)
+			}
+
+		case r.Method == http.MethodGet:
+			var f io.ReadCloser
+			if f, err = st.Open(name); err == nil {
+				defer f.Close()
+				w.Header().Set("Content-Type", "application/octet-stream")
+				_, err = io.Copy(w, f)
+			}
+
+		case r.Method == http.MethodPut:
+			var f io.WriteCloser
+			if f, err = st.Create(name); err == nil {
+				_, err = io.Copy(f, r.Body)
+				err = errors.Join(err, f.Close())
+			}
+
+		case r.Method == http.MethodDelete:
+			err = st.Remove(name)
+
+		case r.Method == http.MethodPost && q.Has("rename"):
+			err = st.Rename(name, q.Get("rename"))
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch {
+		case err == nil:
+		case errors.Is(err, fs.ErrNotExist):
+			http.Error(w, "not found", http.StatusNotFound)
+		case errors.Is(err, fs.ErrPermission):
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			log.Println("StorageHandler", r.Method, name, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
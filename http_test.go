@@ -0,0 +1,157 @@
+package tortugasync
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newHTTPBay serves a temporary directory as the server's home with
+// StorageHandler behind the basic authentication and returns a Bay for it
+// and the directory.
+func newHTTPBay(t *testing.T) (*Bay, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	handler := StorageHandler(LocalStorage{Root: dir})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "tortuga" || pass != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword("tortuga", "secret")
+	return NewBay(NewHTTPStorage(u), "/home/tortuga"), dir
+}
+
+func TestHTTPStorage(t *testing.T) {
+	var (
+		bay, dir = newHTTPBay(t)
+		local    = t.TempDir()
+		content  = bytes.Repeat([]byte("Ahoy there, me hearty! "), 10000)
+	)
+
+	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), []byte(`{"0cc175b9c0f1b6a831c399e269772661": "/home/tortuga/a.epub"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := bay.Metadata("/home/tortuga/metadata.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta) != 1 || meta["0cc175b9c0f1b6a831c399e269772661"] != "/home/tortuga/a.epub" {
+		t.Errorf("Metadata() = %v", meta)
+	}
+
+	lpath := filepath.Join(local, "book.epub")
+	if err := os.WriteFile(lpath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := bay.Upload(lpath, "/home/tortuga/sub/book.epub"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Upload() error = %v into a missing directory, want fs.ErrNotExist", err)
+	}
+	if err := bay.Upload(lpath, "/home/tortuga/book.epub"); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := bay.Stat("/home/tortuga/book.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name() != "book.epub" || fi.Size() != int64(len(content)) || fi.IsDir() {
+		t.Errorf("Stat() = %s %d %t", fi.Name(), fi.Size(), fi.IsDir())
+	}
+
+	if err := bay.Rename("/home/tortuga/book.epub", "/home/tortuga/renamed.epub"); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := bay.List("/home/tortuga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "metadata.json" || names[1] != "renamed.epub" {
+		t.Errorf("List() = %q", names)
+	}
+
+	sum, err := bay.Fetch(filepath.Join(local, "fetched.epub"), "/home/tortuga/renamed.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := md5.Sum(content); !bytes.Equal(sum, want[:]) {
+		t.Errorf("Fetch() = %x, want %x", sum, want)
+	}
+
+	if err := bay.Remove("/home/tortuga/renamed.epub"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bay.Stat("/home/tortuga/renamed.epub"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat() error = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := bay.Fetch(filepath.Join(local, "x.epub"), "/home/tortuga/missing.epub"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Fetch() error = %v, want fs.ErrNotExist", err)
+	}
+
+	// Names can't escape the served directory.
+	if _, err := bay.Stat("/home/tortuga/../../etc/passwd"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat() error = %v outside of the root, want fs.ErrNotExist", err)
+	}
+}
+
+func TestHTTPStorageAuth(t *testing.T) {
+	bay, _ := newHTTPBay(t)
+
+	h := bay.Storage.(*HTTPStorage)
+	h.Base.User = url.UserPassword("tortuga", "wrong")
+	if _, err := bay.Stat("/home/tortuga"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Stat() error = %v, want fs.ErrPermission", err)
+	}
+}
+
+func TestHTTPStorageContext(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bay := NewBay(NewHTTPStorage(u), "/")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := bay.MetadataContext(ctx, "/metadata.json"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("MetadataContext() error = %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("MetadataContext() took %s with an unresponsive server", d)
+	}
+}
@@ -1,69 +1,203 @@
 package tortugasync
 
 import (
-	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net"
+	"io/fs"
+	"net/url"
 	"os"
-	"time"
+	"path"
+	"strings"
 
-	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
+// Bay is a connection to the Tortuga server.
+// Its methods take the absolute paths of the files on the server, which are
+// mapped onto the storage relative to Home.
 type Bay struct {
-	*sftp.Client
+	Storage Storage
+	Home    string
+	// Agent is the ssh-agent connection the signers of the storage use, if
+	// any, closed along with the Bay since reconnecting needs it.
+	Agent io.Closer
 }
 
+// NewBay returns a Bay syncing with st, whose root holds the server's home.
+func NewBay(st Storage, home string) *Bay {
+	return &Bay{Storage: st, Home: home}
+}
+
+// Connect opens an SFTP session with the server at url, authenticating as
+// the tortuga user with the given PEM encoded private key and accepting only
+// the given marshalled host key.
+// It's kept for compatibility, ConnectContext and Dial take any signers and
+// host key callback.
 func Connect(url string, key, hostKey []byte) (Bay, error) {
 	signer, err := ssh.ParsePrivateKey(key)
 	if err != nil {
 		return Bay{}, fmt.Errorf("Connect: ssh.ParsePrivateKey: %w", err)
 	}
 
-	clientCfg := &ssh.ClientConfig{
-		User: "tortuga",
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		Timeout: 5 * time.Second,
-		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
-			if !bytes.Equal(key.Marshal(), hostKey) {
-				return errors.New("HostKeyCallback: invalid host key")
-			}
-			return nil
-		},
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	bay, err := ConnectContext(ctx, url, []ssh.Signer{signer}, FixedHostKey(hostKey), FixedHostKeyAlgorithms(hostKey)...)
+	if err != nil {
+		return Bay{}, fmt.Errorf("Connect: %w", err)
 	}
+	return *bay, nil
+}
 
-	// Connect to the remote server.
-	conn, err := ssh.Dial("tcp", url, clientCfg)
+// ConnectContext opens an SFTP session with the server at url, authenticating
+// as the tortuga user with any of the given signers, see ParseSigner and
+// AgentSigners.
+// hostKey verifies the server's identity, see FixedHostKey and KnownHosts,
+// and algos restricts the host key algorithms negotiated, see
+// FixedHostKeyAlgorithms.
+// It keeps retrying with exponential backoff until it succeeds or ctx is
+// done, useful while the network is coming up.
+func ConnectContext(ctx context.Context, url string, signers []ssh.Signer, hostKey ssh.HostKeyCallback, algos ...string) (*Bay, error) {
+	st, err := NewSFTPStorage(ctx, url, "/", signers, hostKey, algos...)
 	if err != nil {
-		return Bay{}, fmt.Errorf("Connect: ssh.Dial: %w", err)
+		return nil, fmt.Errorf("ConnectContext: %w", err)
+	}
+	return NewBay(st, "/"), nil
+}
+
+// Dial returns a Bay for the server whose home is at rawurl, the storage is
+// chosen by the URL scheme:
+//
+//	host:port, sftp://host:port  SFTP, see ConnectContext
+//	file:///path                 a local directory holding a copy of home
+//	http://host, https://host    a server exposing home with StorageHandler
+func Dial(ctx context.Context, rawurl, home string, signers []ssh.Signer, hostKey ssh.HostKeyCallback, algos ...string) (*Bay, error) {
+	if !strings.Contains(rawurl, "://") {
+		return ConnectContext(ctx, rawurl, signers, hostKey, algos...)
 	}
 
-	// Open an SFTP session over the SSH connection.
-	client, err := sftp.NewClient(conn)
+	u, err := url.Parse(rawurl)
 	if err != nil {
-		return Bay{}, fmt.Errorf("Connect: %w", err)
+		return nil, fmt.Errorf("Dial: url.Parse: %w", err)
+	}
+
+	switch u.Scheme {
+	case "sftp":
+		return ConnectContext(ctx, u.Host, signers, hostKey, algos...)
+	case "file":
+		return NewBay(LocalStorage{Root: u.Path}, home), nil
+	case "http", "https":
+		return NewBay(NewHTTPStorage(u), home), nil
+	default:
+		return nil, fmt.Errorf("Dial: unsupported scheme %q", u.Scheme)
 	}
+}
+
+// name maps the absolute server path p to the storage.
+func (b *Bay) name(p string) string {
+	p, home := path.Clean(p), path.Clean(b.Home)
+	if home != "/" && (p == home || strings.HasPrefix(p, home+"/")) {
+		p = p[len(home):]
+	}
+	return path.Clean("/" + p)
+}
+
+// storage returns the storage bound to ctx, if it supports it.
+func (b *Bay) storage(ctx context.Context) Storage {
+	if cs, ok := b.Storage.(contextStorage); ok {
+		return cs.WithContext(ctx)
+	}
+	return b.Storage
+}
+
+// retry runs op and, if it fails because the connection dropped and the
+// storage supports it, reconnects and runs it once more.
+func (b *Bay) retry(ctx context.Context, op func() error) error {
+	err := op()
+	if err == nil || ctx.Err() != nil || !isConnError(err) {
+		return err
+	}
+
+	rc, ok := b.Storage.(interface{ Reconnect(context.Context) error })
+	if !ok {
+		return err
+	}
+	if rerr := rc.Reconnect(ctx); rerr != nil {
+		return errors.Join(err, rerr)
+	}
+	return op()
+}
+
+func (b *Bay) Open(p string) (io.ReadCloser, error) {
+	return b.Storage.Open(b.name(p))
+}
+
+func (b *Bay) Create(p string) (io.WriteCloser, error) {
+	return b.Storage.Create(b.name(p))
+}
+
+func (b *Bay) Stat(p string) (fs.FileInfo, error) {
+	return b.Storage.Stat(b.name(p))
+}
+
+// StatContext is like Stat but gives up once ctx is done and reconnects
+// when the connection dropped.
+func (b *Bay) StatContext(ctx context.Context, p string) (fi fs.FileInfo, err error) {
+	err = b.retry(ctx, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fi, err = b.storage(ctx).Stat(b.name(p))
+		return err
+	})
+	return
+}
+
+func (b *Bay) List(dir string) ([]fs.FileInfo, error) {
+	return b.Storage.List(b.name(dir))
+}
 
-	return Bay{Client: client}, nil
+func (b *Bay) Remove(p string) error {
+	return b.Storage.Remove(b.name(p))
+}
+
+func (b *Bay) Rename(oldpath, newpath string) error {
+	return b.Storage.Rename(b.name(oldpath), b.name(newpath))
+}
+
+func (b *Bay) Close() error {
+	err := b.Storage.Close()
+	if b.Agent != nil {
+		b.Agent.Close()
+	}
+	return err
 }
 
 // Metadata returns a map of MD5 hashes as keys and file paths as values read from the server.
-func (b Bay) Metadata(path string) (Cache, error) {
-	meta, err := b.Open(path)
+func (b *Bay) Metadata(path string) (Cache, error) {
+	return b.MetadataContext(context.Background(), path)
+}
+
+func (b *Bay) MetadataContext(ctx context.Context, path string) (ret Cache, err error) {
+	err = b.retry(ctx, func() error {
+		ret, err = b.metadata(ctx, path)
+		return err
+	})
+	return
+}
+
+func (b *Bay) metadata(ctx context.Context, path string) (Cache, error) {
+	meta, err := b.storage(ctx).Open(b.name(path))
 	if err != nil {
 		return nil, fmt.Errorf("b.metadata: b.Open: %w", err)
 	}
 	defer meta.Close()
 
 	ret := make(Cache)
-	cnt, err := io.ReadAll(meta)
+	cnt, err := io.ReadAll(ctxReader{ctx, meta})
 	if err != nil {
 		return nil, fmt.Errorf("b.metadata: io.ReadAll: %w", err)
 	}
@@ -76,8 +210,20 @@ func (b Bay) Metadata(path string) (Cache, error) {
 
 // Fetch downloads a book from tortuga@{remote}:{remotePath} to localPath and
 // returns its just calculated MD5SUM and an error if any.
-func (b Bay) Fetch(localPath, remotePath string) ([]byte, error) {
-	rbook, err := b.Open(remotePath)
+func (b *Bay) Fetch(localPath, remotePath string) ([]byte, error) {
+	return b.FetchContext(context.Background(), localPath, remotePath)
+}
+
+func (b *Bay) FetchContext(ctx context.Context, localPath, remotePath string) (sum []byte, err error) {
+	err = b.retry(ctx, func() error {
+		sum, err = b.fetch(ctx, localPath, remotePath)
+		return err
+	})
+	return
+}
+
+func (b *Bay) fetch(ctx context.Context, localPath, remotePath string) ([]byte, error) {
+	rbook, err := b.storage(ctx).Open(b.name(remotePath))
 	if err != nil {
 		return nil, fmt.Errorf("b.fetch: b.Open: %w", err)
 	}
@@ -90,7 +236,7 @@ func (b Bay) Fetch(localPath, remotePath string) ([]byte, error) {
 	defer lbook.Close()
 
 	// Write the book locally.
-	if _, err := io.Copy(lbook, rbook); err != nil {
+	if _, err := io.Copy(lbook, ctxReader{ctx, rbook}); err != nil {
 		return nil, fmt.Errorf("b.fetch: io.Copy: %w", err)
 	}
 	lbook.Seek(0, 0)
@@ -104,19 +250,29 @@ func (b Bay) Fetch(localPath, remotePath string) ([]byte, error) {
 	return hash.Sum(nil), nil
 }
 
-func (b Bay) Upload(localPath, remotePath string) error {
-	rfile, err := b.OpenFile(remotePath, os.O_CREATE|os.O_RDWR|os.O_TRUNC)
+func (b *Bay) Upload(localPath, remotePath string) error {
+	return b.UploadContext(context.Background(), localPath, remotePath)
+}
+
+func (b *Bay) UploadContext(ctx context.Context, localPath, remotePath string) error {
+	return b.retry(ctx, func() error {
+		return b.upload(ctx, localPath, remotePath)
+	})
+}
+
+func (b *Bay) upload(ctx context.Context, localPath, remotePath string) error {
+	rfile, err := b.storage(ctx).Create(b.name(remotePath))
 	if err != nil {
 		return err
 	}
-	defer rfile.Close()
 
 	lfile, err := os.Open(localPath)
 	if err != nil {
+		rfile.Close()
 		return err
 	}
 	defer lfile.Close()
 
-	_, err = io.Copy(rfile, lfile)
-	return err
+	_, err = io.Copy(rfile, ctxReader{ctx, lfile})
+	return errors.Join(err, rfile.Close())
 }
@@ -0,0 +1,368 @@
+package tortugasync
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestConnect(t *testing.T) {
+	srv := newTestServer(t)
+
+	t.Run("ok", func(t *testing.T) {
+		srv.connect(t)
+	})
+
+	t.Run("wrong host key", func(t *testing.T) {
+		start := time.Now()
+		other := newSigner(t).PublicKey().Marshal()
+
+		_, err := dialServer(srv.addr, []ssh.Signer{srv.clientKey}, FixedHostKey(other))
+		if err == nil {
+			t.Fatal("expected an error with the wrong host key")
+		}
+		// A rejected host key must not be retried.
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("Connect took %s, expected an immediate failure", d)
+		}
+	})
+
+	t.Run("PEM key", func(t *testing.T) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := ssh.MarshalPrivateKey(priv, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := newTestServer(t)
+		if other.clientKey, err = ssh.NewSignerFromKey(priv); err != nil {
+			t.Fatal(err)
+		}
+
+		bay, err := Connect(other.addr, pem.EncodeToMemory(block), other.hostKey.PublicKey().Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		bay.Close()
+		if _, err := Connect(other.addr, []byte("not a key"), other.hostKey.PublicKey().Marshal()); err == nil {
+			t.Error("expected an error with an invalid key")
+		}
+	})
+
+	t.Run("wrong client key", func(t *testing.T) {
+		_, err := dialServer(srv.addr, []ssh.Signer{newSigner(t)}, FixedHostKey(srv.hostKey.PublicKey().Marshal()))
+		if err == nil {
+			t.Fatal("expected an error with an unauthorised key")
+		}
+	})
+}
+
+func TestFixedHostKeyAlgorithms(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like OpenSSH the server holds keys of several types, the client
+	// prefers ECDSA.
+	srv := newTestServer(t, ecdsaKey)
+
+	for _, key := range []ssh.PublicKey{srv.hostKey.PublicKey(), ecdsaKey.PublicKey()} {
+		pinned := key.Marshal()
+		algos := FixedHostKeyAlgorithms(pinned)
+		if len(algos) != 1 || algos[0] != key.Type() {
+			t.Errorf("FixedHostKeyAlgorithms() = %q, want %s", algos, key.Type())
+		}
+
+		bay, err := dialServer(srv.addr, []ssh.Signer{srv.clientKey}, FixedHostKey(pinned), algos...)
+		if err != nil {
+			t.Fatalf("pinning %s: %v", key.Type(), err)
+		}
+		bay.Close()
+	}
+
+	if _, err := dialServer(srv.addr, []ssh.Signer{srv.clientKey}, FixedHostKey(srv.hostKey.PublicKey().Marshal())); err == nil {
+		t.Error("expected the server to present its ECDSA key without the algorithms")
+	}
+}
+
+func TestKnownHostsAlgorithms(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// OpenSSH records only the ed25519 key, the client prefers ECDSA.
+	var (
+		srv  = newTestServer(t, ecdsaKey)
+		path = filepath.Join(t.TempDir(), "known_hosts")
+		line = knownhosts.Line([]string{knownhosts.Normalize(srv.addr)}, srv.hostKey.PublicKey())
+	)
+	if err := os.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	algos, err := KnownHostsAlgorithms(path, srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(algos) != 1 || algos[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("KnownHostsAlgorithms() = %q, want %s", algos, ssh.KeyAlgoED25519)
+	}
+	if algos, err := KnownHostsAlgorithms(path, "localhost:1"); err != nil || algos != nil {
+		t.Errorf("KnownHostsAlgorithms() = %q, %v for an unknown host, want nil", algos, err)
+	}
+
+	cb, err := KnownHosts(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bay, err := dialServer(srv.addr, []ssh.Signer{srv.clientKey}, cb, algos...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bay.Close()
+	if _, err := dialServer(srv.addr, []ssh.Signer{srv.clientKey}, cb); err == nil {
+		t.Error("expected the server to present its ECDSA key without the algorithms")
+	}
+
+	// Both keys listed, ed25519 is preferred.
+	line = knownhosts.Line([]string{knownhosts.Normalize(srv.addr)}, ecdsaKey.PublicKey())
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(line + "\n")
+	f.Close()
+	algos, err = KnownHostsAlgorithms(path, srv.addr)
+	if err != nil || len(algos) != 2 || algos[0] != ssh.KeyAlgoED25519 || algos[1] != ssh.KeyAlgoECDSA256 {
+		t.Errorf("KnownHostsAlgorithms() = %q, %v, want ed25519 then ECDSA", algos, err)
+	}
+}
+
+func TestKnownHostsTOFU(t *testing.T) {
+	var (
+		srv  = newTestServer(t)
+		path = filepath.Join(t.TempDir(), "known_hosts")
+	)
+
+	for i := 0; i < 2; i++ {
+		cb, err := KnownHosts(path, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bay, err := dialServer(srv.addr, []ssh.Signer{srv.clientKey}, cb)
+		if err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		bay.Close()
+	}
+
+	// A different key presented later to the same callback is rejected.
+	cb, err := KnownHosts(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.ResolveTCPAddr("tcp", srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := "localhost:1"
+	if err := cb(unknown, tcp, srv.clientKey.PublicKey()); err != nil {
+		t.Fatalf("first key of %s: %v", unknown, err)
+	}
+	var kerr *knownhosts.KeyError
+	if err := cb(unknown, tcp, newSigner(t).PublicKey()); !errors.As(err, &kerr) {
+		t.Errorf("changed key of %s: error = %v, want a KeyError", unknown, err)
+	}
+	if b, err := os.ReadFile(path); err != nil || bytes.Count(b, []byte("[localhost]:1 ")) != 1 {
+		t.Errorf("known_hosts = %q, %v, want a single line for %s", b, err, unknown)
+	}
+
+	// Pin a different key for another server.
+	other := newTestServer(t)
+	line := knownhosts.Line([]string{knownhosts.Normalize(other.addr)}, srv.hostKey.PublicKey())
+	if err := os.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if cb, err = KnownHosts(path, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialServer(other.addr, []ssh.Signer{other.clientKey}, cb); err == nil {
+		t.Fatal("expected a changed host key to be rejected")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	var (
+		srv = newTestServer(t)
+		bay = srv.connect(t)
+		dir = t.TempDir()
+	)
+
+	tests := []struct {
+		name    string
+		content string
+		want    Cache
+		wantErr bool
+	}{
+		{"valid", `{"0cc175b9c0f1b6a831c399e269772661": "/home/tortuga/a.epub"}`, Cache{"0cc175b9c0f1b6a831c399e269772661": "/home/tortuga/a.epub"}, false},
+		{"empty object", `{}`, Cache{}, false},
+		{"empty file", ``, nil, true},
+		{"truncated", `{"0cc175b9c0f1b6a831c399e269772661": "/home/`, nil, true},
+		{"wrong type", `["/home/tortuga/a.epub"]`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".json")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := bay.Metadata(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Metadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Metadata() = %v, want %v", got, tt.want)
+			}
+			for h, p := range tt.want {
+				if got[h] != p {
+					t.Errorf("Metadata()[%s] = %q, want %q", h, got[h], p)
+				}
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := bay.Metadata(filepath.Join(dir, "missing.json"))
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Metadata() error = %v, want fs.ErrNotExist", err)
+		}
+	})
+}
+
+func TestFetch(t *testing.T) {
+	var (
+		srv     = newTestServer(t)
+		bay     = srv.connect(t)
+		dir     = t.TempDir()
+		rpath   = filepath.Join(dir, "remote.epub")
+		lpath   = filepath.Join(dir, "local.epub")
+		content = bytes.Repeat([]byte("Ahoy there, me hearty! "), 10000)
+	)
+
+	if err := os.WriteFile(rpath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A stale longer local file must be replaced.
+	if err := os.WriteFile(lpath, append(content, content...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := bay.Fetch(lpath, rpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := md5.Sum(content); !bytes.Equal(sum, want[:]) {
+		t.Errorf("Fetch() = %x, want %x", sum, want)
+	}
+
+	got, err := os.ReadFile(lpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("fetched %d bytes, want %d", len(got), len(content))
+	}
+
+	if _, err := bay.Fetch(lpath, filepath.Join(dir, "missing.epub")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Fetch() error = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	var (
+		srv   = newTestServer(t)
+		bay   = srv.connect(t)
+		dir   = t.TempDir()
+		lpath = filepath.Join(dir, "notes.html")
+		rpath = filepath.Join(dir, "remote.html")
+	)
+
+	if err := os.WriteFile(rpath, []byte("a much longer previous version of the notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lpath, []byte("new notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bay.Upload(lpath, rpath); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(rpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new notes" {
+		t.Errorf("remote file = %q, want it truncated to %q", got, "new notes")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	var (
+		srv  = newTestServer(t)
+		bay  = srv.connect(t)
+		path = filepath.Join(t.TempDir(), "metadata.json")
+	)
+
+	if err := os.WriteFile(path, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.dropConns()
+	if _, err := bay.Metadata(path); err != nil {
+		t.Fatalf("Metadata() after the connection dropped: %v", err)
+	}
+}
+
+func TestLocalStoragePath(t *testing.T) {
+	l := LocalStorage{Root: "/srv/tortuga"}
+
+	tests := map[string]string{
+		"metadata.json":        "/srv/tortuga/metadata.json",
+		"/sub/book.epub":       "/srv/tortuga/sub/book.epub",
+		"../../etc/passwd":     "/srv/tortuga/etc/passwd",
+		"/sub/../../book.epub": "/srv/tortuga/book.epub",
+	}
+	for name, want := range tests {
+		if got := l.path(name); got != filepath.FromSlash(want) {
+			t.Errorf("path(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package tortugasync
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process SSH server offering the SFTP subsystem on the
+// local filesystem, it only accepts clientKey.
+// Besides hostKey it can hold more host keys of other types.
+type testServer struct {
+	addr      string
+	hostKey   ssh.Signer
+	clientKey ssh.Signer
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newTestServer(t *testing.T, hostKeys ...ssh.Signer) *testServer {
+	t.Helper()
+
+	srv := &testServer{
+		hostKey:   newSigner(t),
+		clientKey: newSigner(t),
+	}
+
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), srv.clientKey.PublicKey().Marshal()) {
+				return nil, errors.New("unknown public key")
+			}
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(srv.hostKey)
+	for _, k := range hostKeys {
+		cfg.AddHostKey(k)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.addr = l.Addr().String()
+	t.Cleanup(func() {
+		l.Close()
+		srv.dropConns()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.mu.Unlock()
+			go srv.serve(conn, cfg)
+		}
+	}()
+	return srv
+}
+
+func (s *testServer) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+
+				go func() {
+					defer ch.Close()
+					if srv, err := sftp.NewServer(ch); err == nil {
+						srv.Serve()
+					}
+				}()
+			}
+		}()
+	}
+}
+
+// dropConns abruptly closes all the client connections.
+func (s *testServer) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+// dialServer connects to the server at addr giving up after dialTimeout.
+func dialServer(addr string, signers []ssh.Signer, hostKey ssh.HostKeyCallback, algos ...string) (*Bay, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return ConnectContext(ctx, addr, signers, hostKey, algos...)
+}
+
+// connect returns a Bay connected to the server, closed at the end of the test.
+func (s *testServer) connect(t *testing.T) *Bay {
+	t.Helper()
+
+	bay, err := dialServer(s.addr, []ssh.Signer{s.clientKey}, FixedHostKey(s.hostKey.PublicKey().Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bay.Close() })
+	return bay
+}
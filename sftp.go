@@ -0,0 +1,131 @@
+package tortugasync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPStorage is a Storage served over SFTP as the tortuga user, it
+// transparently reconnects when the connection drops.
+type SFTPStorage struct {
+	// Root is the remote directory the names are relative to.
+	Root string
+
+	mu     sync.Mutex
+	client *sftp.Client
+	conn   *ssh.Client
+	addr   string
+	cfg    *ssh.ClientConfig
+}
+
+// NewSFTPStorage connects to the SSH server at addr, retrying with
+// exponential backoff until it succeeds or ctx is done, and opens an SFTP
+// session rooted at root.
+// algos restricts the host key algorithms negotiated, see
+// FixedHostKeyAlgorithms.
+func NewSFTPStorage(ctx context.Context, addr, root string, signers []ssh.Signer, hostKey ssh.HostKeyCallback, algos ...string) (*SFTPStorage, error) {
+	s := &SFTPStorage{
+		Root: root,
+		addr: addr,
+		cfg: &ssh.ClientConfig{
+			User: "tortuga",
+			Auth: []ssh.AuthMethod{
+				ssh.PublicKeys(signers...),
+			},
+			Timeout:           dialTimeout,
+			HostKeyCallback:   hostKey,
+			HostKeyAlgorithms: algos,
+		},
+	}
+
+	if err := s.connect(ctx); err != nil {
+		return nil, fmt.Errorf("NewSFTPStorage: %w", err)
+	}
+	return s, nil
+}
+
+// connect (re)opens the SSH connection and the SFTP session over it.
+func (s *SFTPStorage) connect(ctx context.Context) error {
+	conn, err := dialRetry(ctx, s.addr, s.cfg)
+	if err != nil {
+		return err
+	}
+
+	// Open an SFTP session over the SSH connection.
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("sftp.NewClient: %w", err)
+	}
+	go keepAlive(conn)
+
+	s.mu.Lock()
+	s.client, s.conn = client, conn
+	s.mu.Unlock()
+	return nil
+}
+
+// Reconnect replaces the current connection with a new one.
+func (s *SFTPStorage) Reconnect(ctx context.Context) error {
+	s.mu.Lock()
+	s.client.Close()
+	s.conn.Close()
+	s.mu.Unlock()
+	return s.connect(ctx)
+}
+
+func (s *SFTPStorage) c() *sftp.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client
+}
+
+func (s *SFTPStorage) path(name string) string {
+	return path.Join(s.Root, path.Clean("/"+name))
+}
+
+func (s *SFTPStorage) Open(name string) (io.ReadCloser, error) {
+	return s.c().Open(s.path(name))
+}
+
+func (s *SFTPStorage) Create(name string) (io.WriteCloser, error) {
+	return s.c().OpenFile(s.path(name), os.O_CREATE|os.O_RDWR|os.O_TRUNC)
+}
+
+func (s *SFTPStorage) Stat(name string) (fs.FileInfo, error) {
+	return s.c().Stat(s.path(name))
+}
+
+func (s *SFTPStorage) List(dir string) ([]fs.FileInfo, error) {
+	return s.c().ReadDir(s.path(dir))
+}
+
+func (s *SFTPStorage) Remove(name string) error {
+	return s.c().Remove(s.path(name))
+}
+
+func (s *SFTPStorage) Rename(oldname, newname string) error {
+	return s.c().PosixRename(s.path(oldname), s.path(newname))
+}
+
+// Close closes the SFTP session and the underlying SSH connection.
+func (s *SFTPStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.client.Close()
+	if cerr := s.conn.Close(); !errors.Is(cerr, net.ErrClosed) {
+		err = errors.Join(err, cerr)
+	}
+	return err
+}
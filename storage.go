@@ -0,0 +1,106 @@
+package tortugasync
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Storage is the remote filesystem a Bay syncs with.
+// Names are slash separated and relative to the root of the storage.
+type Storage interface {
+	Open(name string) (io.ReadCloser, error)
+	// Create creates or truncates the named file.
+	Create(name string) (io.WriteCloser, error)
+	Stat(name string) (fs.FileInfo, error)
+	List(dir string) ([]fs.FileInfo, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	Close() error
+}
+
+// contextStorage is implemented by the storages whose requests can be
+// cancelled on their own, without waiting for the next read or write.
+type contextStorage interface {
+	WithContext(ctx context.Context) Storage
+}
+
+// LocalStorage is a Storage backed by the local directory Root, useful for
+// syncing over USB or from a mounted share.
+type LocalStorage struct {
+	Root string
+}
+
+// path returns the local path of name, names can't escape Root.
+func (l LocalStorage) path(name string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (l LocalStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l LocalStorage) Create(name string) (io.WriteCloser, error) {
+	return os.Create(l.path(name))
+}
+
+func (l LocalStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(l.path(name))
+}
+
+func (l LocalStorage) List(dir string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(l.path(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var infos = make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+func (l LocalStorage) Remove(name string) error {
+	return os.Remove(l.path(name))
+}
+
+func (l LocalStorage) Rename(oldname, newname string) error {
+	return os.Rename(l.path(oldname), l.path(newname))
+}
+
+func (l LocalStorage) Close() error {
+	return nil
+}
+
+// fileInfo is the JSON representation of a fs.FileInfo.
+type fileInfo struct {
+	FName    string      `json:"name"`
+	FSize    int64       `json:"size"`
+	FMode    fs.FileMode `json:"mode"`
+	FModTime time.Time   `json:"mod_time"`
+}
+
+func newFileInfo(fi fs.FileInfo) fileInfo {
+	return fileInfo{
+		FName:    fi.Name(),
+		FSize:    fi.Size(),
+		FMode:    fi.Mode(),
+		FModTime: fi.ModTime(),
+	}
+}
+
+func (f fileInfo) Name() string       { return f.FName }
+func (f fileInfo) Size() int64        { return f.FSize }
+func (f fileInfo) Mode() fs.FileMode  { return f.FMode }
+func (f fileInfo) ModTime() time.Time { return f.FModTime }
+func (f fileInfo) IsDir() bool        { return f.FMode.IsDir() }
+func (f fileInfo) Sys() any           { return nil }